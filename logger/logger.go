@@ -1,15 +1,23 @@
 package logger
 
 import (
+	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io"
 	"os"
-	// "go.elastic.co/apm/module/apmzap/v2"
+	"strings"
+	"time"
 )
 
 var errorLogger *zap.SugaredLogger
 var logger *zap.Logger
-// var appConfig = config.InitConfig()
+
+// level of every output, changeable at runtime
+var level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+
+// outputs opened by Init, closed when it is called again
+var closers []io.Closer
 
 var levelMap = map[string]zapcore.Level{
 	"debug":  zapcore.DebugLevel,
@@ -28,16 +36,132 @@ func GetLoggerLevel(lvl string) zapcore.Level {
 	return zapcore.InfoLevel
 }
 
+// Config selects what is logged, how and where
+type Config struct {
+	// debug, info, warn, error, dpanic, panic or fatal, debug if empty
+	Level string
+	// json or console, json if empty
+	Format string
+	// stdout, stderr, syslog (the local daemon), syslog://host:port (UDP),
+	// syslog+tcp://host:port or file paths, stdout if empty
+	Outputs []string
+	// Rotation of file outputs
+	Rotation Rotation
+	// Sampling of repeated messages, nil logs every message
+	Sampling *Sampling
+}
+
+// Sampling logs the first Initial entries with the same level and message
+// per Tick, then every Thereafter-th of them
+type Sampling struct {
+	Tick       time.Duration
+	Initial    int
+	Thereafter int
+}
+
 func init() {
-	level := GetLoggerLevel("debug")
+	if err := Init(Config{}); err != nil {
+		panic(err)
+	}
+}
+
+// Init replaces the logger with one built from config. It is meant to be
+// called at startup, before other goroutines log.
+func Init(config Config) error {
+	lvl := zapcore.DebugLevel
+	if config.Level != "" {
+		var ok bool
+		if lvl, ok = levelMap[config.Level]; !ok {
+			return fmt.Errorf("invalid log level %q", config.Level)
+		}
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch config.Format {
+	case "json", "":
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "console":
+		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return fmt.Errorf("invalid log format %q", config.Format)
+	}
+
+	outputs := config.Outputs
+	if len(outputs) == 0 {
+		outputs = []string{"stdout"}
+	}
+	var cores []zapcore.Core
+	var opened []io.Closer
+	for _, output := range outputs {
+		core, closer, err := newCore(output, encoder.Clone(), config.Rotation)
+		if err != nil {
+			for _, c := range opened {
+				c.Close()
+			}
+			return fmt.Errorf("log output %s: %v", output, err)
+		}
+		cores = append(cores, core)
+		if closer != nil {
+			opened = append(opened, closer)
+		}
+	}
 
-	encoder := zap.NewProductionEncoderConfig()
-	encoder.EncodeTime = zapcore.ISO8601TimeEncoder
-	core := zapcore.NewTee(
-		zapcore.NewCore(zapcore.NewJSONEncoder(encoder), zapcore.AddSync(os.Stdout), level),
-	)
+	core := zapcore.NewTee(cores...)
+	if s := config.Sampling; s != nil {
+		core = zapcore.NewSamplerWithOptions(core, s.Tick, s.Initial, s.Thereafter)
+	}
+	level.SetLevel(lvl)
 	logger = zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1))
 	errorLogger = logger.Sugar()
+	for _, c := range closers {
+		c.Close()
+	}
+	closers = opened
+	return nil
+}
+
+// newCore writes to one output, the closer is nil for stdout and stderr
+func newCore(output string, encoder zapcore.Encoder, rotation Rotation) (zapcore.Core, io.Closer, error) {
+	switch {
+	case output == "stdout":
+		return zapcore.NewCore(encoder, zapcore.Lock(os.Stdout), level), nil, nil
+	case output == "stderr":
+		return zapcore.NewCore(encoder, zapcore.Lock(os.Stderr), level), nil, nil
+	case output == "syslog":
+		return newSyslogCore("", "", encoder)
+	case strings.HasPrefix(output, "syslog://"):
+		return newSyslogCore("udp", strings.TrimPrefix(output, "syslog://"), encoder)
+	case strings.HasPrefix(output, "syslog+tcp://"):
+		return newSyslogCore("tcp", strings.TrimPrefix(output, "syslog+tcp://"), encoder)
+	}
+	file, err := openRotatingFile(output, rotation)
+	if err != nil {
+		return nil, nil, err
+	}
+	return zapcore.NewCore(encoder, file, level), file, nil
+}
+
+// SetLevel changes the level of every output
+func SetLevel(lvl string) error {
+	l, ok := levelMap[lvl]
+	if !ok {
+		return fmt.Errorf("invalid log level %q", lvl)
+	}
+	level.SetLevel(l)
+	return nil
+}
+
+// Level returns the current level
+func Level() string {
+	return level.Level().String()
+}
+
+// Sync flushes buffered log entries
+func Sync() error {
+	return logger.Sync()
 }
 
 func WithTrace(messsage string, fields ...interface{}) {
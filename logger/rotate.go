@@ -0,0 +1,179 @@
+package logger
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated files, it sorts by time
+const backupTimeFormat = "20060102T150405.000"
+
+// Rotation moves a log file aside when it grows too large or gets too old
+type Rotation struct {
+	// Bytes a file may reach, 0 for no limit
+	MaxSize int64
+	// Rotate at multiples of Interval since the Unix epoch, like every 24h
+	// at midnight UTC, 0 to never rotate by time
+	Interval time.Duration
+	// Rotated files kept, 0 keeps all
+	MaxBackups int
+	// Gzip rotated files
+	Compress bool
+}
+
+// rotatingFile is a log file rotated as its Rotation says. Rotated files
+// are named after the file with the rotation time appended.
+type rotatingFile struct {
+	path     string
+	rotation Rotation
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// end of the interval the file was opened in
+	deadline time.Time
+
+	// serializes compressing and pruning the rotated files
+	cleanup sync.Mutex
+}
+
+func openRotatingFile(path string, rotation Rotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	if f.rotation.Interval > 0 {
+		f.deadline = time.Now().Truncate(f.rotation.Interval).Add(f.rotation.Interval)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.due(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file is rotated before writing n bytes
+func (f *rotatingFile) due(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.rotation.MaxSize > 0 && f.size+int64(n) > f.rotation.MaxSize {
+		return true
+	}
+	return f.rotation.Interval > 0 && !time.Now().Before(f.deadline)
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backup := f.path + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.clean(backup)
+	return nil
+}
+
+// clean compresses the rotated file and removes the oldest ones beyond
+// MaxBackups
+func (f *rotatingFile) clean(backup string) {
+	f.cleanup.Lock()
+	defer f.cleanup.Unlock()
+	if f.rotation.Compress {
+		if err := compress(backup); err != nil {
+			Errorf("Failed to compress %s: %s", backup, err)
+		}
+	}
+	if f.rotation.MaxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(match, f.path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, name); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > f.rotation.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (f *rotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Sync()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
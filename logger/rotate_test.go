@@ -0,0 +1,136 @@
+package logger
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backups returns the rotated files of path, oldest first
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// cleaned reports whether files are the want backups, compressed if compress
+func cleaned(files []string, want int, compress bool) bool {
+	if len(files) != want {
+		return false
+	}
+	for _, file := range files {
+		if compress != strings.HasSuffix(file, ".gz") {
+			return false
+		}
+	}
+	return true
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		rotation    Rotation
+		writes      []string
+		wantCurrent string
+		wantBackups []string
+	}{
+		{"no rotation", Rotation{}, []string{"aaaa\n", "bbbb\n"}, "aaaa\nbbbb\n", nil},
+		{"size", Rotation{MaxSize: 8}, []string{"aaaa\n", "bbbb\n", "cccc\n"}, "cccc\n", []string{"aaaa\n", "bbbb\n"}},
+		{"larger than the size", Rotation{MaxSize: 2}, []string{"aaaa\n"}, "aaaa\n", nil},
+		{"max backups", Rotation{MaxSize: 5, MaxBackups: 1}, []string{"aaaa\n", "bbbb\n", "cccc\n"}, "cccc\n", []string{"bbbb\n"}},
+		{"compressed", Rotation{MaxSize: 5, Compress: true}, []string{"aaaa\n", "bbbb\n"}, "bbbb\n", []string{"aaaa\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "proxy.log")
+			f, err := openRotatingFile(path, tt.rotation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			for _, w := range tt.writes {
+				if _, err := f.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+				// backups are named by the millisecond
+				time.Sleep(2 * time.Millisecond)
+			}
+			if got := readFile(t, path); got != tt.wantCurrent {
+				t.Errorf("current file %q, want %q", got, tt.wantCurrent)
+			}
+			// rotated files are cleaned up aside
+			files := backups(t, path)
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !cleaned(files, len(tt.wantBackups), tt.rotation.Compress); {
+				time.Sleep(10 * time.Millisecond)
+				files = backups(t, path)
+			}
+			if len(files) != len(tt.wantBackups) {
+				t.Fatalf("backups %v, want %d", files, len(tt.wantBackups))
+			}
+			for i, file := range files {
+				if tt.rotation.Compress != strings.HasSuffix(file, ".gz") {
+					t.Errorf("backup %s compressed %v", file, !tt.rotation.Compress)
+				}
+				if got := readFile(t, file); got != tt.wantBackups[i] {
+					t.Errorf("backup %s holds %q, want %q", file, got, tt.wantBackups[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFileInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := openRotatingFile(path, Rotation{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("old\n"))
+	if f.due(4) {
+		t.Fatal("rotation due within the interval")
+	}
+	// the interval ended
+	f.deadline = time.Now().Add(-time.Second)
+	f.Write([]byte("new\n"))
+	if got := readFile(t, path); got != "new\n" {
+		t.Errorf("current file %q, want %q", got, "new\n")
+	}
+	if !f.deadline.After(time.Now()) {
+		t.Error("deadline not moved to the next interval")
+	}
+	if files := backups(t, path); len(files) != 1 || readFile(t, files[0]) != "old\n" {
+		t.Errorf("backups %v, want one holding old", files)
+	}
+}
@@ -0,0 +1,177 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// facilityDaemon is the syslog facility of the entries
+const facilityDaemon = 3
+
+// syslogWriter sends RFC 5424 messages to a syslog daemon
+type syslogWriter struct {
+	network, addr string
+	hostname, app string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// dialSyslog connects to the daemon at addr, the local one if network is empty
+func dialSyslog(network, addr string) (*syslogWriter, error) {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{network: network, addr: addr, hostname: hostname, app: filepath.Base(os.Args[0])}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// DialSyslog connects to a syslog daemon like the syslog outputs of the log
+// do, the local one if network is empty. Each Write of the writer is sent
+// as one informational message.
+func DialSyslog(network, addr string) (io.WriteCloser, error) {
+	w, err := dialSyslog(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	if w.network != "" {
+		conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+		return nil
+	}
+	var err error
+	for _, network := range []string{"unixgram", "unix"} {
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			var conn net.Conn
+			if conn, err = net.Dial(network, path); err == nil {
+				w.network = network
+				w.addr = path
+				w.conn = conn
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// write sends msg with the severity, reconnecting once if that fails
+func (w *syslogWriter) write(severity int, msg []byte) error {
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		facilityDaemon*8+severity, time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, w.app, os.Getpid(), msg)
+	if w.network == "tcp" || w.network == "unix" {
+		// octet counting framing of RFC 6587
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		if _, err := w.conn.Write([]byte(line)); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	if err := w.connect(); err != nil {
+		return err
+	}
+	_, err := w.conn.Write([]byte(line))
+	return err
+}
+
+// Write sends p as one informational message
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	if err := w.write(severity(zapcore.InfoLevel), bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
+
+// syslogCore sends each entry as a message with the severity of its level
+type syslogCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	w       *syslogWriter
+}
+
+func newSyslogCore(network, addr string, encoder zapcore.Encoder) (zapcore.Core, *syslogWriter, error) {
+	w, err := dialSyslog(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &syslogCore{LevelEnabler: level, encoder: encoder, w: w}, w, nil
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := c.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	return &syslogCore{LevelEnabler: c.LevelEnabler, encoder: encoder, w: c.w}
+}
+
+func (c *syslogCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *syslogCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+	return c.w.write(severity(entry.Level), bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
+
+func severity(l zapcore.Level) int {
+	switch l {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	case zapcore.DPanicLevel:
+		return 2
+	case zapcore.PanicLevel:
+		return 1
+	}
+	return 0
+}
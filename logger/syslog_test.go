@@ -0,0 +1,141 @@
+package logger
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// header matches the RFC 5424 header up to the message
+var header = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ \S+ \d+ - - `)
+
+// listenSyslog returns a daemon address on network and a function
+// returning the next message it gets
+func listenSyslog(t *testing.T, network string) (string, func() string) {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn.LocalAddr().String(), func() string {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 4096)
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(buf[:n])
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+			conns <- conn
+		}
+	}()
+	var r *bufio.Reader
+	return listener.Addr().String(), func() string {
+		if r == nil {
+			r = bufio.NewReader(<-conns)
+		}
+		// octet counting framing
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			t.Fatalf("invalid frame length %q", length)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		return string(msg)
+	}
+}
+
+// parse splits a message into its priority and text
+func parse(t *testing.T, msg string) (int, string) {
+	t.Helper()
+	m := header.FindStringSubmatch(msg)
+	if m == nil {
+		t.Fatalf("message %q lacks an RFC 5424 header", msg)
+	}
+	priority, _ := strconv.Atoi(m[1])
+	return priority, msg[len(m[0]):]
+}
+
+func TestDialSyslog(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			addr, next := listenSyslog(t, network)
+			w, err := DialSyslog(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			for _, line := range []string{`{"user":"alice"}` + "\n", "no newline"} {
+				if n, err := w.Write([]byte(line)); err != nil || n != len(line) {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+				priority, text := parse(t, next())
+				// daemon facility, informational severity
+				if priority != 3*8+6 {
+					t.Errorf("priority %d, want %d", priority, 3*8+6)
+				}
+				if text != strings.TrimSuffix(line, "\n") {
+					t.Errorf("message %q, want %q", text, strings.TrimSuffix(line, "\n"))
+				}
+			}
+		})
+	}
+}
+
+func TestSyslogOutput(t *testing.T) {
+	addr, next := listenSyslog(t, "udp")
+	if err := Init(Config{Level: "info", Format: "console", Outputs: []string{"syslog://" + addr}}); err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Config{})
+
+	tests := []struct {
+		log          func(template string, args ...interface{})
+		wantSeverity int
+		wantLevel    string
+	}{
+		{Infof, 6, "INFO"},
+		{Warnf, 4, "WARN"},
+		{Errorf, 3, "ERROR"},
+	}
+	for _, tt := range tests {
+		tt.log("hello %s", "syslog")
+		priority, text := parse(t, next())
+		if priority != 3*8+tt.wantSeverity {
+			t.Errorf("%s: priority %d, want %d", tt.wantLevel, priority, 3*8+tt.wantSeverity)
+		}
+		if !strings.Contains(text, tt.wantLevel) || !strings.HasSuffix(text, "hello syslog") {
+			t.Errorf("message %q", text)
+		}
+	}
+	// below the level, nothing is sent; the next message is the one after
+	Debugf("hidden")
+	Infof("shown")
+	if _, text := parse(t, next()); !strings.HasSuffix(text, "shown") {
+		t.Errorf("message %q, want the one after the debug one", text)
+	}
+}
@@ -1,71 +1,755 @@
 package main
 
 import (
-    "flag"
-    "fmt"
-    "net"
-    "os"
-    "strings"
-
-    "github.com/joho/godotenv"
-    "github.com/thifnmi/proxy-socks-server/logger"
-    "github.com/thifnmi/proxy-socks-server/server"
-    "github.com/thifnmi/proxy-socks-server/server/auth"
-    "github.com/thifnmi/proxy-socks-server/utils"
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/thifnmi/proxy-socks-server/logger"
+	"github.com/thifnmi/proxy-socks-server/metrics"
+	"github.com/thifnmi/proxy-socks-server/server"
+	"github.com/thifnmi/proxy-socks-server/server/accesslog"
+	"github.com/thifnmi/proxy-socks-server/server/acl"
+	"github.com/thifnmi/proxy-socks-server/server/auth"
+	"github.com/thifnmi/proxy-socks-server/server/auth/kerberos"
+	"github.com/thifnmi/proxy-socks-server/server/connlimit"
+	"github.com/thifnmi/proxy-socks-server/server/listenfd"
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/server/quota"
+	"github.com/thifnmi/proxy-socks-server/server/ratelimit"
+	"github.com/thifnmi/proxy-socks-server/utils"
 )
 
 func main() {
-    // Load .env file
-    _ = godotenv.Load()
-
-    bindAddr := flag.String("addr", "0.0.0.0", "socks server bind address (optional)")
-    bindPort := flag.String("port", "1081", "socks server bind port (optional)")
-    dnsAddr := flag.String("dns", "", "specify a dns server (ip:port) to be used for resolving domains (optional)")
-    flag.Parse()
-
-    var resolver utils.Resolver
-    if *dnsAddr == "" {
-        resolver = utils.DefaultResolver{}
-    } else {
-        if _, _, err := net.SplitHostPort(*dnsAddr); err != nil {
-            logger.Info("DNS server should be in this format 'ip:port'")
-            return
-        }
-        logger.Infof("DNS server %v", *dnsAddr)
-        resolver = utils.NewCustomResolver(*dnsAddr)
-    }
-
-    // Get credentials from environment variables
-    userList := os.Getenv("SOCKS_USERS")
-    passList := os.Getenv("SOCKS_PASSWORDS")
-    if userList == "" || passList == "" {
-        logger.Info("SOCKS_USERS and SOCKS_PASSWORDS must be set in .env file")
-        return
-    }
-    usernames := strings.Split(userList, ",")
-    passwords := strings.Split(passList, ",")
-
-    if len(usernames) != len(passwords) {
-        logger.Info("SOCKS_USERS and SOCKS_PASSWORDS must have the same number of entries")
-        return
-    }
-
-    creds := auth.StaticCredentials{}
-    for i := range usernames {
-        creds[usernames[i]] = passwords[i]
-    }
-    cator := auth.UserPassAuthenticator{Credentials: creds}
-
-    config := &utils.Config{
-        AuthMethods: []auth.Authenticator{cator},
-        Credentials: creds,
-        Resolv:      resolver,
-    }
-    bindListenner := fmt.Sprintf("%s:%s", *bindAddr, *bindPort)
-
-    s := server.NewSocksServer(config)
-    err := s.ListenAndServe("tcp", bindListenner)
-    if err != nil {
-        logger.Infof("Failed to listen socks server: %s", err)
-    }
-}
\ No newline at end of file
+	// Load .env file
+	_ = godotenv.Load()
+
+	logConfig, err := loggerConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := logger.Init(logConfig); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+	go toggleDebugOnSignal(logger.Level())
+
+	if len(os.Args) > 1 && os.Args[1] == "quota" {
+		if err := runQuotaCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	bindAddr := flag.String("addr", "0.0.0.0", "socks server bind address (optional)")
+	bindPort := flag.String("port", "1081", "socks server bind port (optional)")
+	dnsAddr := flag.String("dns", "", "specify comma separated dns servers (ip:port, udp://, tls:// or https:// URLs) to be used for resolving domains (optional)")
+	extraListeners := flag.String("listen", "", "additional comma separated addresses (ip:port) to serve on (optional)")
+	flag.Parse()
+
+	// Options of the dns servers given by -dns and the dns routes
+	var dnsOptions utils.DNSOptions
+	if bootstrap := os.Getenv("SOCKS_DNS_BOOTSTRAP"); bootstrap != "" {
+		for _, s := range strings.Split(bootstrap, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				logger.Infof("SOCKS_DNS_BOOTSTRAP: invalid address %q", s)
+				return
+			}
+			dnsOptions.Bootstrap = append(dnsOptions.Bootstrap, ip)
+		}
+	}
+	if value := os.Getenv("SOCKS_DNS_TIMEOUT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			logger.Info("SOCKS_DNS_TIMEOUT must be a duration like 3s")
+			return
+		}
+		dnsOptions.Timeout = d
+	}
+	dnsOptions.UseGET = os.Getenv("SOCKS_DNS_HTTP_METHOD") == "GET"
+	dnsOptions.ADPassThrough = os.Getenv("SOCKS_DNS_AD_PASSTHROUGH") == "true"
+	strategy, err := utils.ParseStrategy(os.Getenv("SOCKS_DNS_STRATEGY"))
+	if err != nil {
+		logger.Infof("SOCKS_DNS_STRATEGY: %s", err)
+		return
+	}
+	dnsOptions.Strategy = strategy
+
+	var resolver utils.Resolver
+	// forwards queries the fake ip DNS server does not answer itself
+	var forward utils.Exchanger
+	if *dnsAddr == "" {
+		resolver = utils.DefaultResolver{}
+	} else {
+		dnsResolver, err := utils.NewDNSResolvers(strings.Split(*dnsAddr, ","), dnsOptions)
+		if err != nil {
+			logger.Infof("Invalid -dns: %s", err)
+			return
+		}
+		resolver, forward = dnsResolver, dnsResolver
+		logger.Infof("DNS server %v", *dnsAddr)
+	}
+
+	// reloaders run on SIGHUP
+	var reloaders []func()
+
+	// Destination names the dialer resolves itself, for all names or per route
+	remoteDNS := os.Getenv("SOCKS_DNS_REMOTE") == "true"
+	var resolveRemotely func(name string) bool
+	if remoteDNS {
+		resolveRemotely = func(string) bool { return true }
+	}
+
+	// Split horizon dns routes and static hosts, reloaded when the files change
+	routesFile := os.Getenv("SOCKS_DNS_ROUTES_FILE")
+	hostsFile := os.Getenv("SOCKS_HOSTS_FILE")
+	if routesFile != "" || hostsFile != "" {
+		routing, err := utils.NewRoutingResolver(resolver, routesFile, hostsFile, dnsOptions)
+		if err != nil {
+			logger.Infof("Failed to load dns routes: %s", err)
+			return
+		}
+		routing.DefaultRemote = remoteDNS
+		resolver = routing
+		resolveRemotely = routing.Remote
+		go routing.WatchEvery(5 * time.Second)
+		reloaders = append(reloaders, func() {
+			if err := routing.Reload(); err != nil {
+				logger.Infof("Failed to reload dns routes: %s", err)
+				return
+			}
+			logger.Info("Reloaded dns routes and hosts")
+		})
+	}
+
+	// Cache answers when SOCKS_DNS_CACHE_SIZE is set
+	if value := os.Getenv("SOCKS_DNS_CACHE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			logger.Info("SOCKS_DNS_CACHE_SIZE must be a non-negative number")
+			return
+		}
+		options := utils.CacheOptions{Size: size}
+		for env, ttl := range map[string]*time.Duration{
+			"SOCKS_DNS_CACHE_MIN_TTL":      &options.MinTTL,
+			"SOCKS_DNS_CACHE_MAX_TTL":      &options.MaxTTL,
+			"SOCKS_DNS_CACHE_NEGATIVE_TTL": &options.NegativeTTL,
+			"SOCKS_DNS_CACHE_STALE_TTL":    &options.StaleTTL,
+		} {
+			if value := os.Getenv(env); value != "" {
+				d, err := time.ParseDuration(value)
+				if err != nil || d < 0 {
+					logger.Infof("%s must be a duration like 30s", env)
+					return
+				}
+				*ttl = d
+			}
+		}
+		if size > 0 {
+			cache := utils.NewCachingResolver(resolver, options)
+			resolver = cache
+			for _, counter := range []struct {
+				name, help string
+				value      func(utils.CacheStats) uint64
+			}{
+				{"socks_dns_cache_hits_total", "Lookups answered from a fresh cache entry.", func(s utils.CacheStats) uint64 { return s.Hits }},
+				{"socks_dns_cache_stale_hits_total", "Lookups answered from an expired cache entry being refreshed.", func(s utils.CacheStats) uint64 { return s.StaleHits }},
+				{"socks_dns_cache_negative_hits_total", "Lookups answered no such host from the cache.", func(s utils.CacheStats) uint64 { return s.NegativeHits }},
+				{"socks_dns_cache_misses_total", "Lookups sent upstream.", func(s utils.CacheStats) uint64 { return s.Misses }},
+				{"socks_dns_cache_deduplicated_total", "Lookups joining one in flight for the same name.", func(s utils.CacheStats) uint64 { return s.Deduplicated }},
+				{"socks_dns_cache_evictions_total", "Cache entries dropped to stay within the size.", func(s utils.CacheStats) uint64 { return s.Evictions }},
+			} {
+				value := counter.value
+				metrics.NewCounterFunc(counter.name, counter.help, func() float64 { return float64(value(cache.Stats())) })
+			}
+			metrics.NewGaugeFunc("socks_dns_cache_entries", "Names in the DNS cache.", func() float64 { return float64(cache.Stats().Entries) })
+			reloaders = append(reloaders, func() {
+				stats := cache.Stats()
+				logger.Infof("DNS cache: %d entries, %d hits, %d stale hits, %d negative hits, %d misses, %d deduplicated, %d evictions",
+					stats.Entries, stats.Hits, stats.StaleHits, stats.NegativeHits, stats.Misses, stats.Deduplicated, stats.Evictions)
+			})
+		}
+	}
+
+	var clientACL *acl.ACL
+	if aclFile := os.Getenv("SOCKS_ACL_FILE"); aclFile != "" {
+		var err error
+		clientACL, err = acl.Load(aclFile)
+		if err != nil {
+			logger.Infof("Failed to load acl: %s", err)
+			return
+		}
+		reloaders = append(reloaders, func() {
+			if err := clientACL.Reload(); err != nil {
+				logger.Infof("Failed to reload acl: %s", err)
+				return
+			}
+			logger.Infof("Reloaded acl from %s", aclFile)
+		})
+	}
+
+	// Fake ip DNS server for transparent proxying, connections to the fake
+	// addresses it hands out are dialed by name
+	var fakeIPs *utils.FakeIPPool
+	var dnsServer *utils.DNSServer
+	if listen := os.Getenv("SOCKS_FAKEIP_DNS_LISTEN"); listen != "" {
+		range4 := os.Getenv("SOCKS_FAKEIP_RANGE")
+		if range4 == "" {
+			range4 = "198.18.0.0/15"
+		}
+		fakeIPs, err = utils.NewFakeIPPool(range4, os.Getenv("SOCKS_FAKEIP_RANGE6"), os.Getenv("SOCKS_FAKEIP_STORE"))
+		if err != nil {
+			logger.Infof("Failed to set up fake ip pool: %s", err)
+			return
+		}
+		go fakeIPs.FlushEvery(10 * time.Second)
+		fakeResolver := &utils.FakeIPResolver{Pool: fakeIPs, Real: resolver}
+		if exclude := os.Getenv("SOCKS_FAKEIP_EXCLUDE"); exclude != "" {
+			fakeResolver.Exclude = strings.Split(exclude, ",")
+		}
+		dnsServer = &utils.DNSServer{Resolver: fakeResolver, Forward: forward, ACL: clientACL}
+		go func() {
+			if err := dnsServer.ListenAndServe(listen); err != nil && err != utils.ErrDNSServerClosed {
+				logger.Infof("Failed to serve dns on %s: %s", listen, err)
+			}
+		}()
+	}
+
+	var authMethods []auth.Authenticator
+
+	// Bearer token verifiers, used by the private token method
+	var verifiers auth.TokenVerifiers
+	claimChecks := auth.ClaimChecks{
+		Audience: os.Getenv("SOCKS_TOKEN_AUDIENCE"),
+		Issuer:   os.Getenv("SOCKS_TOKEN_ISSUER"),
+
+		AllowNoExpiry: os.Getenv("SOCKS_TOKEN_ALLOW_NO_EXPIRY") == "true",
+	}
+	if secret := os.Getenv("SOCKS_TOKEN_HMAC_SECRET"); secret != "" {
+		verifiers = append(verifiers, &auth.HMACVerifier{Secret: []byte(secret), ClaimChecks: claimChecks})
+	}
+	if jwksFile := os.Getenv("SOCKS_TOKEN_JWKS_FILE"); jwksFile != "" {
+		jwks, err := auth.LoadJWKS(jwksFile, claimChecks)
+		if err != nil {
+			logger.Infof("Failed to load jwks: %s", err)
+			return
+		}
+		verifiers = append(verifiers, jwks)
+	}
+	if len(verifiers) > 0 {
+		authMethods = append(authMethods, auth.TokenAuthenticator{
+			Verifier:      verifiers,
+			UsernameClaim: os.Getenv("SOCKS_TOKEN_USERNAME_CLAIM"),
+		})
+	}
+
+	// Kerberos principals through GSSAPI
+	if keytabFile := os.Getenv("SOCKS_GSSAPI_KEYTAB"); keytabFile != "" {
+		krbService, err := kerberos.Load(keytabFile, os.Getenv("SOCKS_GSSAPI_PRINCIPAL"))
+		if err != nil {
+			logger.Infof("Failed to load GSSAPI keytab: %s", err)
+			return
+		}
+		authMethods = append(authMethods, auth.GSSAPIAuthenticator{NewAcceptor: krbService.NewAcceptor})
+	}
+
+	// Get credentials from environment variables
+	userList := os.Getenv("SOCKS_USERS")
+	passList := os.Getenv("SOCKS_PASSWORDS")
+	var stores auth.CredentialStores
+	if userList != "" && passList != "" {
+		usernames := strings.Split(userList, ",")
+		passwords := strings.Split(passList, ",")
+
+		if len(usernames) != len(passwords) {
+			logger.Info("SOCKS_USERS and SOCKS_PASSWORDS must have the same number of entries")
+			return
+		}
+
+		staticCreds := auth.StaticCredentials{}
+		for i := range usernames {
+			staticCreds[usernames[i]] = passwords[i]
+		}
+		stores = append(stores, staticCreds)
+	}
+	// User records with validity windows
+	if accountsFile := os.Getenv("SOCKS_ACCOUNTS_FILE"); accountsFile != "" {
+		accounts, err := auth.LoadAccounts(accountsFile)
+		if err != nil {
+			logger.Infof("Failed to load accounts: %s", err)
+			return
+		}
+		stores = append(stores, accounts)
+		reloaders = append(reloaders, func() {
+			if err := accounts.Reload(); err != nil {
+				logger.Infof("Failed to reload accounts: %s", err)
+				return
+			}
+			logger.Infof("Reloaded accounts from %s", accountsFile)
+		})
+	}
+	// Tokens in the password field
+	if os.Getenv("SOCKS_PASSWORD_TOKENS") == "true" {
+		if len(verifiers) == 0 {
+			logger.Info("SOCKS_PASSWORD_TOKENS needs SOCKS_TOKEN_HMAC_SECRET or SOCKS_TOKEN_JWKS_FILE")
+			return
+		}
+		stores = append(stores, auth.TokenCredentials{
+			Verifier:      verifiers,
+			UsernameClaim: os.Getenv("SOCKS_TOKEN_USERNAME_CLAIM"),
+		})
+	}
+
+	var creds auth.CredentialStore
+	if len(stores) == 0 {
+		if len(authMethods) == 0 {
+			logger.Info("SOCKS_USERS and SOCKS_PASSWORDS must be set in .env file")
+			return
+		}
+	} else {
+		creds = stores
+		cator := auth.UserPassAuthenticator{Credentials: creds}
+		if guardFile := os.Getenv("SOCKS_AUTH_GUARD_FILE"); guardFile != "" {
+			guardConfig, err := auth.LoadGuardConfig(guardFile)
+			if err != nil {
+				logger.Infof("Failed to load auth guard: %s", err)
+				return
+			}
+			cator.Guard = auth.NewGuard(guardConfig)
+		}
+		authMethods = append(authMethods, cator)
+	}
+
+	var userPolicy *policy.Policy
+	if policyFile := os.Getenv("SOCKS_POLICY_FILE"); policyFile != "" {
+		p, err := policy.Load(policyFile)
+		if err != nil {
+			logger.Infof("Failed to load policy: %s", err)
+			return
+		}
+		logger.Infof("Loaded %d policy rules from %s", len(p.Rules), policyFile)
+		userPolicy = p
+	}
+
+	var limiter *ratelimit.Limiter
+	if limitFile := os.Getenv("SOCKS_RATELIMIT_FILE"); limitFile != "" {
+		limits, err := ratelimit.Load(limitFile)
+		if err != nil {
+			logger.Infof("Failed to load rate limits: %s", err)
+			return
+		}
+		limiter = ratelimit.New(limits)
+		reloaders = append(reloaders, func() {
+			limits, err := ratelimit.Load(limitFile)
+			if err != nil {
+				logger.Infof("Failed to reload rate limits: %s", err)
+				return
+			}
+			limiter.SetLimits(limits)
+			logger.Infof("Reloaded rate limits from %s", limitFile)
+		})
+	}
+
+	var tracker *quota.Tracker
+	if quotaFile := os.Getenv("SOCKS_QUOTA_FILE"); quotaFile != "" {
+		quotaConfig, err := quota.Load(quotaFile)
+		if err != nil {
+			logger.Infof("Failed to load quotas: %s", err)
+			return
+		}
+		tracker, err = quota.New(quotaConfig)
+		if err != nil {
+			logger.Infof("Failed to open quota store: %s", err)
+			return
+		}
+		go tracker.FlushEvery(10 * time.Second)
+	}
+
+	var connLimits connlimit.Limits
+	for env, limit := range map[string]*int{
+		"SOCKS_MAX_CONNS":          &connLimits.Global,
+		"SOCKS_MAX_CONNS_PER_IP":   &connLimits.PerIP,
+		"SOCKS_MAX_CONNS_PER_USER": &connLimits.PerUser,
+	} {
+		if value := os.Getenv(env); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				logger.Infof("%s must be a non-negative number", env)
+				return
+			}
+			*limit = n
+		}
+	}
+
+	prefer, err := utils.ParseFamilyPreference(os.Getenv("SOCKS_DIAL_PREFER"))
+	if err != nil {
+		logger.Infof("SOCKS_DIAL_PREFER: %s", err)
+		return
+	}
+	happyEyeballs := utils.HappyEyeballs{Prefer: prefer}
+	if value := os.Getenv("SOCKS_DIAL_ATTEMPT_DELAY"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			logger.Info("SOCKS_DIAL_ATTEMPT_DELAY must be a duration like 250ms")
+			return
+		}
+		happyEyeballs.AttemptDelay = d
+	}
+
+	// Learn host names of address requests from TLS SNI and HTTP Host
+	var sniffTimeout time.Duration
+	if value := os.Getenv("SOCKS_SNIFF_TIMEOUT"); value != "" {
+		sniffTimeout, err = time.ParseDuration(value)
+		if err != nil || sniffTimeout < 0 {
+			logger.Info("SOCKS_SNIFF_TIMEOUT must be a duration like 300ms")
+			return
+		}
+	}
+
+	// One JSON record per session to stdout, a file or syslog
+	var accessLog *accesslog.Log
+	if dest := os.Getenv("SOCKS_ACCESS_LOG"); dest != "" {
+		accessLog, err = accesslog.Open(dest)
+		if err != nil {
+			logger.Infof("Failed to open access log %s: %s", dest, err)
+			return
+		}
+		reloaders = append(reloaders, func() {
+			if err := accessLog.Reopen(); err != nil {
+				logger.Infof("Failed to reopen access log %s: %s", dest, err)
+			}
+		})
+	}
+
+	config := &utils.Config{
+		AuthMethods:     authMethods,
+		Credentials:     creds,
+		Resolv:          resolver,
+		ResolveRemotely: resolveRemotely,
+		FakeIP:          fakeIPs,
+		HappyEyeballs:   happyEyeballs,
+		SniffTimeout:    sniffTimeout,
+		Policy:          userPolicy,
+		RateLimiter:     limiter,
+		Quota:           tracker,
+		ConnLimiter:     connlimit.New(connLimits),
+		ACL:             clientACL,
+		AccessLog:       accessLog,
+	}
+	bindListenner := fmt.Sprintf("%s:%s", *bindAddr, *bindPort)
+	go reloadOnHangup(reloaders)
+
+	// Prometheus metrics, the byte counters keep at most
+	// SOCKS_METRICS_MAX_USERS users apart
+	var metricsServer *http.Server
+	if listen := os.Getenv("SOCKS_METRICS_LISTEN"); listen != "" {
+		if value := os.Getenv("SOCKS_METRICS_MAX_USERS"); value != "" {
+			maxUsers, err := strconv.Atoi(value)
+			if err != nil || maxUsers < 1 {
+				logger.Info("SOCKS_METRICS_MAX_USERS must be a positive number")
+				return
+			}
+			metrics.SetMaxUsers(maxUsers)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{Handler: mux}
+		go func() {
+			l, err := listenfd.Listen("tcp", listen)
+			if err != nil {
+				logger.Infof("Failed to listen metrics on %s: %s", listen, err)
+				return
+			}
+			logger.Infof("Serving metrics on %s", listen)
+			metricsServer.Serve(l)
+		}()
+	}
+
+	// Sessions are drained for up to SOCKS_SHUTDOWN_TIMEOUT on SIGINT and SIGTERM
+	shutdownTimeout := 30 * time.Second
+	if value := os.Getenv("SOCKS_SHUTDOWN_TIMEOUT"); value != "" {
+		shutdownTimeout, err = time.ParseDuration(value)
+		if err != nil || shutdownTimeout < 0 {
+			logger.Info("SOCKS_SHUTDOWN_TIMEOUT must be a duration like 30s")
+			return
+		}
+	}
+
+	s := server.NewSocksServer(config)
+	// Admin API to list and kill sessions, protected by SOCKS_ADMIN_TOKEN
+	var adminServer *http.Server
+	if listen := os.Getenv("SOCKS_ADMIN_LISTEN"); listen != "" {
+		token := os.Getenv("SOCKS_ADMIN_TOKEN")
+		if token == "" {
+			logger.Info("SOCKS_ADMIN_TOKEN must be set to serve the admin API")
+			return
+		}
+		adminServer = &http.Server{Handler: s.AdminHandler(token)}
+		go func() {
+			l, err := listenfd.Listen("tcp", listen)
+			if err != nil {
+				logger.Infof("Failed to listen admin API on %s: %s", listen, err)
+				return
+			}
+			logger.Infof("Serving admin API on %s", listen)
+			adminServer.Serve(l)
+		}()
+	}
+	// The DNS, metrics and admin servers stop before the sessions drain,
+	// after an upgrade the new process answers on their sockets
+	stopServers := func() {
+		if dnsServer != nil {
+			dnsServer.Close()
+		}
+		if fakeIPs != nil {
+			if err := fakeIPs.Flush(); err != nil {
+				logger.Infof("Failed to store fake ip mappings: %s", err)
+			}
+		}
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+		if adminServer != nil {
+			adminServer.Close()
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(s, shutdownTimeout, stopServers)
+		if tracker != nil {
+			if err := tracker.Flush(); err != nil {
+				logger.Infof("Failed to flush traffic counters: %s", err)
+			}
+		}
+		close(stopped)
+	}()
+	if *extraListeners != "" {
+		for _, addr := range strings.Split(*extraListeners, ",") {
+			go func(addr string) {
+				if err := s.ListenAndServe("tcp", addr); err != nil && err != server.ErrServerClosed {
+					logger.Infof("Failed to listen socks server on %s: %s", addr, err)
+				}
+			}(strings.TrimSpace(addr))
+		}
+	}
+	// Transparent proxying of iptables REDIRECT and TPROXY traffic
+	if value := os.Getenv("SOCKS_TRANSPARENT_LISTEN"); value != "" {
+		for _, addr := range strings.Split(value, ",") {
+			go func(addr string) {
+				if err := s.ListenAndServeTransparent(addr, false); err != nil && err != server.ErrServerClosed {
+					logger.Infof("Failed to listen transparent proxy on %s: %s", addr, err)
+				}
+			}(strings.TrimSpace(addr))
+		}
+	}
+	if value := os.Getenv("SOCKS_TPROXY_LISTEN"); value != "" {
+		for _, addr := range strings.Split(value, ",") {
+			go func(addr string) {
+				if err := s.ListenAndServeTransparent(addr, true); err != nil && err != server.ErrServerClosed {
+					logger.Infof("Failed to listen tproxy on %s: %s", addr, err)
+				}
+			}(strings.TrimSpace(addr))
+			go func(addr string) {
+				if err := s.ListenAndServeTransparentUDP(addr); err != nil && err != server.ErrServerClosed {
+					logger.Infof("Failed to listen tproxy udp on %s: %s", addr, err)
+				}
+			}(strings.TrimSpace(addr))
+		}
+	}
+	// a process upgraded from may shut down now
+	listenfd.Ready()
+	if err := s.ListenAndServe("tcp", bindListenner); err != server.ErrServerClosed {
+		logger.Infof("Failed to listen socks server: %s", err)
+		return
+	}
+	<-stopped
+}
+
+// shutdownOnSignal shuts the server down on SIGINT or SIGTERM, or on SIGUSR2
+// once a new process took over the listening sockets, waiting up to timeout
+// for the sessions to end. A second SIGINT or SIGTERM kills them right away.
+// stop is called before the sessions are drained.
+func shutdownOnSignal(s *server.SocksServer, timeout time.Duration, stop func()) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	upgrade := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgrade, upgradeSignals...)
+	}
+	for {
+		select {
+		case received := <-sig:
+			logger.Infof("Received %s, shutting down, sessions have %s to end", received, timeout)
+		case <-upgrade:
+			pid, err := listenfd.Upgrade()
+			if err != nil {
+				logger.Infof("Failed to upgrade: %s", err)
+				continue
+			}
+			logger.Infof("Upgraded to process %d, shutting down, sessions have %s to end", pid, timeout)
+		}
+		break
+	}
+	stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Infof("Shut down with sessions killed: %s", err)
+		return
+	}
+	logger.Info("Shut down")
+}
+
+// loggerConfig reads the SOCKS_LOG_* settings
+func loggerConfig() (logger.Config, error) {
+	config := logger.Config{
+		Level:  os.Getenv("SOCKS_LOG_LEVEL"),
+		Format: os.Getenv("SOCKS_LOG_FORMAT"),
+	}
+	if value := os.Getenv("SOCKS_LOG_OUTPUTS"); value != "" {
+		for _, output := range strings.Split(value, ",") {
+			config.Outputs = append(config.Outputs, strings.TrimSpace(output))
+		}
+	}
+	if value := os.Getenv("SOCKS_LOG_MAX_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return config, fmt.Errorf("SOCKS_LOG_MAX_SIZE must be a number of bytes")
+		}
+		config.Rotation.MaxSize = size
+	}
+	if value := os.Getenv("SOCKS_LOG_ROTATE_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return config, fmt.Errorf("SOCKS_LOG_ROTATE_INTERVAL must be a duration like 24h")
+		}
+		config.Rotation.Interval = interval
+	}
+	if value := os.Getenv("SOCKS_LOG_MAX_BACKUPS"); value != "" {
+		backups, err := strconv.Atoi(value)
+		if err != nil || backups < 0 {
+			return config, fmt.Errorf("SOCKS_LOG_MAX_BACKUPS must be a non-negative number")
+		}
+		config.Rotation.MaxBackups = backups
+	}
+	config.Rotation.Compress = os.Getenv("SOCKS_LOG_COMPRESS") == "true"
+	// "initial,thereafter" entries with the same message per second
+	if value := os.Getenv("SOCKS_LOG_SAMPLING"); value != "" {
+		initialStr, thereafterStr, _ := strings.Cut(value, ",")
+		initial, err1 := strconv.Atoi(initialStr)
+		thereafter, err2 := strconv.Atoi(thereafterStr)
+		if err1 != nil || err2 != nil || initial < 1 || thereafter < 0 {
+			return config, fmt.Errorf("SOCKS_LOG_SAMPLING must be like 100,10")
+		}
+		config.Sampling = &logger.Sampling{Tick: time.Second, Initial: initial, Thereafter: thereafter}
+	}
+	return config, nil
+}
+
+// toggleDebugOnSignal switches between debug and the configured level on
+// SIGUSR1
+func toggleDebugOnSignal(configured string) {
+	if len(debugSignals) == 0 {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, debugSignals...)
+	for range sig {
+		lvl := "debug"
+		if logger.Level() == "debug" {
+			lvl = configured
+			if lvl == "debug" {
+				lvl = "info"
+			}
+		}
+		logger.SetLevel(lvl)
+		logger.Infof("Log level set to %s", lvl)
+	}
+}
+
+// reloadOnHangup runs the reloaders on every SIGHUP
+func reloadOnHangup(reloaders []func()) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		for _, reload := range reloaders {
+			reload()
+		}
+	}
+}
+
+// runQuotaCommand implements "quota show [user...]" and "quota reset [user...]"
+// against the store configured in SOCKS_QUOTA_FILE
+func runQuotaCommand(args []string) error {
+	quotaFile := os.Getenv("SOCKS_QUOTA_FILE")
+	if quotaFile == "" {
+		return fmt.Errorf("SOCKS_QUOTA_FILE must be set")
+	}
+	quotaConfig, err := quota.Load(quotaFile)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s quota show|reset [user...]", os.Args[0])
+	}
+	switch args[0] {
+	case "show":
+		usage, err := quota.ReadUsage(quotaConfig.Store)
+		if err != nil {
+			return err
+		}
+		users := args[1:]
+		if len(users) == 0 {
+			for user := range usage {
+				users = append(users, user)
+			}
+			sort.Strings(users)
+		}
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USER\tPERIOD\tUSED\tQUOTA\tUPLOAD\tDOWNLOAD")
+		for _, user := range users {
+			u, ok := usage[user]
+			if !ok {
+				u = &quota.Usage{}
+			}
+			period, used, limit := "-", "-", "-"
+			if q := quotaConfig.QuotaOf(user); q != nil {
+				period = q.Period
+				used = strconv.FormatInt(u.Since(q.PeriodStart(now)), 10)
+				limit = strconv.FormatInt(q.Bytes, 10)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", user, period, used, limit, u.Upload, u.Download)
+		}
+		return w.Flush()
+	case "reset":
+		if err := quota.ResetUsage(quotaConfig.Store, args[1:]...); err != nil {
+			return err
+		}
+		fmt.Println("Counters reset, a running server applies this on its next flush")
+		return nil
+	}
+	return fmt.Errorf("unknown quota command %q", args[0])
+}
@@ -0,0 +1,332 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overflowLabel replaces the first label value of series beyond a metric's limit
+const overflowLabel = "other"
+
+type family interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []family
+)
+
+func register(f family) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, f)
+}
+
+// Handler serves every metric
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registryMu.Lock()
+		families := append([]family(nil), registry...)
+		registryMu.Unlock()
+		for _, f := range families {
+			f.write(w)
+		}
+	})
+}
+
+// vec holds the series of a metric by label values
+type vec struct {
+	name, help, typ string
+	labels          []string
+	// series beyond this many get overflowLabel as their first label
+	// value, 0 for no limit
+	limit int
+
+	mu     sync.Mutex
+	series map[string]interface{}
+	values map[string][]string
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{name: name, help: help, typ: typ, labels: labels, series: make(map[string]interface{}), values: make(map[string][]string)}
+}
+
+// get returns the series of the label values, made by create if new
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+	if v.limit > 0 && len(v.series) >= v.limit {
+		values = append([]string{overflowLabel}, values[1:]...)
+		key = strings.Join(values, "\xff")
+		if s, ok := v.series[key]; ok {
+			return s
+		}
+	}
+	s := create()
+	v.series[key] = s
+	v.values[key] = values
+	return s
+}
+
+// each calls f with the label pairs and series, ordered by label values
+func (v *vec) each(f func(labels string, s interface{})) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	type entry struct {
+		labels string
+		s      interface{}
+	}
+	entries := make([]entry, len(keys))
+	for i, key := range keys {
+		entries[i] = entry{formatLabels(v.labels, v.values[key]), v.series[key]}
+	}
+	v.mu.Unlock()
+	for _, e := range entries {
+		f(e.labels, e.s)
+	}
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escape(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a metric that only goes up
+type Counter struct {
+	vec
+}
+
+// CounterValue is one series of a Counter
+type CounterValue struct {
+	n uint64
+}
+
+// NewCounter registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	register(c)
+	return c
+}
+
+// Limit bounds the number of series, those beyond it are counted with their
+// first label value, like a user name, set to "other"
+func (c *Counter) Limit(series int) *Counter {
+	c.limit = series
+	return c
+}
+
+// With returns the series of the label values
+func (c *Counter) With(values ...string) *CounterValue {
+	return c.get(values, func() interface{} { return &CounterValue{} }).(*CounterValue)
+}
+
+func (c *CounterValue) Inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+func (c *CounterValue) Add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labels, atomic.LoadUint64(&s.(*CounterValue).n))
+	})
+}
+
+// Gauge is a metric that goes up and down
+type Gauge struct {
+	vec
+}
+
+// GaugeValue is one series of a Gauge
+type GaugeValue struct {
+	n int64
+}
+
+// NewGauge registers a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	register(g)
+	return g
+}
+
+// With returns the series of the label values
+func (g *Gauge) With(values ...string) *GaugeValue {
+	return g.get(values, func() interface{} { return &GaugeValue{} }).(*GaugeValue)
+}
+
+func (g *GaugeValue) Inc() {
+	atomic.AddInt64(&g.n, 1)
+}
+
+func (g *GaugeValue) Dec() {
+	atomic.AddInt64(&g.n, -1)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, labels, atomic.LoadInt64(&s.(*GaugeValue).n))
+	})
+}
+
+// funcMetric reads its value when it is served
+type funcMetric struct {
+	vec
+	value func() float64
+}
+
+// NewCounterFunc registers a counter kept elsewhere
+func NewCounterFunc(name, help string, value func() float64) {
+	register(&funcMetric{newVec(name, help, "counter", nil), value})
+}
+
+// NewGaugeFunc registers a gauge kept elsewhere
+func NewGaugeFunc(name, help string, value func() float64) {
+	register(&funcMetric{newVec(name, help, "gauge", nil), value})
+}
+
+func (f *funcMetric) write(w io.Writer) {
+	f.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.value()))
+}
+
+// DurationBuckets are upper bounds in seconds suiting network latencies
+var DurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	vec
+	buckets []float64
+}
+
+// HistogramValue is one series of a Histogram
+type HistogramValue struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds
+// and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newVec(name, help, "histogram", labels), buckets}
+	register(h)
+	return h
+}
+
+// With returns the series of the label values
+func (h *Histogram) With(values ...string) *HistogramValue {
+	return h.get(values, func() interface{} { return &HistogramValue{counts: make([]uint64, len(h.buckets))} }).(*HistogramValue)
+}
+
+// Observe adds a value to the series of the label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	s := h.With(values...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveSince adds the seconds passed since start
+func (h *Histogram) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, series interface{}) {
+		s := series.(*HistogramValue)
+		s.mu.Lock()
+		counts := append([]uint64(nil), s.counts...)
+		count, sum := s.count, s.sum
+		s.mu.Unlock()
+		inner := strings.TrimSuffix(strings.TrimPrefix(labels, "{"), "}")
+		if inner != "" {
+			inner += ","
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, inner, formatFloat(bound), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, inner, count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, count)
+	})
+}
+
+// countingReader adds the bytes read to a counter
+type countingReader struct {
+	r io.Reader
+	c *CounterValue
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.c.Add(uint64(n))
+	}
+	return n, err
+}
+
+// CountReader returns a reader adding the bytes read from r to c
+func CountReader(r io.Reader, c *CounterValue) io.Reader {
+	return &countingReader{r: r, c: c}
+}
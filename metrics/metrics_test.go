@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func output(f family) string {
+	var buf bytes.Buffer
+	f.write(&buf)
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	c := &Counter{newVec("test_total", "Test counter.", "counter", []string{"user", "direction"})}
+	c.With("bob", "upload").Add(10)
+	c.With("alice", "upload").Inc()
+	c.With("bob", "upload").Inc()
+	c.With("quo\"te\\new\nline", "download").Inc()
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{user="alice",direction="upload"} 1
+test_total{user="bob",direction="upload"} 11
+test_total{user="quo\"te\\new\nline",direction="download"} 1
+`
+	if got := output(c); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCounterLimit(t *testing.T) {
+	c := (&Counter{newVec("test_total", "Test counter.", "counter", []string{"user", "direction"})}).Limit(2)
+	tests := []struct {
+		user, direction string
+	}{
+		{"alice", "upload"},
+		{"bob", "upload"},
+		// beyond the limit
+		{"carol", "upload"},
+		{"dave", "upload"},
+		{"carol", "download"},
+		// known series keep counting
+		{"alice", "upload"},
+	}
+	for _, tt := range tests {
+		c.With(tt.user, tt.direction).Inc()
+	}
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{user="alice",direction="upload"} 2
+test_total{user="bob",direction="upload"} 1
+test_total{user="other",direction="download"} 1
+test_total{user="other",direction="upload"} 2
+`
+	if got := output(c); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	c := &Counter{newVec("test_total", "Test counter.", "counter", []string{"user"})}
+	defer func() {
+		if recover() == nil {
+			t.Error("With() with the wrong number of label values did not panic")
+		}
+	}()
+	c.With("alice", "upload")
+}
+
+func TestGauge(t *testing.T) {
+	g := &Gauge{newVec("test_active", "Test gauge.", "gauge", []string{"listener"})}
+	g.With("socks").Inc()
+	g.With("socks").Inc()
+	g.With("transparent").Inc()
+	g.With("transparent").Dec()
+	g.With("transparent").Dec()
+
+	want := `# HELP test_active Test gauge.
+# TYPE test_active gauge
+test_active{listener="socks"} 2
+test_active{listener="transparent"} -1
+`
+	if got := output(g); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{newVec("test_seconds", "Test histogram.", "histogram", []string{"result"}), []float64{.1, 1}}
+	h.Observe(.05, "success")
+	h.Observe(.5, "success")
+	h.Observe(1, "success")
+	h.Observe(3, "success")
+	h.Observe(.25, "failure")
+
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{result="failure",le="0.1"} 0
+test_seconds_bucket{result="failure",le="1"} 1
+test_seconds_bucket{result="failure",le="+Inf"} 1
+test_seconds_sum{result="failure"} 0.25
+test_seconds_count{result="failure"} 1
+test_seconds_bucket{result="success",le="0.1"} 1
+test_seconds_bucket{result="success",le="1"} 3
+test_seconds_bucket{result="success",le="+Inf"} 4
+test_seconds_sum{result="success"} 4.55
+test_seconds_count{result="success"} 4
+`
+	if got := output(h); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+
+	unlabeled := &Histogram{newVec("test_seconds", "Test histogram.", "histogram", nil), []float64{1}}
+	unlabeled.Observe(2)
+	if got := output(unlabeled); !strings.Contains(got, "test_seconds_bucket{le=\"1\"} 0\ntest_seconds_bucket{le=\"+Inf\"} 1\ntest_seconds_sum 2\n") {
+		t.Errorf("unlabeled output:\n%s", got)
+	}
+}
+
+func TestFuncMetric(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{42, "42"},
+		{0.5, "0.5"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+	}
+	for _, tt := range tests {
+		f := &funcMetric{newVec("test_value", "Test gauge.", "gauge", nil), func() float64 { return tt.value }}
+		if got, want := output(f), "# HELP test_value Test gauge.\n# TYPE test_value gauge\ntest_value "+tt.want+"\n"; got != want {
+			t.Errorf("output:\n%s\nwant:\n%s", got, want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ConnectionsAccepted.With("socks").Inc()
+	NewGaugeFunc("test_handler_value", "Test gauge.", func() float64 { return 7 })
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE socks_connections_accepted_total counter\n",
+		`socks_connections_accepted_total{listener="socks"} `,
+		"# TYPE socks_dial_duration_seconds histogram\n",
+		"test_handler_value 7\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response lacks %q", want)
+		}
+	}
+}
+
+func TestCountReader(t *testing.T) {
+	c := &Counter{newVec("test_total", "Test counter.", "counter", nil)}
+	data, err := io.ReadAll(CountReader(strings.NewReader("hello world"), c.With()))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("ReadAll() = %q, %v", data, err)
+	}
+	if got := output(c); !strings.HasSuffix(got, "test_total 11\n") {
+		t.Errorf("output:\n%s", got)
+	}
+}
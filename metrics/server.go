@@ -0,0 +1,45 @@
+package metrics
+
+// DefaultMaxUsers is how many users Bytes keeps apart by default, the
+// traffic of the users beyond it is counted as user "other"
+const DefaultMaxUsers = 100
+
+// bytesDirections is the number of Bytes series of a user, upload and download
+const bytesDirections = 2
+
+// Metrics of the proxy, labels are documented in the README
+var (
+	ConnectionsAccepted = NewCounter("socks_connections_accepted_total",
+		"Connections accepted by listener kind.", "listener")
+	ConnectionsActive = NewGauge("socks_connections_active",
+		"Connections being served by listener kind.", "listener")
+	ConnectionsRejected = NewCounter("socks_connections_rejected_total",
+		"Connections refused before being served by reason.", "reason")
+	Handshakes = NewCounter("socks_handshakes_total",
+		"SOCKS handshakes by protocol version and outcome.", "version", "result")
+	Auth = NewCounter("socks_auth_total",
+		"Authentication attempts by method and outcome.", "method", "result")
+	Commands = NewCounter("socks_commands_total",
+		"Requests by protocol and command.", "protocol", "command")
+	DialDuration = NewHistogram("socks_dial_duration_seconds",
+		"Time taken to connect to destinations by outcome.", DurationBuckets, "result")
+	Bytes = NewCounter("socks_bytes_total",
+		"Bytes relayed by user and direction, upload is from the client.", "user", "direction").Limit(bytesDirections * DefaultMaxUsers)
+	UDPPackets = NewCounter("socks_udp_packets_total",
+		"UDP datagrams relayed by direction.", "direction")
+	DNSResolveDuration = NewHistogram("socks_dns_resolve_duration_seconds",
+		"Time taken to resolve destination names by outcome.", DurationBuckets, "result")
+)
+
+// SetMaxUsers changes how many users Bytes keeps apart, see DefaultMaxUsers
+func SetMaxUsers(users int) {
+	Bytes.Limit(bytesDirections * users)
+}
+
+// Result is the result label value of an operation returning err
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,89 @@
+// Package accesslog writes one JSON record per session when it ends
+package accesslog
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+	"github.com/thifnmi/proxy-socks-server/server/session"
+)
+
+// Log writes session records to stdout, a file or syslog
+type Log struct {
+	dest string
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// Open opens the destination of the records: "stdout", "syslog" for the
+// local syslog daemon, "syslog://host:port" or "syslog+tcp://host:port"
+// for a remote one, or the path of a file to append to
+func Open(dest string) (*Log, error) {
+	l := &Log{dest: dest}
+	w, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	l.w = w
+	return l, nil
+}
+
+func (l *Log) open() (io.WriteCloser, error) {
+	switch {
+	case l.dest == "stdout":
+		return nopCloser{os.Stdout}, nil
+	case l.dest == "syslog":
+		return logger.DialSyslog("", "")
+	case strings.HasPrefix(l.dest, "syslog://"):
+		return logger.DialSyslog("udp", strings.TrimPrefix(l.dest, "syslog://"))
+	case strings.HasPrefix(l.dest, "syslog+tcp://"):
+		return logger.DialSyslog("tcp", strings.TrimPrefix(l.dest, "syslog+tcp://"))
+	}
+	return os.OpenFile(l.dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+// Reopen opens the file again, for log rotation. Other destinations are kept.
+func (l *Log) Reopen() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	_, isFile := l.w.(*os.File)
+	l.mu.Unlock()
+	if !isFile {
+		return nil
+	}
+	w, err := l.open()
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Close()
+	l.w = w
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Write appends the record of a session that ended
+func (l *Log) Write(info session.Info) {
+	if l == nil {
+		return
+	}
+	line, _ := json.Marshal(&info)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(line, '\n'))
+}
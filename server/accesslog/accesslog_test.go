@@ -0,0 +1,133 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/server/session"
+)
+
+func readRecords(t *testing.T, path string) []session.Info {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []session.Info
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var info session.Info
+		if err := json.Unmarshal([]byte(line), &info); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		records = append(records, info)
+	}
+	return records
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		dest    string
+		wantErr bool
+	}{
+		{"stdout", false},
+		{filepath.Join(t.TempDir(), "access.log"), false},
+		{filepath.Join(t.TempDir(), "missing", "access.log"), true},
+		{"syslog+tcp://127.0.0.1:1", true},
+	}
+	for _, tt := range tests {
+		l, err := Open(tt.dest)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Open(%q) error = %v, wantErr %v", tt.dest, err, tt.wantErr)
+		}
+		if err == nil {
+			l.w.Close()
+		}
+	}
+}
+
+func TestFileRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { l.w.Close() }()
+	reply := 0
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.Write(session.Info{ID: 1, Client: "192.0.2.1:5000", User: "alice", Protocol: "socks5", Command: "connect", Destination: "example.com:443", BytesUp: 10, BytesDown: 20, Start: start, Reply: &reply})
+
+	// rotated away, then reopened
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Write(session.Info{ID: 2, Protocol: "transparent", Start: start, Error: "connection refused"})
+
+	tests := []struct {
+		path string
+		want session.Info
+	}{
+		{path + ".1", session.Info{ID: 1, Client: "192.0.2.1:5000", User: "alice", Protocol: "socks5", Command: "connect", Destination: "example.com:443", BytesUp: 10, BytesDown: 20, Start: start, Reply: &reply}},
+		{path, session.Info{ID: 2, Protocol: "transparent", Start: start, Error: "connection refused"}},
+	}
+	for _, tt := range tests {
+		records := readRecords(t, tt.path)
+		if len(records) != 1 {
+			t.Fatalf("%s holds %d records, want 1", tt.path, len(records))
+		}
+		got := records[0]
+		if got.ID != tt.want.ID || got.User != tt.want.User || got.Destination != tt.want.Destination ||
+			got.BytesUp != tt.want.BytesUp || !got.Start.Equal(tt.want.Start) || got.Error != tt.want.Error ||
+			(got.Reply == nil) != (tt.want.Reply == nil) {
+			t.Errorf("%s holds %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSyslogRecords(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	l, err := Open("syslog://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { l.w.Close() }()
+	l.Write(session.Info{ID: 7, Protocol: "socks4"})
+	// syslog is not reopened
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	// informational daemon messages holding the record
+	if !strings.HasPrefix(msg, "<30>1 ") || !strings.HasSuffix(msg, `"protocol":"socks4","bytesUp":0,"bytesDown":0,"start":"0001-01-01T00:00:00Z","duration":0}`) {
+		t.Errorf("message %q", msg)
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Write(session.Info{ID: 1})
+	if err := l.Reopen(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,141 @@
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Rules decide which clients may connect. Deny is checked first, then
+// Allow if it is not empty. Clients in NoAuth may skip authentication.
+type Rules struct {
+	Allow  []string `json:"allow"`
+	Deny   []string `json:"deny"`
+	NoAuth []string `json:"noAuth"`
+
+	allow, deny, noAuth []*net.IPNet
+}
+
+func (r *Rules) init() error {
+	var err error
+	if r.allow, err = parseNetworks(r.Allow); err != nil {
+		return err
+	}
+	if r.deny, err = parseNetworks(r.Deny); err != nil {
+		return err
+	}
+	r.noAuth, err = parseNetworks(r.NoAuth)
+	return err
+}
+
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", s)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns whether ip may connect and whether it may skip authentication
+func (r *Rules) check(ip net.IP) (allowed bool, noAuth bool) {
+	if containsIP(r.deny, ip) {
+		return false, false
+	}
+	if len(r.allow) > 0 && !containsIP(r.allow, ip) {
+		return false, false
+	}
+	return true, containsIP(r.noAuth, ip)
+}
+
+// file layout, the top level rules apply to listeners without their own section
+type file struct {
+	Rules
+	Listeners map[string]*Rules `json:"listeners"`
+}
+
+// ACL holds client address rules, it can be reloaded while serving
+type ACL struct {
+	path string
+	mu   sync.RWMutex
+	file *file
+}
+
+// Load reads a JSON ACL file
+func Load(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the file, the current rules stay in effect if it is invalid
+func (a *ACL) Reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	f := &file{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return fmt.Errorf("invalid acl file %s: %v", a.path, err)
+	}
+	if err := f.init(); err != nil {
+		return fmt.Errorf("acl file %s: %v", a.path, err)
+	}
+	for listener, rules := range f.Listeners {
+		if err := rules.init(); err != nil {
+			return fmt.Errorf("acl file %s, listener %s: %v", a.path, listener, err)
+		}
+	}
+	a.mu.Lock()
+	a.file = f
+	a.mu.Unlock()
+	return nil
+}
+
+// Check returns whether a client connecting from remote to the listener bound
+// to listenAddr is allowed, and whether it may skip authentication.
+// A nil ACL allows everyone and bypasses nothing.
+func (a *ACL) Check(listenAddr string, remote net.Addr) (allowed bool, noAuth bool) {
+	if a == nil {
+		return true, false
+	}
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return false, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false, false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	rules := &a.file.Rules
+	if listenerRules, ok := a.file.Listeners[listenAddr]; ok {
+		rules = listenerRules
+	}
+	return rules.check(ip)
+}
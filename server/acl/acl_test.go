@@ -0,0 +1,97 @@
+package acl
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeACL(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	writeACL(t, path, `{
+		"allow": ["10.0.0.0/8", "192.0.2.1", "2001:db8::/32"],
+		"deny": ["10.9.0.0/16"],
+		"noAuth": ["10.1.0.0/16"],
+		"listeners": {
+			"127.0.0.1:1081": {"deny": ["192.0.2.1"]}
+		}
+	}`)
+	a, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		listen      string
+		remote      string
+		wantAllowed bool
+		wantNoAuth  bool
+	}{
+		{"allowed network", "0.0.0.0:1080", "10.2.3.4:5000", true, false},
+		{"single address", "0.0.0.0:1080", "192.0.2.1:5000", true, false},
+		{"next to single address", "0.0.0.0:1080", "192.0.2.2:5000", false, false},
+		{"deny before allow", "0.0.0.0:1080", "10.9.1.1:5000", false, false},
+		{"no auth", "0.0.0.0:1080", "10.1.2.3:5000", true, true},
+		{"ipv6", "0.0.0.0:1080", "[2001:db8::1]:5000", true, false},
+		{"ipv6 outside", "0.0.0.0:1080", "[2001:db9::1]:5000", false, false},
+		{"listener section", "127.0.0.1:1081", "192.0.2.1:5000", false, false},
+		{"listener section without allow list", "127.0.0.1:1081", "203.0.113.1:5000", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, err := net.ResolveTCPAddr("tcp", tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed, noAuth := a.Check(tt.listen, remote)
+			if allowed != tt.wantAllowed || noAuth != tt.wantNoAuth {
+				t.Errorf("Check() = %v, %v, want %v, %v", allowed, noAuth, tt.wantAllowed, tt.wantNoAuth)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsRulesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	writeACL(t, path, `{"deny": ["192.0.2.0/24"]}`)
+	a, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+
+	for _, content := range []string{`{"deny": ["not an address"]}`, `{`} {
+		writeACL(t, path, content)
+		if err := a.Reload(); err == nil {
+			t.Errorf("Reload() accepted %s", content)
+		}
+		if allowed, _ := a.Check("0.0.0.0:1080", remote); allowed {
+			t.Errorf("rules dropped after reloading %s", content)
+		}
+	}
+
+	writeACL(t, path, `{}`)
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _ := a.Check("0.0.0.0:1080", remote); !allowed {
+		t.Error("reloaded rules not applied")
+	}
+}
+
+func TestNilACL(t *testing.T) {
+	var a *ACL
+	allowed, noAuth := a.Check("0.0.0.0:1080", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")})
+	if !allowed || noAuth {
+		t.Errorf("Check() = %v, %v, want true, false", allowed, noAuth)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+	"github.com/thifnmi/proxy-socks-server/server/session"
+)
+
+// AdminHandler serves the admin API, requests must send token in an
+// "Authorization: Bearer" header:
+//
+//	GET    /sessions[?user=name]    list open sessions
+//	DELETE /sessions/{id}           kill a session
+//	DELETE /users/{name}/sessions   kill every session of a user
+//	GET    /users/{name}/access     {"enabled": true}
+//	PUT    /users/{name}/access     {"enabled": false} refuses new sessions
+//	GET    /users/disabled          users whose access is disabled
+//	GET    /log/level               {"level": "info"}
+//	PUT    /log/level               {"level": "debug"}
+func (s *SocksServer) AdminHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(header, "Bearer ")
+		if token == "" || !strings.HasPrefix(header, "Bearer ") || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		var path []string
+		for _, segment := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+			segment, err := url.PathUnescape(segment)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid path")
+				return
+			}
+			path = append(path, segment)
+		}
+		s.serveAdmin(w, r, path)
+	})
+}
+
+func (s *SocksServer) serveAdmin(w http.ResponseWriter, r *http.Request, path []string) {
+	route := r.Method + " " + path[0]
+	switch {
+	case route == "GET sessions" && len(path) == 1:
+		sessions := s.sessions.List()
+		if user, ok := r.URL.Query()["user"]; ok {
+			var filtered []session.Info
+			for _, info := range sessions {
+				if info.User == user[0] {
+					filtered = append(filtered, info)
+				}
+			}
+			sessions = filtered
+		}
+		if sessions == nil {
+			sessions = []session.Info{}
+		}
+		writeJSON(w, sessions)
+
+	case route == "DELETE sessions" && len(path) == 2:
+		id, err := strconv.ParseUint(path[1], 10, 64)
+		if err != nil || !s.sessions.Kill(id) {
+			writeError(w, http.StatusNotFound, "no such session")
+			return
+		}
+		logger.Infof("Killed session %d by admin request", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case route == "GET users" && len(path) == 2 && path[1] == "disabled":
+		writeJSON(w, s.sessions.Disabled())
+
+	case route == "DELETE users" && len(path) == 3 && path[2] == "sessions":
+		killed := s.sessions.KillUser(path[1])
+		logger.Infof("Killed %d sessions of user %q by admin request", killed, path[1])
+		writeJSON(w, map[string]int{"killed": killed})
+
+	case route == "GET users" && len(path) == 3 && path[2] == "access":
+		writeJSON(w, map[string]interface{}{"user": path[1], "enabled": s.sessions.Enabled(path[1])})
+
+	case route == "PUT users" && len(path) == 3 && path[2] == "access":
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+			writeError(w, http.StatusBadRequest, `body must be {"enabled": true|false}`)
+			return
+		}
+		s.sessions.SetEnabled(path[1], *body.Enabled)
+		logger.Infof("Access of user %q set to %t by admin request", path[1], *body.Enabled)
+		writeJSON(w, map[string]interface{}{"user": path[1], "enabled": *body.Enabled})
+
+	case route == "GET log" && len(path) == 2 && path[1] == "level":
+		writeJSON(w, map[string]string{"level": logger.Level()})
+
+	case route == "PUT log" && len(path) == 2 && path[1] == "level":
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, `body must be {"level": "debug|info|warn|error"}`)
+			return
+		}
+		if err := logger.SetLevel(body.Level); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logger.Infof("Log level set to %s by admin request", body.Level)
+		writeJSON(w, map[string]string{"level": logger.Level()})
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+	"github.com/thifnmi/proxy-socks-server/utils"
+)
+
+type testConn struct {
+	closed bool
+}
+
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestAdminHandler(t *testing.T) {
+	defer logger.SetLevel(logger.Level())
+	s := NewSocksServer(&utils.Config{})
+	s.sessions.SetEnabled("carol", false)
+	var conns []*testConn
+	for _, user := range []string{"alice", "bob", "alice"} {
+		conn := &testConn{}
+		s.sessions.Open("socks5", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}, conn).SetUser(user)
+		conns = append(conns, conn)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		// the response holds every one of these
+		want []string
+	}{
+		{"no token", "GET", "/sessions", "", "", http.StatusUnauthorized, []string{`"error":"invalid token"`}},
+		{"wrong token", "GET", "/sessions", "wrong", "", http.StatusUnauthorized, nil},
+		{"sessions", "GET", "/sessions", "secret", "", http.StatusOK, []string{`"id":1,`, `"id":2,`, `"id":3,`}},
+		{"sessions of a user", "GET", "/sessions?user=bob", "secret", "", http.StatusOK, []string{`[{"id":2,`}},
+		{"no sessions", "GET", "/sessions?user=dave", "secret", "", http.StatusOK, []string{"[]"}},
+		{"kill", "DELETE", "/sessions/2", "secret", "", http.StatusNoContent, nil},
+		{"kill unknown", "DELETE", "/sessions/9", "secret", "", http.StatusNotFound, []string{"no such session"}},
+		{"kill invalid", "DELETE", "/sessions/x", "secret", "", http.StatusNotFound, nil},
+		{"kill user", "DELETE", "/users/alice/sessions", "secret", "", http.StatusOK, []string{`{"killed":2}`}},
+		{"access", "GET", "/users/carol/access", "secret", "", http.StatusOK, []string{`"enabled":false`}},
+		{"escaped user", "GET", "/users/a%2Fb/access", "secret", "", http.StatusOK, []string{`"user":"a/b"`, `"enabled":true`}},
+		{"disable", "PUT", "/users/dave/access", "secret", `{"enabled": false}`, http.StatusOK, []string{`"enabled":false`}},
+		{"disable without body", "PUT", "/users/dave/access", "secret", `{}`, http.StatusBadRequest, nil},
+		{"disabled", "GET", "/users/disabled", "secret", "", http.StatusOK, []string{`["carol","dave"]`}},
+		{"enable", "PUT", "/users/carol/access", "secret", `{"enabled": true}`, http.StatusOK, []string{`"enabled":true`}},
+		{"log level", "PUT", "/log/level", "secret", `{"level": "warn"}`, http.StatusOK, []string{`{"level":"warn"}`}},
+		{"invalid log level", "PUT", "/log/level", "secret", `{"level": "loud"}`, http.StatusBadRequest, nil},
+		{"current log level", "GET", "/log/level", "secret", "", http.StatusOK, []string{`{"level":"warn"}`}},
+		{"unknown", "GET", "/users", "secret", "", http.StatusNotFound, []string{"not found"}},
+		{"wrong method", "POST", "/sessions", "secret", "", http.StatusNotFound, nil},
+	}
+	handler := s.AdminHandler("secret")
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: response %q lacks %q", tt.name, w.Body.String(), want)
+			}
+		}
+	}
+
+	// session 2 by id, the others with their user
+	for i, conn := range conns {
+		if !conn.closed {
+			t.Errorf("session %d not killed", i+1)
+		}
+	}
+	if got := s.sessions.Disabled(); strings.Join(got, ",") != "dave" {
+		t.Errorf("disabled users %v, want dave", got)
+	}
+}
+
+func TestAdminHandlerNoToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/sessions", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	NewSocksServer(&utils.Config{}).AdminHandler("").ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d without a configured token, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminHandlerScheme(t *testing.T) {
+	handler := NewSocksServer(&utils.Config{}).AdminHandler("secret")
+	for _, tt := range []struct {
+		header     string
+		wantStatus int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/sessions", nil)
+		r.Header.Set("Authorization", tt.header)
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, w.Code, tt.wantStatus)
+		}
+	}
+}
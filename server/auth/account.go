@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionExpiresAttribute holds the RFC 3339 time an authenticated session
+// must be ended at, see AuthContext.Expires
+const SessionExpiresAttribute = "SessionExpires"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Account is a user record with an optional validity window
+type Account struct {
+	Password string `json:"password"`
+	// Dates "2006-01-02" or RFC 3339 times, in TimeZone. A date NotAfter
+	// includes the whole day.
+	NotBefore string `json:"notBefore"`
+	NotAfter  string `json:"notAfter"`
+	// Allowed days: "mon", "tue", ... Empty allows every day.
+	Days []string `json:"days"`
+	// Allowed hours like "09:00-18:00", may wrap midnight like "22:00-06:00".
+	// The days apply to the start of a wrapping window. Empty allows all day.
+	Hours string `json:"hours"`
+	// IANA time zone of the dates and hours, UTC if empty
+	TimeZone string `json:"timeZone"`
+	// End active sessions when the window closes
+	EndSessions bool `json:"endSessions"`
+
+	location   *time.Location
+	notBefore  time.Time
+	notAfter   time.Time
+	days       map[time.Weekday]bool
+	start, end int // minutes since midnight, start == end if Hours is empty
+}
+
+func (a *Account) init() error {
+	a.location = time.UTC
+	if a.TimeZone != "" {
+		location, err := time.LoadLocation(a.TimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone %q", a.TimeZone)
+		}
+		a.location = location
+	}
+	var err error
+	if a.notBefore, err = parseAccountTime(a.NotBefore, a.location, false); err != nil {
+		return err
+	}
+	if a.notAfter, err = parseAccountTime(a.NotAfter, a.location, true); err != nil {
+		return err
+	}
+	if len(a.Days) > 0 {
+		a.days = make(map[time.Weekday]bool, len(a.Days))
+		for _, day := range a.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return fmt.Errorf("invalid day %q", day)
+			}
+			a.days[weekday] = true
+		}
+	}
+	if a.Hours != "" {
+		startStr, endStr, _ := strings.Cut(a.Hours, "-")
+		start, err := parseClock(startStr)
+		if err != nil {
+			return fmt.Errorf("invalid hours %q", a.Hours)
+		}
+		end, err := parseClock(endStr)
+		if err != nil || start == end {
+			return fmt.Errorf("invalid hours %q", a.Hours)
+		}
+		a.start, a.end = start, end
+	}
+	return nil
+}
+
+// parseAccountTime reads a date or RFC 3339 time, a date used as upper
+// bound means the end of that day
+func parseAccountTime(s string, location *time.Location, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// parseClock reads "15:04" as minutes since midnight, "24:00" is allowed
+func parseClock(s string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &hour, &minute); err != nil {
+		return 0, err
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// Active reports whether the account may be used at t
+func (a *Account) Active(t time.Time) bool {
+	if !a.notBefore.IsZero() && t.Before(a.notBefore) {
+		return false
+	}
+	if !a.notAfter.IsZero() && !t.Before(a.notAfter) {
+		return false
+	}
+	t = t.In(a.location)
+	if a.start == a.end {
+		return a.dayAllowed(t.Weekday())
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if a.start < a.end {
+		return minute >= a.start && minute < a.end && a.dayAllowed(t.Weekday())
+	}
+	// window wrapping midnight
+	if minute >= a.start {
+		return a.dayAllowed(t.Weekday())
+	}
+	return minute < a.end && a.dayAllowed((t.Weekday()+6)%7)
+}
+
+func (a *Account) dayAllowed(day time.Weekday) bool {
+	return a.days == nil || a.days[day]
+}
+
+// Closes returns when the window active at t closes, zero if it stays open
+func (a *Account) Closes(t time.Time) time.Time {
+	// the window can only change at midnight, at the start and end hours
+	// and at NotAfter, check those for the coming week. They are wall clock
+	// times of the account's zone, whatever its offset is on that day.
+	local := t.In(a.location)
+	var candidates []time.Time
+	for day := 0; day <= 8; day++ {
+		year, month, date := local.Year(), local.Month(), local.Day()+day
+		candidates = append(candidates, time.Date(year, month, date, 0, 0, 0, 0, a.location))
+		if a.start != a.end {
+			candidates = append(candidates,
+				time.Date(year, month, date, a.start/60, a.start%60, 0, 0, a.location),
+				time.Date(year, month, date, a.end/60, a.end%60, 0, 0, a.location))
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	for _, c := range candidates {
+		if !a.notAfter.IsZero() && !c.Before(a.notAfter) {
+			break
+		}
+		if c.After(t) && !a.Active(c) {
+			return c
+		}
+	}
+	return a.notAfter
+}
+
+// Accounts is a credential store of user records read from a JSON file
+//
+//	{"users": {"ci": {"password": "secret", "days": ["mon", "tue"], "hours": "08:00-20:00"}}}
+//
+// It can be reloaded while serving.
+type Accounts struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]*Account
+}
+
+// LoadAccounts reads an accounts file
+func LoadAccounts(path string) (*Accounts, error) {
+	a := &Accounts{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the file, the current accounts stay in effect if it is invalid
+func (a *Accounts) Reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		Users map[string]*Account `json:"users"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("invalid accounts file %s: %v", a.path, err)
+	}
+	for user, account := range f.Users {
+		if account == nil {
+			return fmt.Errorf("accounts file %s, user %s: no account", a.path, user)
+		}
+		if err := account.init(); err != nil {
+			return fmt.Errorf("accounts file %s, user %s: %v", a.path, user, err)
+		}
+	}
+	a.mu.Lock()
+	a.users = f.Users
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *Accounts) Valid(user, password string) bool {
+	_, ok := a.ValidClaims(user, password)
+	return ok
+}
+
+// ValidClaims accepts the password of an account inside its window. If the
+// account ends its sessions, the closing time is returned as SessionExpires.
+func (a *Accounts) ValidClaims(user, password string) (map[string]string, bool) {
+	a.mu.RLock()
+	account, ok := a.users[user]
+	a.mu.RUnlock()
+	// unknown users are compared too, so that the time taken does not
+	// tell whether they exist
+	stored := ""
+	if ok {
+		stored = account.Password
+	}
+	if !equalPasswords(stored, password) || !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if !account.Active(now) {
+		return nil, false
+	}
+	attributes := map[string]string{}
+	if account.EndSessions {
+		if closes := account.Closes(now); !closes.IsZero() {
+			attributes[SessionExpiresAttribute] = closes.Format(time.RFC3339)
+		}
+	}
+	return attributes, true
+}
+
+// equalPasswords compares passwords in constant time, whatever their lengths
+func equalPasswords(a, b string) bool {
+	digestA, digestB := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(digestA[:], digestB[:]) == 1
+}
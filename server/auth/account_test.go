@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func newAccount(t *testing.T, a Account) *Account {
+	t.Helper()
+	if err := a.init(); err != nil {
+		t.Fatal(err)
+	}
+	return &a
+}
+
+func mustTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestAccountActive(t *testing.T) {
+	tests := []struct {
+		name    string
+		account Account
+		at      string
+		want    bool
+	}{
+		{"no window", Account{}, "2024-03-11T12:00:00Z", true},
+		{"before not before", Account{NotBefore: "2024-03-12"}, "2024-03-11T23:59:00Z", false},
+		{"not after includes the day", Account{NotAfter: "2024-03-11"}, "2024-03-11T23:59:00Z", true},
+		{"after not after", Account{NotAfter: "2024-03-11"}, "2024-03-12T00:00:00Z", false},
+		{"allowed day", Account{Days: []string{"mon"}}, "2024-03-11T12:00:00Z", true},
+		{"other day", Account{Days: []string{"tue"}}, "2024-03-11T12:00:00Z", false},
+		{"inside hours", Account{Hours: "09:00-17:00"}, "2024-03-11T16:59:00Z", true},
+		{"end of hours", Account{Hours: "09:00-17:00"}, "2024-03-11T17:00:00Z", false},
+		{"wrapping window after midnight", Account{Hours: "22:00-06:00", Days: []string{"sun"}}, "2024-03-11T05:00:00Z", true},
+		{"wrapping window of another day", Account{Hours: "22:00-06:00", Days: []string{"mon"}}, "2024-03-11T05:00:00Z", false},
+		{"time zone", Account{Hours: "09:00-17:00", TimeZone: "Europe/Berlin"}, "2024-03-11T16:30:00Z", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAccount(t, tt.account)
+			if got := a.Active(mustTime(t, tt.at)); got != tt.want {
+				t.Errorf("Active(%s) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccountCloses(t *testing.T) {
+	tests := []struct {
+		name    string
+		account Account
+		at      string
+		want    string
+	}{
+		{"open", Account{}, "2024-03-11T12:00:00Z", ""},
+		{"end of hours", Account{Hours: "09:00-17:00"}, "2024-03-11T12:00:00Z", "2024-03-11T17:00:00Z"},
+		{"not after", Account{NotAfter: "2024-03-11T13:00:00Z"}, "2024-03-11T12:00:00Z", "2024-03-11T13:00:00Z"},
+		{"end of day", Account{Days: []string{"mon"}}, "2024-03-11T12:00:00Z", "2024-03-12T00:00:00Z"},
+		{"wrapping window", Account{Hours: "22:00-06:00"}, "2024-03-11T23:00:00Z", "2024-03-12T06:00:00Z"},
+		// daylight saving time starts at 02:00 on March 10 in New York
+		{"start of daylight saving time", Account{Hours: "09:00-17:00", TimeZone: "America/New_York"}, "2024-03-10T14:00:00Z", "2024-03-10T21:00:00Z"},
+		{"end of daylight saving time", Account{Hours: "09:00-17:00", TimeZone: "America/New_York"}, "2024-11-03T15:00:00Z", "2024-11-03T22:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAccount(t, tt.account)
+			got := a.Closes(mustTime(t, tt.at))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Closes() = %v, want zero", got)
+				}
+				return
+			}
+			if want := mustTime(t, tt.want); !got.Equal(want) {
+				t.Errorf("Closes() = %v, want %v", got.UTC(), want)
+			}
+		})
+	}
+}
+
+func TestAccountsValidClaims(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	content := `{"users": {
+		"alice": {"password": "secret", "endSessions": true, "notAfter": "2999-01-01T00:00:00Z"},
+		"bob": {"password": "secret", "notAfter": "2000-01-01"}
+	}}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := LoadAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "secret2", false},
+		{"alice", "", false},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"carol", "", false},
+	}
+	for _, tt := range tests {
+		attributes, ok := accounts.ValidClaims(tt.user, tt.password)
+		if ok != tt.want {
+			t.Errorf("ValidClaims(%q, %q) = %v, want %v", tt.user, tt.password, ok, tt.want)
+		}
+		if ok && attributes[SessionExpiresAttribute] != "2999-01-01T00:00:00Z" {
+			t.Errorf("session expires %q", attributes[SessionExpiresAttribute])
+		}
+	}
+}
+
+func TestAccountsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"users": {"alice": {"password": "secret"}}}`)
+	accounts, err := LoadAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+		// user valid with the password "secret" afterwards
+		wantUser string
+	}{
+		{"null account", `{"users": {"bob": null}}`, true, "alice"},
+		{"invalid account", `{"users": {"bob": {"password": "secret", "days": ["someday"]}}}`, true, "alice"},
+		{"invalid json", `{"users": `, true, "alice"},
+		{"valid", `{"users": {"bob": {"password": "secret"}}}`, false, "bob"},
+	}
+	for _, tt := range tests {
+		write(tt.content)
+		if err := accounts.Reload(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Reload() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if !accounts.Valid(tt.wantUser, "secret") {
+			t.Errorf("%s: %s not valid after the reload", tt.name, tt.wantUser)
+		}
+	}
+}
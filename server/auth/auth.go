@@ -3,6 +3,8 @@ package auth
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"time"
 )
 
 const (
@@ -18,6 +20,7 @@ const (
 
 var (
 	UserAuthFailed  = fmt.Errorf("User authentication failed")
+	UserAuthLocked  = fmt.Errorf("User authentication locked out")
 	NoSupportedAuth = fmt.Errorf("No supported authentication mechanism")
 )
 
@@ -32,6 +35,31 @@ type AuthContext struct {
 	Payload map[string]string
 }
 
+// Attributes returns the payload, nil for anonymous sessions
+func (a *AuthContext) Attributes() map[string]string {
+	if a == nil {
+		return nil
+	}
+	return a.Payload
+}
+
+// Username returns the authenticated user name, empty for anonymous sessions
+func (a *AuthContext) Username() string {
+	if a == nil || a.Payload == nil {
+		return ""
+	}
+	return a.Payload["Username"]
+}
+
+// Expires returns when the session must be ended, zero if it may last
+func (a *AuthContext) Expires() time.Time {
+	if a == nil || a.Payload == nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, a.Payload[SessionExpiresAttribute])
+	return t
+}
+
 type Authenticator interface {
 	Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error)
 	GetCode() uint8
@@ -53,6 +81,8 @@ func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*
 // authentication
 type UserPassAuthenticator struct {
 	Credentials CredentialStore
+	// Guard throttles password guessing, nil disables it
+	Guard *Guard
 }
 
 func (a UserPassAuthenticator) GetCode() uint8 {
@@ -95,12 +125,29 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 		return nil, err
 	}
 
+	// Locked out clients are refused after a fixed delay without checking the password
+	ip := remoteIP(writer)
+	if a.Guard != nil && a.Guard.Locked(string(user), ip) {
+		time.Sleep(a.Guard.LockedDelay())
+		if _, err := writer.Write([]byte{UserAuthVersion, AuthFailure}); err != nil {
+			return nil, err
+		}
+		return nil, UserAuthLocked
+	}
+
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
+	attributes, valid := validClaims(a.Credentials, string(user), string(pass))
+	if valid {
+		if a.Guard != nil {
+			a.Guard.Success(string(user))
+		}
 		if _, err := writer.Write([]byte{UserAuthVersion, AuthSuccess}); err != nil {
 			return nil, err
 		}
 	} else {
+		if a.Guard != nil {
+			time.Sleep(a.Guard.Failure(string(user), ip))
+		}
 		if _, err := writer.Write([]byte{UserAuthVersion, AuthFailure}); err != nil {
 			return nil, err
 		}
@@ -108,7 +155,12 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	payload := map[string]string{}
+	for name, value := range attributes {
+		payload[name] = value
+	}
+	payload["Username"] = string(user)
+	return &AuthContext{UserPassAuth, payload}, nil
 }
 
 // ReadMethods is used to read the number of methods
@@ -124,3 +176,18 @@ func ReadMethods(r io.Reader) ([]byte, error) {
 	_, err := io.ReadAtLeast(r, methods, numMethods)
 	return methods, err
 }
+
+// MethodName names an authentication method code
+func MethodName(method uint8) string {
+	switch method {
+	case NoAuth:
+		return "none"
+	case GSSAPIAuth:
+		return "gssapi"
+	case UserPassAuth:
+		return "userpass"
+	case TokenAuth:
+		return "token"
+	}
+	return strconv.Itoa(int(method))
+}
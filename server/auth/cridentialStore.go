@@ -5,6 +5,13 @@ type CredentialStore interface {
 	Valid(user, password string) bool
 }
 
+// ClaimsCredentialStore is a CredentialStore that also returns attributes
+// of the user, like the claims of a token used as password
+type ClaimsCredentialStore interface {
+	CredentialStore
+	ValidClaims(user, password string) (map[string]string, bool)
+}
+
 // StaticCredentials enables using a map directly as a credential store
 type StaticCredentials map[string]string
 
@@ -15,3 +22,28 @@ func (s StaticCredentials) Valid(user, password string) bool {
 	}
 	return password == pass
 }
+
+// CredentialStores accepts credentials valid in any of the stores
+type CredentialStores []CredentialStore
+
+func (s CredentialStores) Valid(user, password string) bool {
+	_, ok := s.ValidClaims(user, password)
+	return ok
+}
+
+func (s CredentialStores) ValidClaims(user, password string) (map[string]string, bool) {
+	for _, store := range s {
+		if attributes, ok := validClaims(store, user, password); ok {
+			return attributes, true
+		}
+	}
+	return nil, false
+}
+
+// validClaims checks the credentials and returns the attributes of the user if the store has any
+func validClaims(store CredentialStore, user, password string) (map[string]string, bool) {
+	if claimsStore, ok := store.(ClaimsCredentialStore); ok {
+		return claimsStore.ValidClaims(user, password)
+	}
+	return nil, store.Valid(user, password)
+}
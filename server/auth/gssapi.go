@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// RFC 1961 message framing
+//
+//	+------+------+------+.......................+
+//	+ ver  | mtyp | len  |       token           |
+//	+------+------+------+.......................+
+//	+ 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+//	+------+------+------+.......................+
+const (
+	GSSAPIAuth          = uint8(1)
+	gssapiVersion       = uint8(1)
+	gssapiMsgAuth       = uint8(1)
+	gssapiMsgProtection = uint8(2)
+	gssapiMsgAbort      = uint8(0xff)
+	// selected in the protection subnegotiation, as Dante and curl call it
+	gssapiProtectionNone = uint8(0)
+	gssapiMaxExchanges   = 8
+	gssapiMaxTokenBytes  = 0xffff
+)
+
+var GSSAPIAuthFailed = fmt.Errorf("GSSAPI authentication failed")
+
+// GSSAcceptor is the acceptor side of one GSS-API security context
+type GSSAcceptor interface {
+	// Accept processes a context token from the client. It returns the token
+	// to send back, possibly empty, and the authenticated principal once the
+	// context is established.
+	Accept(token []byte) (reply []byte, principal string, err error)
+	// Unwrap verifies a token the client protected with GSS_Wrap once the
+	// context is established and returns its payload
+	Unwrap(token []byte) ([]byte, error)
+	// Wrap protects a payload for the client with GSS_Wrap, without
+	// confidentiality
+	Wrap(payload []byte) ([]byte, error)
+}
+
+// GSSAPIAuthenticator is used to handle GSSAPI authentication (RFC 1961).
+// It completes the context establishment and the protection level
+// subnegotiation, in which it always selects no per-message protection.
+type GSSAPIAuthenticator struct {
+	// NewAcceptor creates the acceptor of one connection
+	NewAcceptor func() GSSAcceptor
+}
+
+func (a GSSAPIAuthenticator) GetCode() uint8 {
+	return GSSAPIAuth
+}
+
+func (a GSSAPIAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	// Tell the client to use GSSAPI
+	if _, err := writer.Write([]byte{SocksVersion5, GSSAPIAuth}); err != nil {
+		return nil, err
+	}
+
+	acceptor := a.NewAcceptor()
+	for i := 0; i < gssapiMaxExchanges; i++ {
+		mtyp, token, err := readGSSAPIMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+		if mtyp == gssapiMsgAbort {
+			return nil, fmt.Errorf("%v: aborted by client", GSSAPIAuthFailed)
+		}
+		if mtyp != gssapiMsgAuth {
+			writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+			return nil, fmt.Errorf("%v: unexpected message type %d", GSSAPIAuthFailed, mtyp)
+		}
+
+		reply, principal, err := acceptor.Accept(token)
+		if err != nil {
+			writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+			return nil, fmt.Errorf("%v: %v", GSSAPIAuthFailed, err)
+		}
+		if len(reply) > 0 {
+			if err := writeGSSAPIMessage(writer, gssapiMsgAuth, reply); err != nil {
+				return nil, err
+			}
+		}
+		if principal != "" {
+			if err := negotiateProtection(reader, writer, acceptor); err != nil {
+				return nil, err
+			}
+			return &AuthContext{GSSAPIAuth, map[string]string{"Username": principal, "Principal": principal}}, nil
+		}
+	}
+	writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+	return nil, fmt.Errorf("%v: context not established after %d exchanges", GSSAPIAuthFailed, gssapiMaxExchanges)
+}
+
+// negotiateProtection answers the protection level message that follows
+// the context establishment (RFC 1961 section 4). Relayed data is never
+// protected, so whatever the client asks for the server selects no
+// per-message protection. Clients sending the level unwrapped, like those
+// following the NEC implementation, get the reply unwrapped as well.
+func negotiateProtection(reader io.Reader, writer io.Writer, acceptor GSSAcceptor) error {
+	mtyp, token, err := readGSSAPIMessage(reader)
+	if err != nil {
+		return err
+	}
+	if mtyp == gssapiMsgAbort {
+		return fmt.Errorf("%v: aborted by client", GSSAPIAuthFailed)
+	}
+	if mtyp != gssapiMsgProtection {
+		writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+		return fmt.Errorf("%v: unexpected message type %d", GSSAPIAuthFailed, mtyp)
+	}
+
+	wrapped := len(token) != 1
+	level := token
+	if wrapped {
+		if level, err = acceptor.Unwrap(token); err != nil {
+			writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+			return fmt.Errorf("%v: protection level message: %v", GSSAPIAuthFailed, err)
+		}
+	}
+	if len(level) != 1 {
+		writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+		return fmt.Errorf("%v: protection level message of %d octets", GSSAPIAuthFailed, len(level))
+	}
+
+	reply := []byte{gssapiProtectionNone}
+	if wrapped {
+		if reply, err = acceptor.Wrap(reply); err != nil {
+			writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+			return fmt.Errorf("%v: %v", GSSAPIAuthFailed, err)
+		}
+	}
+	return writeGSSAPIMessage(writer, gssapiMsgProtection, reply)
+}
+
+func readGSSAPIMessage(reader io.Reader) (uint8, []byte, error) {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != gssapiVersion {
+		return 0, nil, fmt.Errorf("Unsupported GSSAPI version: %v", header[0])
+	}
+	// an abort message has no length and token
+	if header[1] == gssapiMsgAbort {
+		return header[1], nil, nil
+	}
+	length := []byte{0, 0}
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return 0, nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(reader, token); err != nil {
+		return 0, nil, err
+	}
+	return header[1], token, nil
+}
+
+func writeGSSAPIMessage(writer io.Writer, mtyp uint8, token []byte) error {
+	if len(token) > gssapiMaxTokenBytes {
+		return fmt.Errorf("GSSAPI token too long: %d bytes", len(token))
+	}
+	msg := make([]byte, 4, 4+len(token))
+	msg[0] = gssapiVersion
+	msg[1] = mtyp
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	_, err := writer.Write(append(msg, token...))
+	return err
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// fakeAcceptor establishes a context with the token "hello" and wraps
+// payloads by prefixing them with "w:"
+type fakeAcceptor struct{}
+
+func (fakeAcceptor) Accept(token []byte) ([]byte, string, error) {
+	if string(token) != "hello" {
+		return nil, "", errors.New("bad token")
+	}
+	return []byte("welcome"), "alice@EXAMPLE.COM", nil
+}
+
+func (fakeAcceptor) Unwrap(token []byte) ([]byte, error) {
+	if !bytes.HasPrefix(token, []byte("w:")) {
+		return nil, errors.New("not wrapped")
+	}
+	return token[2:], nil
+}
+
+func (fakeAcceptor) Wrap(payload []byte) ([]byte, error) {
+	return append([]byte("w:"), payload...), nil
+}
+
+func gssapiMessage(mtyp uint8, token string) []byte {
+	var buf bytes.Buffer
+	writeGSSAPIMessage(&buf, mtyp, []byte(token))
+	return buf.Bytes()
+}
+
+func TestGSSAPIAuthenticate(t *testing.T) {
+	selected := []byte{SocksVersion5, GSSAPIAuth}
+	established := append(append([]byte{}, selected...), gssapiMessage(gssapiMsgAuth, "welcome")...)
+	abort := []byte{gssapiVersion, gssapiMsgAbort}
+	tests := []struct {
+		name      string
+		request   [][]byte
+		wantReply [][]byte
+		wantErr   bool
+	}{
+		{
+			name:      "wrapped protection level",
+			request:   [][]byte{gssapiMessage(gssapiMsgAuth, "hello"), gssapiMessage(gssapiMsgProtection, "w:\x02")},
+			wantReply: [][]byte{established, gssapiMessage(gssapiMsgProtection, "w:\x00")},
+		},
+		{
+			name:      "unwrapped protection level",
+			request:   [][]byte{gssapiMessage(gssapiMsgAuth, "hello"), gssapiMessage(gssapiMsgProtection, "\x01")},
+			wantReply: [][]byte{established, gssapiMessage(gssapiMsgProtection, "\x00")},
+		},
+		{
+			name:      "bad protection token",
+			request:   [][]byte{gssapiMessage(gssapiMsgAuth, "hello"), gssapiMessage(gssapiMsgProtection, "xx")},
+			wantReply: [][]byte{established, abort},
+			wantErr:   true,
+		},
+		{
+			name:      "no protection message",
+			request:   [][]byte{gssapiMessage(gssapiMsgAuth, "hello"), gssapiMessage(gssapiMsgAuth, "hello")},
+			wantReply: [][]byte{established, abort},
+			wantErr:   true,
+		},
+		{
+			name:      "client abort",
+			request:   [][]byte{gssapiMessage(gssapiMsgAuth, "hello"), abort},
+			wantReply: [][]byte{established},
+			wantErr:   true,
+		},
+		{
+			name:      "rejected context",
+			request:   [][]byte{gssapiMessage(gssapiMsgAuth, "bye")},
+			wantReply: [][]byte{selected, abort},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := GSSAPIAuthenticator{NewAcceptor: func() GSSAcceptor { return fakeAcceptor{} }}
+			var reply bytes.Buffer
+			authCtx, err := a.Authenticate(bytes.NewReader(bytes.Join(tt.request, nil)), &reply)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if want := bytes.Join(tt.wantReply, nil); !bytes.Equal(reply.Bytes(), want) {
+				t.Errorf("reply = %q, want %q", reply.Bytes(), want)
+			}
+			if err == nil && authCtx.Username() != "alice@EXAMPLE.COM" {
+				t.Errorf("Username() = %q", authCtx.Username())
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+)
+
+// tracked usernames and addresses before expired entries are swept
+const maxGuardEntries = 10000
+
+// Ban blocks an address or CIDR until the given time
+type Ban struct {
+	Address string    `json:"address"`
+	Until   time.Time `json:"until"`
+
+	network *net.IPNet
+}
+
+// GuardConfig is read from the file named by SOCKS_AUTH_GUARD_FILE
+type GuardConfig struct {
+	// Failures per username or address before it is locked out
+	MaxAttempts int `json:"maxAttempts"`
+	// Failures older than this are forgotten
+	Window string `json:"window"`
+	// First failure delay, doubled on every further failure up to MaxDelay
+	BaseDelay string `json:"baseDelay"`
+	MaxDelay  string `json:"maxDelay"`
+	// How long a lockout lasts
+	Lockout string `json:"lockout"`
+	// Delay before rejecting attempts of locked out or banned clients
+	LockedDelay string `json:"lockedDelay"`
+	// Log failures in a format fail2ban can match
+	Fail2BanLog bool  `json:"fail2banLog"`
+	Bans        []Ban `json:"bans"`
+
+	window, baseDelay, maxDelay, lockout, lockedDelay time.Duration
+}
+
+// LoadGuardConfig reads a JSON guard config, omitted durations get defaults
+func LoadGuardConfig(path string) (GuardConfig, error) {
+	config := GuardConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid auth guard file %s: %v", path, err)
+	}
+	for _, d := range []struct {
+		value string
+		dest  *time.Duration
+		def   time.Duration
+	}{
+		{config.Window, &config.window, 15 * time.Minute},
+		{config.BaseDelay, &config.baseDelay, 500 * time.Millisecond},
+		{config.MaxDelay, &config.maxDelay, 10 * time.Second},
+		{config.Lockout, &config.lockout, 15 * time.Minute},
+		{config.LockedDelay, &config.lockedDelay, 3 * time.Second},
+	} {
+		*d.dest = d.def
+		if d.value != "" {
+			if *d.dest, err = time.ParseDuration(d.value); err != nil {
+				return config, fmt.Errorf("invalid duration %q in %s", d.value, path)
+			}
+		}
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	for i := range config.Bans {
+		ban := &config.Bans[i]
+		address := ban.Address
+		if !strings.Contains(address, "/") {
+			if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+				address += "/32"
+			} else {
+				address += "/128"
+			}
+		}
+		if _, ban.network, err = net.ParseCIDR(address); err != nil {
+			return config, fmt.Errorf("invalid ban address %q in %s", ban.Address, path)
+		}
+	}
+	return config, nil
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Guard tracks failed logins per username and per source address,
+// delays failures with exponential backoff and locks out repeat offenders
+type Guard struct {
+	mu     sync.Mutex
+	config GuardConfig
+	users  map[string]*failures
+	ips    map[string]*failures
+}
+
+func NewGuard(config GuardConfig) *Guard {
+	return &Guard{
+		config: config,
+		users:  make(map[string]*failures),
+		ips:    make(map[string]*failures),
+	}
+}
+
+// Locked reports whether attempts for user or from ip are currently refused
+func (g *Guard) Locked(user, ip string) bool {
+	now := time.Now()
+	if g.banned(ip, now) {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lockedKey(g.users, user, now) || g.lockedKey(g.ips, ip, now)
+}
+
+func (g *Guard) banned(ip string, now time.Time) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, ban := range g.config.Bans {
+		if now.Before(ban.Until) && ban.network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Guard) lockedKey(m map[string]*failures, key string, now time.Time) bool {
+	f, ok := m[key]
+	return ok && now.Before(f.lockedUntil)
+}
+
+// Failure records a failed attempt and returns how long to wait before replying
+func (g *Guard) Failure(user, ip string) time.Duration {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	userCount := g.fail(g.users, user, now)
+	ipCount := g.fail(g.ips, ip, now)
+	if g.config.Fail2BanLog {
+		logger.Warn(fail2banLine(user, ip))
+	}
+
+	count := userCount
+	if ipCount > count {
+		count = ipCount
+	}
+	delay := g.config.baseDelay
+	for i := 1; i < count && delay < g.config.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.config.maxDelay {
+		delay = g.config.maxDelay
+	}
+	return delay
+}
+
+// fail2banLine describes a failure for fail2ban. The address goes first and
+// the username is quoted, so that a crafted username can not pass for
+// another address.
+func fail2banLine(user, ip string) string {
+	return fmt.Sprintf("socks authentication failure; rhost=%s user=%q", ip, user)
+}
+
+func (g *Guard) fail(m map[string]*failures, key string, now time.Time) int {
+	if key == "" {
+		return 0
+	}
+	if len(m) >= maxGuardEntries {
+		g.sweep(m, now)
+	}
+	f, ok := m[key]
+	if !ok || now.Sub(f.last) > g.config.window {
+		f = &failures{}
+		m[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= g.config.MaxAttempts && !now.Before(f.lockedUntil) {
+		f.lockedUntil = now.Add(g.config.lockout)
+		logger.Infof("Locked out %q for %s after %d failed logins", key, g.config.lockout, f.count)
+	}
+	return f.count
+}
+
+func (g *Guard) sweep(m map[string]*failures, now time.Time) {
+	for key, f := range m {
+		if now.Sub(f.last) > g.config.window && !now.Before(f.lockedUntil) {
+			delete(m, key)
+		}
+	}
+}
+
+// Success forgets the failures of user. Failures of the address are kept so
+// one valid account can not be used to reset them.
+func (g *Guard) Success(user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.users, user)
+}
+
+// LockedDelay is how long locked out attempts are held before the reply
+func (g *Guard) LockedDelay() time.Duration {
+	return g.config.lockedDelay
+}
+
+// remoteIP returns the client address when the writer is the client connection
+func remoteIP(writer io.Writer) string {
+	conn, ok := writer.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadGuard(t *testing.T, config string) *Guard {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "guard.json")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	guardConfig, err := LoadGuardConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGuard(guardConfig)
+}
+
+func TestGuardBackoff(t *testing.T) {
+	g := loadGuard(t, `{"maxAttempts": 10, "baseDelay": "100ms", "maxDelay": "1s"}`)
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if got := g.Failure("alice", "192.0.2.1"); got != w*time.Millisecond {
+			t.Errorf("failure %d delayed %v, want %v", i+1, got, w*time.Millisecond)
+		}
+	}
+}
+
+func TestGuardLockout(t *testing.T) {
+	g := loadGuard(t, `{"maxAttempts": 3}`)
+	for i := 0; i < 2; i++ {
+		g.Failure("alice", "192.0.2.1")
+	}
+	if g.Locked("alice", "192.0.2.9") {
+		t.Fatal("locked out before maxAttempts")
+	}
+	g.Failure("alice", "192.0.2.2")
+
+	tests := []struct {
+		user, ip string
+		want     bool
+	}{
+		{"alice", "192.0.2.9", true},
+		{"bob", "192.0.2.9", false},
+		{"bob", "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		if got := g.Locked(tt.user, tt.ip); got != tt.want {
+			t.Errorf("Locked(%q, %q) = %v, want %v", tt.user, tt.ip, got, tt.want)
+		}
+	}
+
+	// a valid login of another account does not reset the address
+	g.Failure("carol", "192.0.2.1")
+	g.Success("bob")
+	if !g.Locked("bob", "192.0.2.1") {
+		t.Error("address not locked out after maxAttempts")
+	}
+}
+
+func TestGuardBans(t *testing.T) {
+	g := loadGuard(t, `{"bans": [
+		{"address": "198.51.100.7", "until": "2999-01-01T00:00:00Z"},
+		{"address": "2001:db8::/32", "until": "2999-01-01T00:00:00Z"},
+		{"address": "203.0.113.0/24", "until": "2000-01-01T00:00:00Z"}
+	]}`)
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"2001:db8::1", true},
+		{"203.0.113.5", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := g.Locked("", tt.ip); got != tt.want {
+			t.Errorf("Locked(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestFail2banLine(t *testing.T) {
+	tests := []struct {
+		user string
+		want string
+	}{
+		{"alice", `socks authentication failure; rhost=192.0.2.1 user="alice"`},
+		{"x rhost=203.0.113.9", `socks authentication failure; rhost=192.0.2.1 user="x rhost=203.0.113.9"`},
+		{"x\nsocks authentication failure; rhost=203.0.113.9", `socks authentication failure; rhost=192.0.2.1 user="x\nsocks authentication failure; rhost=203.0.113.9"`},
+	}
+	for _, tt := range tests {
+		got := fail2banLine(tt.user, "192.0.2.1")
+		if got != tt.want {
+			t.Errorf("fail2banLine(%q) = %s, want %s", tt.user, got, tt.want)
+		}
+		if strings.Contains(got, "\n") {
+			t.Errorf("fail2banLine(%q) spans lines", tt.user)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// allowed clock difference when checking exp and nbf
+const tokenLeeway = 30 * time.Second
+
+// TokenVerifier validates a token and returns its claims
+type TokenVerifier interface {
+	Verify(token string) (map[string]interface{}, error)
+}
+
+// TokenVerifiers accepts a token if any of the verifiers does
+type TokenVerifiers []TokenVerifier
+
+func (v TokenVerifiers) Verify(token string) (map[string]interface{}, error) {
+	err := fmt.Errorf("no token verifier configured")
+	for _, verifier := range v {
+		var claims map[string]interface{}
+		if claims, err = verifier.Verify(token); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, err
+}
+
+// ClaimChecks are the registered claims checked after the signature
+type ClaimChecks struct {
+	// Required "aud" value, not checked if empty
+	Audience string
+	// Required "iss" value, not checked if empty
+	Issuer string
+	// Accept tokens without "exp", which then never expire
+	AllowNoExpiry bool
+}
+
+func (c ClaimChecks) check(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok && !c.AllowNoExpiry {
+		return fmt.Errorf("token has no expiry")
+	}
+	if ok && now.After(time.Unix(int64(exp), 0).Add(tokenLeeway)) {
+		return fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(tokenLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token not valid yet")
+	}
+	if c.Issuer != "" && claims["iss"] != c.Issuer {
+		return fmt.Errorf("token issuer mismatch")
+	}
+	if c.Audience != "" && !hasAudience(claims["aud"], c.Audience) {
+		return fmt.Errorf("token audience mismatch")
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parseJWT splits a compact JWT and decodes header, claims and signature
+func parseJWT(token string) (header jwtHeader, claims map[string]interface{}, signed []byte, sig []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, nil, nil, fmt.Errorf("malformed token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, nil, nil, nil, fmt.Errorf("malformed token header")
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return header, nil, nil, nil, fmt.Errorf("malformed token header")
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header, nil, nil, nil, fmt.Errorf("malformed token claims")
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return header, nil, nil, nil, fmt.Errorf("malformed token claims")
+	}
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, nil, nil, nil, fmt.Errorf("malformed token signature")
+	}
+	return header, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+// HMACVerifier accepts HS256 signed JWTs
+type HMACVerifier struct {
+	Secret []byte
+	ClaimChecks
+}
+
+func (v *HMACVerifier) Verify(token string) (map[string]interface{}, error) {
+	header, claims, signed, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	mac := hmac.New(sha256.New, v.Secret)
+	mac.Write(signed)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+	return claims, v.check(claims)
+}
+
+// JWKSVerifier accepts RS256 and ES256 signed JWTs using keys from a JWKS file
+type JWKSVerifier struct {
+	// keys by "kid"
+	keys map[string]crypto.PublicKey
+	ClaimChecks
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads the RSA and P-256 keys of a JWKS file
+func LoadJWKS(path string, checks ClaimChecks) (*JWKSVerifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks file %s: %v", path, err)
+	}
+	v := &JWKSVerifier{keys: make(map[string]crypto.PublicKey), ClaimChecks: checks}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks file %s, key %q: %v", path, k.Kid, err)
+		}
+		v.keys[k.Kid] = key
+	}
+	return v, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (v *JWKSVerifier) Verify(token string) (map[string]interface{}, error) {
+	header, claims, signed, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := v.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown token key %q", header.Kid)
+	}
+	digest := sha256.Sum256(signed)
+	switch header.Alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	return claims, v.check(claims)
+}
+
+// tokenUsername returns the username held by usernameClaim, "sub" if empty.
+// Tokens without it are refused, their sessions would have no identity.
+func tokenUsername(claims map[string]interface{}, usernameClaim string) (string, string, error) {
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	user, ok := claims[usernameClaim].(string)
+	if !ok || user == "" {
+		return "", usernameClaim, fmt.Errorf("token has no %q claim", usernameClaim)
+	}
+	return user, usernameClaim, nil
+}
+
+// reservedAttributes are set by the server, claims of the same name are
+// left out so that a token can not choose its username or session expiry
+var reservedAttributes = map[string]bool{
+	"Username":              true,
+	"Principal":             true,
+	SessionExpiresAttribute: true,
+}
+
+// claimsPayload flattens claims into an AuthContext payload, non string
+// claims are kept as JSON. The username is taken from usernameClaim.
+func claimsPayload(claims map[string]interface{}, usernameClaim string) map[string]string {
+	payload := make(map[string]string, len(claims)+1)
+	for name, value := range claims {
+		if reservedAttributes[name] {
+			continue
+		}
+		if s, ok := value.(string); ok {
+			payload[name] = s
+			continue
+		}
+		if data, err := json.Marshal(value); err == nil {
+			payload[name] = string(data)
+		}
+	}
+	if user, ok := claims[usernameClaim].(string); ok {
+		payload["Username"] = user
+	}
+	return payload
+}
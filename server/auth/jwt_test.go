@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("secret")
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signHS256 returns a compact HS256 JWT holding claims
+func signHS256(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	signed := encodeSegment(t, jwtHeader{Alg: "HS256"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func testClaims(extra map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": "alice",
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+	}
+	for name, value := range extra {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestHMACVerifier(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		checks  ClaimChecks
+		token   func(t *testing.T) string
+		wantErr bool
+	}{
+		{"valid", ClaimChecks{}, func(t *testing.T) string { return signHS256(t, testClaims(nil)) }, false},
+		{"expired", ClaimChecks{}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"exp": float64(now.Add(-time.Hour).Unix())}))
+		}, true},
+		{"expired within leeway", ClaimChecks{}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"exp": float64(now.Add(-10 * time.Second).Unix())}))
+		}, false},
+		{"no expiry", ClaimChecks{}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"exp": nil}))
+		}, true},
+		{"no expiry allowed", ClaimChecks{AllowNoExpiry: true}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"exp": nil}))
+		}, false},
+		{"not valid yet", ClaimChecks{}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"nbf": float64(now.Add(time.Hour).Unix())}))
+		}, true},
+		{"issuer", ClaimChecks{Issuer: "idp"}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"iss": "idp"}))
+		}, false},
+		{"wrong issuer", ClaimChecks{Issuer: "idp"}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"iss": "other"}))
+		}, true},
+		{"audience list", ClaimChecks{Audience: "proxy"}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"aud": []string{"web", "proxy"}}))
+		}, false},
+		{"wrong audience", ClaimChecks{Audience: "proxy"}, func(t *testing.T) string {
+			return signHS256(t, testClaims(map[string]interface{}{"aud": "web"}))
+		}, true},
+		{"bad signature", ClaimChecks{}, func(t *testing.T) string {
+			return signHS256(t, testClaims(nil)) + "x"
+		}, true},
+		{"tampered claims", ClaimChecks{}, func(t *testing.T) string {
+			token := signHS256(t, testClaims(nil))
+			other := signHS256(t, testClaims(map[string]interface{}{"sub": "mallory"}))
+			return other[:len(other)-43] + token[len(token)-43:]
+		}, true},
+		{"none algorithm", ClaimChecks{}, func(t *testing.T) string {
+			return encodeSegment(t, jwtHeader{Alg: "none"}) + "." + encodeSegment(t, testClaims(nil)) + "."
+		}, true},
+		{"malformed", ClaimChecks{}, func(t *testing.T) string { return "not.a-token" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &HMACVerifier{Secret: testSecret, ClaimChecks: tt.checks}
+			_, err := v.Verify(tt.token(t))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func paddedBytes(n *big.Int, size int) []byte {
+	b := make([]byte, size)
+	return n.FillBytes(b)
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(paddedBytes(ecKey.X, 32)), "y": b64(paddedBytes(ecKey.Y, 32))},
+	}}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(jwks)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := LoadJWKS(path, ClaimChecks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(alg, kid string) string {
+		signed := encodeSegment(t, jwtHeader{Alg: alg, Kid: kid}) + "." + encodeSegment(t, testClaims(nil))
+		digest := sha256.Sum256([]byte(signed))
+		var sig []byte
+		switch alg {
+		case "RS256":
+			if sig, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:]); err != nil {
+				t.Fatal(err)
+			}
+		case "ES256":
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig = append(paddedBytes(r, 32), paddedBytes(s, 32)...)
+		}
+		return signed + "." + b64(sig)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"rsa", sign("RS256", "rsa"), false},
+		{"ec", sign("ES256", "ec"), false},
+		{"unknown key", sign("RS256", "other"), true},
+		{"algorithm of another key", sign("ES256", "rsa"), true},
+		{"hmac with a public key", signHS256(t, testClaims(nil)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims["sub"] != "alice" {
+				t.Errorf("sub = %v, want alice", claims["sub"])
+			}
+		})
+	}
+}
+
+func TestClaimsPayload(t *testing.T) {
+	payload := claimsPayload(map[string]interface{}{
+		"email":  "alice@example.com",
+		"groups": []interface{}{"a", "b"},
+		"exp":    float64(1700000000),
+		// reserved attributes can not be claimed
+		"Username":       "root",
+		"Principal":      "root@EXAMPLE.COM",
+		"SessionExpires": "2100-01-01T00:00:00Z",
+	}, "email")
+	want := map[string]string{
+		"Username": "alice@example.com",
+		"email":    "alice@example.com",
+		"groups":   `["a","b"]`,
+		"exp":      "1700000000",
+	}
+	if len(payload) != len(want) {
+		t.Errorf("payload = %v, want %v", payload, want)
+	}
+	for name, value := range want {
+		if payload[name] != value {
+			t.Errorf("payload[%q] = %q, want %q", name, payload[name], value)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package kerberos
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+
+	"github.com/thifnmi/proxy-socks-server/server/auth"
+)
+
+// GSS-API KRB5 token id of an AP-REP (RFC 1964)
+var tokIDAPRep = []byte{0x02, 0x00}
+
+// flags of RFC 4121 wrap tokens
+const (
+	wrapFlagSentByAcceptor = 0x01
+	wrapFlagSealed         = 0x02
+)
+
+// Service accepts Kerberos GSS-API contexts for a principal of a keytab
+type Service struct {
+	settings *service.Settings
+}
+
+// Load reads the keytab. principal selects the service principal to accept
+// tickets for, like "rcmd/proxy.example.com"; if empty the ticket's own
+// service name is looked up in the keytab.
+func Load(keytabPath, principal string) (*Service, error) {
+	kt, err := keytab.Load(keytabPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keytab %s: %v", keytabPath, err)
+	}
+	var options []func(*service.Settings)
+	if principal != "" {
+		options = append(options, service.KeytabPrincipal(principal))
+	}
+	return &Service{settings: service.NewSettings(kt, options...)}, nil
+}
+
+// NewAcceptor returns the acceptor for one connection
+func (s *Service) NewAcceptor() auth.GSSAcceptor {
+	return &acceptor{service: s}
+}
+
+type acceptor struct {
+	service *Service
+	// key of the established context, protecting the wrap tokens
+	key types.EncryptionKey
+}
+
+// Accept verifies the AP-REQ in the initial context token. The Kerberos
+// mechanism needs a single round trip, answered with an AP-REP when the
+// client asks for mutual authentication.
+func (a *acceptor) Accept(token []byte) ([]byte, string, error) {
+	var krb5Token spnego.KRB5Token
+	if err := krb5Token.Unmarshal(token); err != nil {
+		return nil, "", err
+	}
+	if !krb5Token.IsAPReq() {
+		return nil, "", fmt.Errorf("initial context token is not an AP-REQ")
+	}
+	apReq := &krb5Token.APReq
+	ok, creds, err := service.VerifyAPREQ(apReq, a.service.settings)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("AP-REQ is not valid")
+	}
+	principal := creds.CName().PrincipalNameString() + "@" + creds.Realm()
+	// the AP-REP asserts no subkey, so the initiator's one is used if it
+	// sent one (RFC 4121 section 2)
+	a.key = apReq.Ticket.DecryptedEncPart.Key
+	if apReq.Authenticator.SubKey.KeyType != 0 {
+		a.key = apReq.Authenticator.SubKey
+	}
+
+	if !types.IsFlagSet(&apReq.APOptions, flags.APOptionMutualRequired) {
+		return nil, principal, nil
+	}
+	reply, err := apRepToken(apReq)
+	if err != nil {
+		return nil, "", err
+	}
+	return reply, principal, nil
+}
+
+// Unwrap verifies an RFC 4121 wrap token sent without confidentiality
+func (a *acceptor) Unwrap(token []byte) ([]byte, error) {
+	if a.key.KeyType == 0 {
+		return nil, fmt.Errorf("context is not established")
+	}
+	if len(token) < gssapi.HdrLen {
+		return nil, fmt.Errorf("wrap token too short")
+	}
+	if token[2]&wrapFlagSealed != 0 {
+		return nil, fmt.Errorf("sealed wrap tokens are not supported")
+	}
+	// undo the right rotation of the payload and checksum
+	if rrc := int(binary.BigEndian.Uint16(token[6:8])); rrc != 0 {
+		body := token[gssapi.HdrLen:]
+		rrc %= len(body)
+		rotated := make([]byte, 0, len(token))
+		rotated = append(rotated, token[:gssapi.HdrLen]...)
+		rotated = append(rotated, body[rrc:]...)
+		token = append(rotated, body[:rrc]...)
+		binary.BigEndian.PutUint16(token[6:8], 0)
+	}
+	var wt gssapi.WrapToken
+	if err := wt.Unmarshal(token, false); err != nil {
+		return nil, err
+	}
+	if _, err := wt.Verify(a.key, keyusage.GSSAPI_INITIATOR_SEAL); err != nil {
+		return nil, err
+	}
+	return wt.Payload, nil
+}
+
+// Wrap builds an RFC 4121 wrap token without confidentiality
+func (a *acceptor) Wrap(payload []byte) ([]byte, error) {
+	if a.key.KeyType == 0 {
+		return nil, fmt.Errorf("context is not established")
+	}
+	etype, err := crypto.GetEtype(a.key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	wt := gssapi.WrapToken{
+		Flags:   wrapFlagSentByAcceptor,
+		EC:      uint16(etype.GetHMACBitLength() / 8),
+		Payload: payload,
+	}
+	if err := wt.SetCheckSum(a.key, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+		return nil, err
+	}
+	return wt.Marshal()
+}
+
+// apRepToken builds the AP-REP context token proving the service could
+// decrypt the ticket (RFC 4120 section 3.2.4, RFC 1964 section 1.1.2)
+func apRepToken(apReq *messages.APReq) ([]byte, error) {
+	encPart, err := asn1.Marshal(messages.EncAPRepPart{
+		CTime: apReq.Authenticator.CTime,
+		Cusec: apReq.Authenticator.Cusec,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encPart = asn1tools.AddASNAppTag(encPart, asnAppTag.EncAPRepPart)
+	sessionKey := apReq.Ticket.DecryptedEncPart.Key
+	encrypted, err := crypto.GetEncryptedData(encPart, sessionKey, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+	apRep, err := asn1.Marshal(messages.APRep{
+		PVNO:    5,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	apRep = asn1tools.AddASNAppTag(apRep, asnAppTag.APREP)
+
+	oid, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	token := append(oid, tokIDAPRep...)
+	token = append(token, apRep...)
+	return asn1tools.AddASNAppTag(token, 0), nil
+}
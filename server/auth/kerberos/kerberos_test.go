@@ -0,0 +1,213 @@
+package kerberos
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	testRealm   = "TEST.REALM"
+	testService = "rcmd/proxy.test"
+)
+
+// testKeytab returns a keytab of the service principal derived from password
+func testKeytab(t *testing.T, password string) *keytab.Keytab {
+	t.Helper()
+	kt := keytab.New()
+	if err := kt.AddEntry(testService, testRealm, password, time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+	return kt
+}
+
+func loadService(t *testing.T, kt *keytab.Keytab) *Service {
+	t.Helper()
+	data, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "proxy.keytab")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path, testService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// initialToken plays the KDC and the client: it issues a ticket for the
+// service, encrypted with the key of kdcKeytab, and wraps the AP-REQ into
+// an initial context token. It returns the token and the session key.
+func initialToken(t *testing.T, kdcKeytab *keytab.Keytab, mutual bool) ([]byte, types.EncryptionKey) {
+	t.Helper()
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "alice")
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, testService)
+	now := time.Now().UTC()
+	tkt, sessionKey, err := messages.NewTicket(cname, testRealm, sname, testRealm, types.NewKrbFlags(), kdcKeytab,
+		etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := types.NewAuthenticator(testRealm, cname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apReq, err := messages.NewAPReq(tkt, sessionKey, authenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutual {
+		types.SetFlag(&apReq.APOptions, flags.APOptionMutualRequired)
+	}
+	apReqBytes, err := apReq.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := append(oid, 0x01, 0x00)
+	token = append(token, apReqBytes...)
+	return asn1tools.AddASNAppTag(token, 0), sessionKey
+}
+
+func TestAccept(t *testing.T) {
+	kt := testKeytab(t, "service password")
+	s := loadService(t, kt)
+	tests := []struct {
+		name      string
+		kdcKeytab *keytab.Keytab
+		mutual    bool
+		wantErr   bool
+	}{
+		{"ticket", kt, false, false},
+		{"mutual authentication", kt, true, false},
+		{"ticket for another key", testKeytab(t, "other password"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _ := initialToken(t, tt.kdcKeytab, tt.mutual)
+			reply, principal, err := s.NewAcceptor().Accept(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Accept() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if principal != "alice@"+testRealm {
+				t.Errorf("principal = %q", principal)
+			}
+			if !tt.mutual {
+				if len(reply) != 0 {
+					t.Errorf("reply of %d bytes without mutual authentication", len(reply))
+				}
+				return
+			}
+			var krb5Token spnego.KRB5Token
+			if err := krb5Token.Unmarshal(reply); err != nil {
+				t.Fatal(err)
+			}
+			if !krb5Token.IsAPRep() {
+				t.Error("reply is not an AP-REP")
+			}
+		})
+	}
+}
+
+func TestAcceptGarbage(t *testing.T) {
+	s := loadService(t, testKeytab(t, "service password"))
+	if _, _, err := s.NewAcceptor().Accept([]byte("garbage")); err == nil {
+		t.Error("garbage token accepted")
+	}
+}
+
+// rotate moves the last rrc bytes after the header of a wrap token to the front
+func rotate(token []byte, rrc int) []byte {
+	body := token[gssapi.HdrLen:]
+	rotated := append([]byte{}, token[:gssapi.HdrLen]...)
+	rotated = append(rotated, body[len(body)-rrc:]...)
+	rotated = append(rotated, body[:len(body)-rrc]...)
+	binary.BigEndian.PutUint16(rotated[6:8], uint16(rrc))
+	return rotated
+}
+
+func TestWrap(t *testing.T) {
+	kt := testKeytab(t, "service password")
+	acceptor := loadService(t, kt).NewAcceptor()
+	if _, err := acceptor.Wrap([]byte{0}); err == nil {
+		t.Error("Wrap() succeeded before the context was established")
+	}
+	token, sessionKey := initialToken(t, kt, false)
+	if _, _, err := acceptor.Accept(token); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := gssapi.NewInitiatorWrapToken([]byte{2}, sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := wt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, wrapped...)
+	tampered[gssapi.HdrLen] = 1
+	sealed := append([]byte{}, wrapped...)
+	sealed[2] |= wrapFlagSealed
+
+	tests := []struct {
+		name    string
+		token   []byte
+		wantErr bool
+	}{
+		{"wrapped", wrapped, false},
+		{"rotated", rotate(wrapped, 5), false},
+		{"tampered", tampered, true},
+		{"sealed", sealed, true},
+		{"short", wrapped[:10], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := acceptor.Unwrap(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unwrap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(payload) != 1 || payload[0] != 2) {
+				t.Errorf("payload = %v, want [2]", payload)
+			}
+		})
+	}
+
+	reply, err := acceptor.Wrap([]byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replyToken gssapi.WrapToken
+	if err := replyToken.Unmarshal(reply, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := replyToken.Verify(sessionKey, keyusage.GSSAPI_ACCEPTOR_SEAL); !ok {
+		t.Fatalf("reply does not verify: %v", err)
+	}
+	if len(replyToken.Payload) != 1 || replyToken.Payload[0] != 0 {
+		t.Errorf("reply payload = %v, want [0]", replyToken.Payload)
+	}
+}
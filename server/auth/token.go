@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// TokenAuth is a private method (X'80' to X'FE') for bearer tokens
+	TokenAuth        = uint8(0x80)
+	TokenAuthVersion = uint8(1)
+)
+
+var TokenAuthFailed = fmt.Errorf("Token authentication failed")
+
+// TokenAuthenticator is used to handle bearer token authentication.
+// After selecting the method the client sends
+//
+//	+----+------+----------+
+//	|VER | TLEN |  TOKEN   |
+//	+----+------+----------+
+//	| 1  |  2   | 1-65535  |
+//	+----+------+----------+
+//
+// with TLEN in network byte order, and the server answers VER, STATUS
+// like username/password authentication.
+type TokenAuthenticator struct {
+	Verifier TokenVerifier
+	// Claim holding the username, "sub" if empty
+	UsernameClaim string
+}
+
+func (a TokenAuthenticator) GetCode() uint8 {
+	return TokenAuth
+}
+
+func (a TokenAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	// Tell the client to use token auth
+	if _, err := writer.Write([]byte{SocksVersion5, TokenAuth}); err != nil {
+		return nil, err
+	}
+
+	// Get the version and token length
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	// Ensure we are compatible
+	if header[0] != TokenAuthVersion {
+		return nil, fmt.Errorf("Unsupported token auth version: %v", header[0])
+	}
+
+	// Get the token
+	token := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(reader, token); err != nil {
+		return nil, err
+	}
+
+	// Verify the token
+	claims, err := a.Verifier.Verify(string(token))
+	var usernameClaim string
+	if err == nil {
+		_, usernameClaim, err = tokenUsername(claims, a.UsernameClaim)
+	}
+	if err != nil {
+		if _, werr := writer.Write([]byte{TokenAuthVersion, AuthFailure}); werr != nil {
+			return nil, werr
+		}
+		return nil, fmt.Errorf("%v: %v", TokenAuthFailed, err)
+	}
+	if _, err := writer.Write([]byte{TokenAuthVersion, AuthSuccess}); err != nil {
+		return nil, err
+	}
+	return &AuthContext{TokenAuth, claimsPayload(claims, usernameClaim)}, nil
+}
+
+// TokenCredentials accepts a token as password, for clients limited to
+// username/password authentication. The username claim of the token must
+// equal the given username. Claims become session attributes.
+type TokenCredentials struct {
+	Verifier TokenVerifier
+	// Claim holding the username, "sub" if empty
+	UsernameClaim string
+}
+
+func (t TokenCredentials) Valid(user, password string) bool {
+	_, ok := t.ValidClaims(user, password)
+	return ok
+}
+
+func (t TokenCredentials) ValidClaims(user, password string) (map[string]string, bool) {
+	claims, err := t.Verifier.Verify(password)
+	if err != nil {
+		return nil, false
+	}
+	// the identity comes from the token, never from the client alone
+	claimed, usernameClaim, err := tokenUsername(claims, t.UsernameClaim)
+	if err != nil || claimed != user {
+		return nil, false
+	}
+	return claimsPayload(claims, usernameClaim), true
+}
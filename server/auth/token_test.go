@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestTokenCredentials(t *testing.T) {
+	store := TokenCredentials{Verifier: &HMACVerifier{Secret: testSecret}}
+	tests := []struct {
+		name     string
+		user     string
+		token    string
+		wantOK   bool
+		wantUser string
+	}{
+		{"matching user", "alice", signHS256(t, testClaims(nil)), true, "alice"},
+		{"other user", "bob", signHS256(t, testClaims(nil)), false, ""},
+		{"no username claim", "alice", signHS256(t, testClaims(map[string]interface{}{"sub": nil})), false, ""},
+		{"empty username claim", "", signHS256(t, testClaims(map[string]interface{}{"sub": ""})), false, ""},
+		{"invalid token", "alice", "alice", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, ok := store.ValidClaims(tt.user, tt.token)
+			if ok != tt.wantOK {
+				t.Fatalf("ValidClaims() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if payload["Username"] != tt.wantUser {
+				t.Errorf("Username = %q, want %q", payload["Username"], tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestTokenCredentialsUsernameClaim(t *testing.T) {
+	store := TokenCredentials{Verifier: &HMACVerifier{Secret: testSecret}, UsernameClaim: "email"}
+	token := signHS256(t, testClaims(map[string]interface{}{"email": "alice@example.com"}))
+	if _, ok := store.ValidClaims("alice", token); ok {
+		t.Error("token accepted for the sub instead of the configured claim")
+	}
+	payload, ok := store.ValidClaims("alice@example.com", token)
+	if !ok || payload["Username"] != "alice@example.com" {
+		t.Errorf("ValidClaims() = %v, %v", payload, ok)
+	}
+}
+
+func tokenRequest(token string) []byte {
+	req := []byte{TokenAuthVersion, 0, 0}
+	binary.BigEndian.PutUint16(req[1:], uint16(len(token)))
+	return append(req, token...)
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	a := TokenAuthenticator{Verifier: &HMACVerifier{Secret: testSecret}}
+	tests := []struct {
+		name      string
+		token     string
+		wantReply []byte
+		wantUser  string
+		wantErr   bool
+	}{
+		{"valid", signHS256(t, testClaims(nil)), []byte{SocksVersion5, TokenAuth, TokenAuthVersion, AuthSuccess}, "alice", false},
+		{"no username claim", signHS256(t, testClaims(map[string]interface{}{"sub": nil})), []byte{SocksVersion5, TokenAuth, TokenAuthVersion, AuthFailure}, "", true},
+		{"invalid", "garbage", []byte{SocksVersion5, TokenAuth, TokenAuthVersion, AuthFailure}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply bytes.Buffer
+			authCtx, err := a.Authenticate(bytes.NewReader(tokenRequest(tt.token)), &reply)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(reply.Bytes(), tt.wantReply) {
+				t.Errorf("reply = %v, want %v", reply.Bytes(), tt.wantReply)
+			}
+			if authCtx.Username() != tt.wantUser {
+				t.Errorf("Username() = %q, want %q", authCtx.Username(), tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package connlimit
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Reasons a connection is rejected for
+const (
+	ReasonGlobal  = "global"
+	ReasonPerIP   = "per-ip"
+	ReasonPerUser = "per-user"
+)
+
+// LimitError is returned when a connection would exceed a limit
+type LimitError struct {
+	Reason string
+	Limit  int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s connection limit of %d reached", e.Reason, e.Limit)
+}
+
+// Limits on simultaneous sessions, 0 means unlimited
+type Limits struct {
+	Global  int
+	PerIP   int
+	PerUser int
+}
+
+// Limiter counts open sessions, rejections are counted by the
+// socks_connections_rejected_total metric
+type Limiter struct {
+	mu     sync.Mutex
+	limits Limits
+	total  int
+	ips    map[string]int
+	users  map[string]int
+}
+
+func New(limits Limits) *Limiter {
+	return &Limiter{
+		limits: limits,
+		ips:    make(map[string]int),
+		users:  make(map[string]int),
+	}
+}
+
+// Acquire takes a global and a per source IP slot for a newly accepted
+// connection. release must be called once the connection is closed, even on error.
+// A nil Limiter always succeeds.
+func (l *Limiter) Acquire(ip string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.Global > 0 && l.total >= l.limits.Global {
+		return func() {}, &LimitError{Reason: ReasonGlobal, Limit: l.limits.Global}
+	}
+	if l.limits.PerIP > 0 && l.ips[ip] >= l.limits.PerIP {
+		return func() {}, &LimitError{Reason: ReasonPerIP, Limit: l.limits.PerIP}
+	}
+	l.total++
+	l.ips[ip]++
+	return l.releaseOnce(func() {
+		l.total--
+		if l.ips[ip]--; l.ips[ip] == 0 {
+			delete(l.ips, ip)
+		}
+	}), nil
+}
+
+// AcquireUser takes a slot for an authenticated user, anonymous sessions are not limited
+func (l *Limiter) AcquireUser(user string) (release func(), err error) {
+	if l == nil || user == "" {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.PerUser > 0 && l.users[user] >= l.limits.PerUser {
+		return func() {}, &LimitError{Reason: ReasonPerUser, Limit: l.limits.PerUser}
+	}
+	l.users[user]++
+	return l.releaseOnce(func() {
+		if l.users[user]--; l.users[user] == 0 {
+			delete(l.users, user)
+		}
+	}), nil
+}
+
+func (l *Limiter) releaseOnce(release func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			release()
+		})
+	}
+}
+
+// Active returns the number of connections holding a global slot
+func (l *Limiter) Active() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
@@ -0,0 +1,90 @@
+package connlimit
+
+import "testing"
+
+func TestAcquire(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		ips    []string
+		want   []string
+	}{
+		{"unlimited", Limits{}, []string{"a", "a", "b"}, []string{"", "", ""}},
+		{"global", Limits{Global: 2}, []string{"a", "b", "c"}, []string{"", "", ReasonGlobal}},
+		{"per ip", Limits{PerIP: 1}, []string{"a", "b", "a"}, []string{"", "", ReasonPerIP}},
+		{"global first", Limits{Global: 1, PerIP: 1}, []string{"a", "a"}, []string{"", ReasonGlobal}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.limits)
+			for i, ip := range tt.ips {
+				_, err := l.Acquire(ip)
+				reason := ""
+				if err != nil {
+					reason = err.(*LimitError).Reason
+				}
+				if reason != tt.want[i] {
+					t.Errorf("Acquire(%q) #%d rejected for %q, want %q", ip, i, reason, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRelease(t *testing.T) {
+	l := New(Limits{Global: 1, PerIP: 1})
+	release, err := l.Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("a"); err == nil {
+		t.Fatal("second connection accepted over the limit")
+	}
+	release()
+	release()
+	if got := l.Active(); got != 0 {
+		t.Errorf("Active() = %d after release, want 0", got)
+	}
+	if _, err := l.Acquire("a"); err != nil {
+		t.Errorf("connection rejected after release: %v", err)
+	}
+}
+
+func TestAcquireUser(t *testing.T) {
+	l := New(Limits{PerUser: 1})
+	release, err := l.AcquireUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.AcquireUser("alice")
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Reason != ReasonPerUser {
+		t.Errorf("AcquireUser() error = %v, want a per-user limit", err)
+	}
+	if _, err := l.AcquireUser("bob"); err != nil {
+		t.Errorf("other user rejected: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := l.AcquireUser(""); err != nil {
+			t.Errorf("anonymous session rejected: %v", err)
+		}
+	}
+	release()
+	if _, err := l.AcquireUser("alice"); err != nil {
+		t.Errorf("user rejected after release: %v", err)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	release, err := l.Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, err := l.AcquireUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Active(); got != 0 {
+		t.Errorf("Active() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,110 @@
+// Package listenfd opens listening sockets that can be passed to another
+// process. Sockets passed by systemd socket activation or by Upgrade of the
+// previous process are taken by the listeners bound to the same address.
+package listenfd
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+var (
+	inheritOnce sync.Once
+
+	mu sync.Mutex
+	// inherited sockets not taken yet
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	// sockets opened, passed on by Upgrade
+	opened []syscall.Conn
+)
+
+// Listen returns the inherited stream socket bound to addr, or listens on it
+func Listen(network, addr string) (net.Listener, error) {
+	return Listener(addr, func() (net.Listener, error) {
+		return net.Listen(network, addr)
+	})
+}
+
+// ListenPacket returns the inherited datagram socket bound to addr, or
+// listens on it
+func ListenPacket(network, addr string) (net.PacketConn, error) {
+	return PacketConn(addr, func() (net.PacketConn, error) {
+		return net.ListenPacket(network, addr)
+	})
+}
+
+// Listener returns the inherited stream socket bound to addr, or the one
+// listen opens
+func Listener(addr string, listen func() (net.Listener, error)) (net.Listener, error) {
+	inheritOnce.Do(inherit)
+	mu.Lock()
+	defer mu.Unlock()
+	for i, l := range listeners {
+		if sameAddr(l.Addr(), addr) {
+			listeners = append(listeners[:i], listeners[i+1:]...)
+			record(l)
+			return l, nil
+		}
+	}
+	l, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	record(l)
+	return l, nil
+}
+
+// PacketConn returns the inherited datagram socket bound to addr, or the
+// one listen opens
+func PacketConn(addr string, listen func() (net.PacketConn, error)) (net.PacketConn, error) {
+	inheritOnce.Do(inherit)
+	mu.Lock()
+	defer mu.Unlock()
+	for i, conn := range packetConns {
+		if sameAddr(conn.LocalAddr(), addr) {
+			packetConns = append(packetConns[:i], packetConns[i+1:]...)
+			record(conn)
+			return conn, nil
+		}
+	}
+	conn, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	record(conn)
+	return conn, nil
+}
+
+func record(socket interface{}) {
+	if conn, ok := socket.(syscall.Conn); ok {
+		opened = append(opened, conn)
+	}
+}
+
+// sameAddr reports whether a socket bound to got serves addr, the
+// unspecified addresses of both families count as the same
+func sameAddr(got net.Addr, addr string) bool {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return false
+	}
+	var ip net.IP
+	var port int
+	switch got := got.(type) {
+	case *net.TCPAddr:
+		ip, port = got.IP, got.Port
+	case *net.UDPAddr:
+		ip, port = got.IP, got.Port
+	default:
+		return false
+	}
+	if port != want.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return ip == nil || ip.IsUnspecified()
+	}
+	return want.IP.Equal(ip)
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package listenfd
+
+import "errors"
+
+func inherit() {}
+
+// Upgrade starts the executable again with the same arguments and passes
+// it the open sockets. It is not supported on this platform.
+func Upgrade() (int, error) {
+	return 0, errors.New("upgrades are not supported on this platform")
+}
+
+// Ready tells the process that started this one with Upgrade that it may
+// shut down, it does nothing on this platform
+func Ready() {}
@@ -0,0 +1,108 @@
+package listenfd
+
+import (
+	"net"
+	"testing"
+)
+
+// reset forgets the sockets of earlier tests, nothing is inherited in tests
+func reset(t *testing.T) {
+	t.Helper()
+	inheritOnce.Do(func() {})
+	mu.Lock()
+	defer mu.Unlock()
+	listeners, packetConns, opened = nil, nil, nil
+}
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		got  net.Addr
+		addr string
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, "127.0.0.1:1080", true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, "127.0.0.1:1081", false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, "127.0.0.2:1080", false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, ":1080", false},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 1080}, ":1080", true},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 1080}, "0.0.0.0:1080", true},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 1080}, "[::]:1080", true},
+		{&net.TCPAddr{Port: 1080}, ":1080", true},
+		{&net.UDPAddr{IP: net.ParseIP("::1"), Port: 53}, "[::1]:53", true},
+		{&net.UDPAddr{IP: net.ParseIP("::1"), Port: 53}, "127.0.0.1:53", false},
+		{&net.UnixAddr{Name: "/run/socks.sock", Net: "unix"}, ":1080", false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, "invalid", false},
+	}
+	for _, tt := range tests {
+		if got := sameAddr(tt.got, tt.addr); got != tt.want {
+			t.Errorf("sameAddr(%v, %q) = %v, want %v", tt.got, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	reset(t)
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	listeners = []net.Listener{inherited}
+	addr := inherited.Addr().String()
+
+	tests := []struct {
+		name          string
+		addr          string
+		wantInherited bool
+	}{
+		{"other address", "127.0.0.1:0", false},
+		{"inherited", addr, true},
+		// taken once only
+		{"taken", "127.0.0.1:0", false},
+	}
+	for _, tt := range tests {
+		l, err := Listen("tcp", tt.addr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		defer l.Close()
+		if got := l == inherited; got != tt.wantInherited {
+			t.Errorf("%s: inherited listener %v, want %v", tt.name, got, tt.wantInherited)
+		}
+	}
+	if len(listeners) != 0 || len(opened) != len(tests) {
+		t.Errorf("%d listeners left and %d opened, want 0 and %d", len(listeners), len(opened), len(tests))
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	reset(t)
+	inherited, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	packetConns = []net.PacketConn{inherited}
+
+	tests := []struct {
+		name          string
+		addr          string
+		wantInherited bool
+	}{
+		{"other address", "127.0.0.1:0", false},
+		{"inherited", inherited.LocalAddr().String(), true},
+	}
+	for _, tt := range tests {
+		conn, err := ListenPacket("udp", tt.addr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		defer conn.Close()
+		if got := conn == inherited; got != tt.wantInherited {
+			t.Errorf("%s: inherited socket %v, want %v", tt.name, got, tt.wantInherited)
+		}
+	}
+	if len(packetConns) != 0 || len(opened) != len(tests) {
+		t.Errorf("%d sockets left and %d opened, want 0 and %d", len(packetConns), len(opened), len(tests))
+	}
+}
@@ -0,0 +1,189 @@
+//go:build !windows && !plan9
+
+package listenfd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+)
+
+const (
+	// first descriptor of the passed sockets, as systemd passes them
+	firstFD = 3
+	// descriptor the new process reports being ready on
+	readyFDEnv = "SOCKS_UPGRADE_READY_FD"
+	// how long Upgrade waits for the new process to be ready
+	upgradeTimeout = 30 * time.Second
+)
+
+// inherit takes the sockets passed in LISTEN_FDS, unless LISTEN_PID says
+// they are meant for another process
+func inherit() {
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for fd := firstFD; fd < firstFD+n; fd++ {
+		syscall.CloseOnExec(fd)
+		if err := inheritFD(fd); err != nil {
+			logger.Infof("Failed to use inherited socket %d: %s", fd, err)
+		}
+	}
+	logger.Infof("Inherited %d listening sockets, %d stream and %d datagram",
+		len(listeners)+len(packetConns), len(listeners), len(packetConns))
+}
+
+func inheritFD(fd int) error {
+	socketType, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return err
+	}
+	// the net package uses a duplicate of the descriptor
+	f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+	defer f.Close()
+	switch socketType {
+	case syscall.SOCK_STREAM:
+		l, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+	case syscall.SOCK_DGRAM:
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		packetConns = append(packetConns, conn)
+	default:
+		return fmt.Errorf("unsupported socket type %d", socketType)
+	}
+	return nil
+}
+
+// dup duplicates the descriptor of a socket. Unlike File it keeps the
+// socket non-blocking, which its Close relies on to interrupt Accept.
+func dup(socket syscall.Conn) (int, error) {
+	raw, err := socket.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd int
+	var dupErr error
+	err = raw.Control(func(s uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, dupErr = syscall.Dup(int(s)); dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fd, dupErr
+}
+
+// Upgrade starts the executable again with the same arguments and passes
+// it the open sockets. It returns the pid of the new process once that is
+// ready to serve, this process is then meant to shut down.
+func Upgrade() (int, error) {
+	mu.Lock()
+	var fds []uintptr
+	for _, socket := range opened {
+		// closed sockets fail and are left out
+		if fd, err := dup(socket); err == nil {
+			fds = append(fds, uintptr(fd))
+		}
+	}
+	mu.Unlock()
+	defer func() {
+		for _, fd := range fds {
+			syscall.Close(int(fd))
+		}
+	}()
+	if len(fds) == 0 {
+		return 0, errors.New("no sockets to pass")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	var env []string
+	for _, value := range os.Environ() {
+		if !strings.HasPrefix(value, "LISTEN_") && !strings.HasPrefix(value, readyFDEnv+"=") {
+			env = append(env, value)
+		}
+	}
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(fds)),
+		readyFDEnv+"="+strconv.Itoa(firstFD+len(fds)))
+	// os/exec would put the sockets in blocking mode
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	files = append(append(files, fds...), readyW.Fd())
+	pid, err := syscall.ForkExec(executable, os.Args, &syscall.ProcAttr{Env: env, Files: files})
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	// Ready writes a byte, the pipe is closed without one if the process exits
+	readyc := make(chan bool, 1)
+	go func() {
+		n, _ := ready.Read(make([]byte, 1))
+		readyc <- n == 1
+	}()
+	select {
+	case ok := <-readyc:
+		if !ok {
+			process.Wait()
+			return 0, errors.New("new process exited before it was ready")
+		}
+	case <-time.After(upgradeTimeout):
+		process.Kill()
+		process.Wait()
+		return 0, fmt.Errorf("new process was not ready within %s", upgradeTimeout)
+	}
+	// reap it should it exit while this process drains
+	go process.Wait()
+	return pid, nil
+}
+
+// Ready tells the process that started this one with Upgrade that it may
+// shut down, it does nothing otherwise
+func Ready() {
+	value := os.Getenv(readyFDEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	f.Write([]byte{1})
+}
@@ -0,0 +1,116 @@
+//go:build !windows && !plan9
+
+package listenfd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInheritFD(t *testing.T) {
+	reset(t)
+	tests := []struct {
+		name   string
+		listen func() (syscall.Conn, error)
+	}{
+		{"stream", func() (syscall.Conn, error) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			return l.(*net.TCPListener), nil
+		}},
+		{"datagram", func() (syscall.Conn, error) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			return conn.(*net.UDPConn), nil
+		}},
+	}
+	for _, tt := range tests {
+		socket, err := tt.listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer socket.(interface{ Close() error }).Close()
+		// as a previous process passes it
+		fd, err := dup(socket)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := inheritFD(fd); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+	}
+	if len(listeners) != 1 || len(packetConns) != 1 {
+		t.Fatalf("inherited %d stream and %d datagram sockets, want 1 and 1", len(listeners), len(packetConns))
+	}
+	defer listeners[0].Close()
+	defer packetConns[0].Close()
+
+	// the inherited listener accepts connections to the original address
+	conn, err := net.Dial("tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listeners[0].(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	accepted, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	f, err := os.CreateTemp(t.TempDir(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := inheritFD(int(f.Fd())); err == nil {
+		t.Error("inherited a regular file")
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name string
+		// value of the environment variable, unset if empty
+		value     func(w *os.File) string
+		wantReady bool
+	}{
+		{"started by Upgrade", func(w *os.File) string {
+			// Ready takes over the descriptor
+			fd, err := syscall.Dup(int(w.Fd()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strconv.Itoa(fd)
+		}, true},
+		{"started otherwise", func(*os.File) string { return "" }, false},
+		{"invalid descriptor", func(*os.File) string { return "x" }, false},
+	}
+	for _, tt := range tests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := tt.value(w); value != "" {
+			os.Setenv(readyFDEnv, value)
+		}
+		Ready()
+		w.Close()
+		if _, ok := os.LookupEnv(readyFDEnv); ok {
+			t.Errorf("%s: %s still set", tt.name, readyFDEnv)
+		}
+		n, _ := r.Read(make([]byte, 1))
+		r.Close()
+		if ready := n == 1; ready != tt.wantReady {
+			t.Errorf("%s: ready %v, want %v", tt.name, ready, tt.wantReady)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Command names used in rules
+const (
+	CmdConnect      = "connect"
+	CmdBind         = "bind"
+	CmdUDPAssociate = "udpAssociate"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Rule matches a request when every non-empty field matches.
+// An empty field matches anything.
+type Rule struct {
+	// Usernames the rule applies to
+	Users []string `json:"users"`
+	// Group names the rule applies to, see Policy.Groups
+	Groups []string `json:"groups"`
+	// Commands: connect, bind, udpAssociate
+	Commands []string `json:"commands"`
+	// Destinations: "example.com", "*.internal", "10.0.0.1", "10.0.0.0/8" or "*"
+	Hosts []string `json:"hosts"`
+	// Ports: "443" or ranges like "8000-8999"
+	Ports []string `json:"ports"`
+	// Session attributes that must have the given values, like token claims
+	Attributes map[string]string `json:"attributes"`
+	// Attribute listing the destinations the session may reach, as a JSON
+	// array or comma separated list of Hosts patterns. A session without
+	// the attribute does not match.
+	HostsFrom string `json:"hostsFrom"`
+	// allow or deny
+	Action string `json:"action"`
+
+	// parsed Hosts
+	hosts []hostPattern
+}
+
+// Policy is an ordered list of rules, the first matching rule wins.
+// Requests matching no rule get the Default action (allow if empty).
+type Policy struct {
+	Groups  map[string][]string `json:"groups"`
+	Rules   []Rule              `json:"rules"`
+	Default string              `json:"default"`
+
+	// username -> groups, built from Groups
+	memberOf map[string][]string
+}
+
+// Request is what a rule is evaluated against
+type Request struct {
+	User string
+	// Session attributes, like the claims of a token
+	Attributes map[string]string
+	Command    string
+	// Host as requested by the client, domain name or IP
+	Host string
+	// IP the host was resolved to, may be nil
+	IP   net.IP
+	Port uint16
+}
+
+// Load reads a JSON policy file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", path, err)
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Policy) init() error {
+	if err := checkAction(p.Default, true); err != nil {
+		return err
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if err := checkAction(r.Action, false); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+		hosts, err := parseHostPatterns(r.Hosts)
+		if err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+		r.hosts = hosts
+		for _, port := range r.Ports {
+			if _, _, err := parsePortRange(port); err != nil {
+				return fmt.Errorf("rule %d: %v", i, err)
+			}
+		}
+		for _, cmd := range r.Commands {
+			if cmd != CmdConnect && cmd != CmdBind && cmd != CmdUDPAssociate {
+				return fmt.Errorf("rule %d: unknown command %q", i, cmd)
+			}
+		}
+	}
+	p.memberOf = make(map[string][]string)
+	for group, users := range p.Groups {
+		for _, user := range users {
+			p.memberOf[user] = append(p.memberOf[user], group)
+		}
+	}
+	return nil
+}
+
+func checkAction(action string, allowEmpty bool) error {
+	switch action {
+	case ActionAllow, ActionDeny:
+		return nil
+	case "":
+		if allowEmpty {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid action %q", action)
+}
+
+// Allowed reports whether the request is permitted. A nil policy allows everything.
+func (p *Policy) Allowed(req Request) bool {
+	if p == nil {
+		return true
+	}
+	for _, r := range p.Rules {
+		if p.matches(&r, &req) {
+			return r.Action == ActionAllow
+		}
+	}
+	return p.Default != ActionDeny
+}
+
+// DeniesName reports whether the request is denied whatever addresses its
+// host resolves to, so that a denied name is not looked up at all. Rules
+// that depend on the address are only known to match once it is resolved.
+// A nil policy denies nothing.
+func (p *Policy) DeniesName(req Request) bool {
+	return p.denies(&req, func(patterns []hostPattern) match {
+		return matchHostsName(patterns, req.Host)
+	})
+}
+
+// DeniesAddress reports whether the request to the address req.IP is denied
+// whatever host name it turns out to be for, so that a request whose name
+// is only learned later is refused up front. Rules on names are only known
+// to match once the name is. A nil policy denies nothing.
+func (p *Policy) DeniesAddress(req Request) bool {
+	return p.denies(&req, func(patterns []hostPattern) match {
+		return matchHostsAddress(patterns, req.IP)
+	})
+}
+
+// denies goes through the rules knowing part of the destination, hosts
+// tells whether a list of host patterns matches it
+func (p *Policy) denies(req *Request, hosts func(patterns []hostPattern) match) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Rules {
+		switch p.matchesPartly(&r, req, hosts) {
+		case mustMatch:
+			return r.Action == ActionDeny
+		case mayMatch:
+			// the rest of the destination may get this rule to allow the request
+			if r.Action == ActionAllow {
+				return false
+			}
+		}
+	}
+	return p.Default == ActionDeny
+}
+
+// match tells whether a rule applies to a request whose destination is
+// partly unknown
+type match int
+
+const (
+	noMatch match = iota
+	mayMatch
+	mustMatch
+)
+
+func (p *Policy) matchesPartly(r *Rule, req *Request, hosts func(patterns []hostPattern) match) match {
+	if !p.matches(&Rule{Users: r.Users, Groups: r.Groups, Commands: r.Commands, Ports: r.Ports, Attributes: r.Attributes}, req) {
+		return noMatch
+	}
+	result := mustMatch
+	if len(r.hosts) > 0 {
+		result = hosts(r.hosts)
+	}
+	if r.HostsFrom != "" && result != noMatch {
+		value, ok := req.Attributes[r.HostsFrom]
+		if !ok {
+			return noMatch
+		}
+		if m := hosts(attributeHosts(value)); m < result {
+			result = m
+		}
+	}
+	return result
+}
+
+func matchHostsName(patterns []hostPattern, host string) match {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		if matchHosts(patterns, host, ip) {
+			return mustMatch
+		}
+		return noMatch
+	}
+	result := noMatch
+	for _, pattern := range patterns {
+		if pattern.match(host, nil) {
+			return mustMatch
+		}
+		// address patterns are decided by what the name resolves to
+		if pattern.isAddress() {
+			result = mayMatch
+		}
+	}
+	return result
+}
+
+func matchHostsAddress(patterns []hostPattern, ip net.IP) match {
+	result := noMatch
+	for _, pattern := range patterns {
+		if pattern.name == "*" || pattern.isAddress() {
+			if pattern.match("", ip) {
+				return mustMatch
+			}
+			continue
+		}
+		// name patterns are decided by the name
+		result = mayMatch
+	}
+	return result
+}
+
+func (p *Policy) matches(r *Rule, req *Request) bool {
+	if len(r.Users) > 0 || len(r.Groups) > 0 {
+		if !contains(r.Users, req.User) && !containsAny(r.Groups, p.memberOf[req.User]) {
+			return false
+		}
+	}
+	if len(r.Commands) > 0 && !contains(r.Commands, req.Command) {
+		return false
+	}
+	if len(r.hosts) > 0 && !matchHosts(r.hosts, req.Host, req.IP) {
+		return false
+	}
+	if len(r.Ports) > 0 && !matchPorts(r.Ports, req.Port) {
+		return false
+	}
+	for name, value := range r.Attributes {
+		if req.Attributes[name] != value {
+			return false
+		}
+	}
+	if r.HostsFrom != "" {
+		value, ok := req.Attributes[r.HostsFrom]
+		if !ok || !matchHosts(attributeHosts(value), req.Host, req.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseList reads an attribute holding a JSON array or a comma separated list
+func parseList(value string) []string {
+	var list []string
+	if err := json.Unmarshal([]byte(value), &list); err == nil {
+		return list
+	}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list []string, values []string) bool {
+	for _, v := range values {
+		if contains(list, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHosts(patterns []hostPattern, host string, ip net.IP) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+	for _, pattern := range patterns {
+		if pattern.match(host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPattern is a parsed Hosts pattern, one of its fields is set
+type hostPattern struct {
+	// lowercase name, "*.suffix" or "*"
+	name    string
+	ip      net.IP
+	network *net.IPNet
+}
+
+func parseHostPattern(pattern string) (hostPattern, error) {
+	if strings.Contains(pattern, "/") {
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return hostPattern{}, fmt.Errorf("invalid host CIDR %q", pattern)
+		}
+		return hostPattern{network: network}, nil
+	}
+	if ip := net.ParseIP(pattern); ip != nil {
+		return hostPattern{ip: ip}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if name == "" || name != "*" && strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return hostPattern{}, fmt.Errorf("invalid host pattern %q", pattern)
+	}
+	return hostPattern{name: name}, nil
+}
+
+func parseHostPatterns(patterns []string) ([]hostPattern, error) {
+	parsed := make([]hostPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		h, err := parseHostPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, h)
+	}
+	return parsed, nil
+}
+
+// attributeHosts parses the patterns of a HostsFrom attribute, malformed
+// ones are left out and match nothing
+func attributeHosts(value string) []hostPattern {
+	var parsed []hostPattern
+	for _, pattern := range parseList(value) {
+		if h, err := parseHostPattern(pattern); err == nil {
+			parsed = append(parsed, h)
+		}
+	}
+	return parsed
+}
+
+func (h hostPattern) isAddress() bool {
+	return h.ip != nil || h.network != nil
+}
+
+// match reports whether host (or the IP it resolved to) matches
+func (h hostPattern) match(host string, ip net.IP) bool {
+	switch {
+	case h.network != nil:
+		return ip != nil && h.network.Contains(ip)
+	case h.ip != nil:
+		return ip != nil && h.ip.Equal(ip)
+	case h.name == "*":
+		return true
+	case strings.HasPrefix(h.name, "*."):
+		return strings.HasSuffix(host, h.name[1:])
+	}
+	return host == h.name
+}
+
+func matchPorts(ranges []string, port uint16) bool {
+	for _, r := range ranges {
+		low, high, err := parsePortRange(r)
+		if err == nil && port >= low && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePortRange(s string) (uint16, uint16, error) {
+	lowStr, highStr, found := strings.Cut(s, "-")
+	low, err := strconv.ParseUint(lowStr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	if !found {
+		return uint16(low), uint16(low), nil
+	}
+	high, err := strconv.ParseUint(highStr, 10, 16)
+	if err != nil || high < low {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(low), uint16(high), nil
+}
@@ -0,0 +1,286 @@
+package policy
+
+import (
+	"net"
+	"testing"
+)
+
+func newPolicy(t *testing.T, p *Policy) *Policy {
+	t.Helper()
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAllowed(t *testing.T) {
+	p := newPolicy(t, &Policy{
+		Groups: map[string][]string{"admins": {"alice"}},
+		Rules: []Rule{
+			{Groups: []string{"admins"}, Action: ActionAllow},
+			{Hosts: []string{"10.0.0.0/8"}, Action: ActionDeny},
+			{Hosts: []string{"*.example.com"}, Ports: []string{"443", "8000-8999"}, Action: ActionAllow},
+			{Users: []string{"bob"}, Commands: []string{CmdUDPAssociate}, Action: ActionAllow},
+			{Attributes: map[string]string{"role": "ops"}, Action: ActionAllow},
+			{HostsFrom: "hosts", Action: ActionAllow},
+		},
+		Default: ActionDeny,
+	})
+
+	tests := []struct {
+		name string
+		req  Request
+		want bool
+	}{
+		{"group member", Request{User: "alice", Command: CmdConnect, Host: "10.1.1.1", Port: 22}, true},
+		{"denied network", Request{User: "bob", Command: CmdConnect, Host: "intranet", IP: net.ParseIP("10.2.3.4"), Port: 443}, false},
+		{"wildcard host and port", Request{User: "bob", Command: CmdConnect, Host: "www.example.com", Port: 443}, true},
+		{"port range", Request{User: "bob", Command: CmdConnect, Host: "www.example.com", Port: 8080}, true},
+		{"port outside ranges", Request{User: "bob", Command: CmdConnect, Host: "www.example.com", Port: 80}, false},
+		{"wildcard does not match apex", Request{User: "bob", Command: CmdConnect, Host: "example.com", Port: 443}, false},
+		{"trailing dot and case", Request{User: "bob", Command: CmdConnect, Host: "WWW.Example.com.", Port: 443}, true},
+		{"command", Request{User: "bob", Command: CmdUDPAssociate, Host: "0.0.0.0"}, true},
+		{"attribute", Request{User: "carol", Attributes: map[string]string{"role": "ops"}, Command: CmdConnect, Host: "a.org", Port: 80}, true},
+		{"hosts from attribute", Request{User: "carol", Attributes: map[string]string{"hosts": `["a.org"]`}, Command: CmdConnect, Host: "a.org", Port: 80}, true},
+		{"hosts from list attribute", Request{User: "carol", Attributes: map[string]string{"hosts": "b.org, a.org"}, Command: CmdConnect, Host: "a.org", Port: 80}, true},
+		{"default", Request{User: "carol", Command: CmdConnect, Host: "a.org", Port: 80}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Allowed(tt.req); got != tt.want {
+				t.Errorf("Allowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	if !p.Allowed(Request{Host: "example.com"}) {
+		t.Error("nil policy denied a request")
+	}
+	if p.DeniesName(Request{Host: "example.com"}) {
+		t.Error("nil policy denied a name")
+	}
+	if p.DeniesAddress(Request{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("nil policy denied an address")
+	}
+}
+
+func TestDeniesName(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+		host   string
+		want   bool
+	}{
+		{
+			name:   "denied name",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"*.ads.test"}, Action: ActionDeny}}},
+			host:   "x.ads.test",
+			want:   true,
+		},
+		{
+			name:   "allowed name",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"*.ads.test"}, Action: ActionDeny}}},
+			host:   "example.com",
+			want:   false,
+		},
+		{
+			name:   "default deny",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"example.com"}, Action: ActionAllow}}, Default: ActionDeny},
+			host:   "other.com",
+			want:   true,
+		},
+		{
+			name: "address rule may allow",
+			policy: &Policy{
+				Rules:   []Rule{{Hosts: []string{"192.0.2.0/24"}, Action: ActionAllow}},
+				Default: ActionDeny,
+			},
+			host: "other.com",
+			want: false,
+		},
+		{
+			name: "address rule may deny",
+			policy: &Policy{
+				Rules: []Rule{
+					{Hosts: []string{"192.0.2.0/24"}, Action: ActionDeny},
+					{Hosts: []string{"other.com"}, Action: ActionDeny},
+				},
+			},
+			host: "other.com",
+			want: true,
+		},
+		{
+			name: "address rule may deny before allowed name",
+			policy: &Policy{
+				Rules: []Rule{
+					{Hosts: []string{"192.0.2.1"}, Action: ActionDeny},
+					{Hosts: []string{"other.com"}, Action: ActionAllow},
+				},
+				Default: ActionDeny,
+			},
+			host: "other.com",
+			want: false,
+		},
+		{
+			name: "rule for another user",
+			policy: &Policy{
+				Rules:   []Rule{{Users: []string{"bob"}, Hosts: []string{"*"}, Action: ActionAllow}},
+				Default: ActionDeny,
+			},
+			host: "other.com",
+			want: true,
+		},
+		{
+			name:   "address host",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"10.0.0.0/8"}, Action: ActionDeny}}},
+			host:   "10.1.2.3",
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPolicy(t, tt.policy)
+			req := Request{User: "alice", Command: CmdConnect, Host: tt.host, Port: 443}
+			if got := p.DeniesName(req); got != tt.want {
+				t.Errorf("DeniesName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeniesAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+		ip     string
+		want   bool
+	}{
+		{
+			name:   "denied network",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"10.0.0.0/8"}, Action: ActionDeny}}},
+			ip:     "10.1.2.3",
+			want:   true,
+		},
+		{
+			name:   "other network",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"10.0.0.0/8"}, Action: ActionDeny}}},
+			ip:     "192.0.2.1",
+			want:   false,
+		},
+		{
+			name:   "name rule may allow",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"example.com"}, Action: ActionAllow}}, Default: ActionDeny},
+			ip:     "192.0.2.1",
+			want:   false,
+		},
+		{
+			name: "name rule may deny before allowed address",
+			policy: &Policy{
+				Rules: []Rule{
+					{Hosts: []string{"*.ads.test"}, Action: ActionDeny},
+					{Hosts: []string{"192.0.2.1"}, Action: ActionAllow},
+				},
+				Default: ActionDeny,
+			},
+			ip:   "192.0.2.1",
+			want: false,
+		},
+		{
+			name: "denied address before allowed name",
+			policy: &Policy{
+				Rules: []Rule{
+					{Hosts: []string{"192.0.2.1"}, Action: ActionDeny},
+					{Hosts: []string{"example.com"}, Action: ActionAllow},
+				},
+			},
+			ip:   "192.0.2.1",
+			want: true,
+		},
+		{
+			name:   "default deny",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"198.51.100.0/24"}, Action: ActionAllow}}, Default: ActionDeny},
+			ip:     "192.0.2.1",
+			want:   true,
+		},
+		{
+			name:   "any host",
+			policy: &Policy{Rules: []Rule{{Hosts: []string{"*"}, Action: ActionDeny}}},
+			ip:     "192.0.2.1",
+			want:   true,
+		},
+		{
+			name: "hosts from attribute",
+			policy: &Policy{
+				Rules:   []Rule{{HostsFrom: "hosts", Action: ActionAllow}},
+				Default: ActionDeny,
+			},
+			ip:   "192.0.2.1",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPolicy(t, tt.policy)
+			req := Request{User: "alice", Attributes: map[string]string{"hosts": "example.com"}, Command: CmdConnect, Host: tt.ip, IP: net.ParseIP(tt.ip), Port: 443}
+			if got := p.DeniesAddress(req); got != tt.want {
+				t.Errorf("DeniesAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"action", Rule{Action: "maybe"}},
+		{"port", Rule{Ports: []string{"http"}, Action: ActionAllow}},
+		{"port range", Rule{Ports: []string{"90-80"}, Action: ActionAllow}},
+		{"command", Rule{Commands: []string{"listen"}, Action: ActionAllow}},
+		{"host cidr", Rule{Hosts: []string{"10.0.0.0/33"}, Action: ActionDeny}},
+		{"host wildcard", Rule{Hosts: []string{"ads.*.test"}, Action: ActionDeny}},
+		{"empty host", Rule{Hosts: []string{""}, Action: ActionDeny}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Policy{Rules: []Rule{tt.rule}}
+			if err := p.init(); err == nil {
+				t.Error("invalid rule accepted")
+			}
+		})
+	}
+}
+
+func TestHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		ip      string
+		want    bool
+	}{
+		{"*", "example.com", "", true},
+		{"example.com", "example.com", "", true},
+		{"Example.COM.", "example.com", "", true},
+		{"example.com", "www.example.com", "", false},
+		{"*.example.com", "www.example.com", "", true},
+		{"*.example.com", "example.com", "", false},
+		{"10.0.0.1", "", "10.0.0.1", true},
+		{"10.0.0.1", "10.0.0.1", "", false},
+		{"10.0.0.0/8", "", "10.1.2.3", true},
+		{"10.0.0.0/8", "", "192.0.2.1", false},
+		{"2001:db8::/32", "", "2001:db8::1", true},
+	}
+	for _, tt := range tests {
+		h, err := parseHostPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("parseHostPattern(%q): %v", tt.pattern, err)
+		}
+		if got := h.match(tt.host, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%q matches %q %s: %v, want %v", tt.pattern, tt.host, tt.ip, got, tt.want)
+		}
+	}
+}
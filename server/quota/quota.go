@@ -0,0 +1,353 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+)
+
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+	PeriodRolling = "rolling"
+)
+
+// hourly slots older than this are dropped unless a rolling window needs them
+const minRetention = 32 * 24 * time.Hour
+
+// Quota limits the traffic of a user over a period
+type Quota struct {
+	// daily, monthly (calendar, local time) or rolling
+	Period string `json:"period"`
+	// Length of a rolling period, like "24h" or "720h"
+	Window string `json:"window"`
+	// Allowed bytes, uploads and downloads combined
+	Bytes int64 `json:"bytes"`
+
+	window time.Duration
+}
+
+func (q *Quota) init() error {
+	switch q.Period {
+	case PeriodDaily, PeriodMonthly:
+	case PeriodRolling:
+		window, err := time.ParseDuration(q.Window)
+		if err != nil || window <= 0 {
+			return fmt.Errorf("invalid rolling window %q", q.Window)
+		}
+		q.window = window
+	default:
+		return fmt.Errorf("invalid period %q", q.Period)
+	}
+	if q.Bytes <= 0 {
+		return fmt.Errorf("quota bytes must be positive")
+	}
+	return nil
+}
+
+// PeriodStart returns when the period containing now began
+func (q *Quota) PeriodStart(now time.Time) time.Time {
+	switch q.Period {
+	case PeriodDaily:
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	case PeriodMonthly:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+	return now.Add(-q.window)
+}
+
+// Config is read from the file named by SOCKS_QUOTA_FILE
+type Config struct {
+	// BoltDB file the counters are persisted to
+	Store string `json:"store"`
+	// Close the open sessions of a user once the quota is exhausted
+	CutActive bool `json:"cutActive"`
+	// Quota for users not listed in Users, none if omitted
+	Default *Quota            `json:"default"`
+	Users   map[string]*Quota `json:"users"`
+}
+
+// Load reads and validates a JSON quota config
+func Load(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid quota file %s: %v", path, err)
+	}
+	if config.Store == "" {
+		return config, fmt.Errorf("quota file %s: store is required", path)
+	}
+	if config.Default != nil {
+		if err := config.Default.init(); err != nil {
+			return config, fmt.Errorf("default quota: %v", err)
+		}
+	}
+	for user, q := range config.Users {
+		if err := q.init(); err != nil {
+			return config, fmt.Errorf("quota of %s: %v", user, err)
+		}
+	}
+	return config, nil
+}
+
+// QuotaOf returns the quota that applies to user, nil if unlimited.
+// Anonymous sessions are not accounted.
+func (c *Config) QuotaOf(user string) *Quota {
+	if user == "" {
+		return nil
+	}
+	if q, ok := c.Users[user]; ok {
+		return q
+	}
+	return c.Default
+}
+
+func (c *Config) retention() time.Duration {
+	retention := minRetention
+	for _, q := range c.Users {
+		if q.window > retention {
+			retention = q.window
+		}
+	}
+	if c.Default != nil && c.Default.window > retention {
+		retention = c.Default.window
+	}
+	return retention
+}
+
+// Tracker counts relayed bytes per user and enforces the quotas.
+// Sessions count their own bytes, Flush folds them into the per user
+// counts and merges those into the store. Quotas are therefore enforced
+// with the delay of the flush interval.
+type Tracker struct {
+	mu       sync.Mutex
+	config   Config
+	usage    map[string]*Usage
+	pending  map[string]*Usage
+	used     map[string]int64
+	sessions map[string]map[*Session]struct{}
+}
+
+// New loads the current counters from the store
+func New(config Config) (*Tracker, error) {
+	t := &Tracker{
+		config:   config,
+		usage:    make(map[string]*Usage),
+		pending:  make(map[string]*Usage),
+		used:     make(map[string]int64),
+		sessions: make(map[string]map[*Session]struct{}),
+	}
+	if err := t.Flush(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Flush merges the counts gathered since the last flush into the store and
+// reloads it, which also picks up counters reset by the quota admin command
+func (t *Tracker) Flush() error {
+	t.mu.Lock()
+	cut := t.collect()
+	pending := t.pending
+	t.pending = make(map[string]*Usage)
+	t.mu.Unlock()
+	closeExhausted(cut)
+
+	now := time.Now()
+	usage, err := mergeUsage(t.config.Store, pending, now.Add(-t.config.retention()))
+	if err != nil {
+		// keep the counts for the next attempt
+		t.mu.Lock()
+		for user, u := range pending {
+			t.pendingOf(user).add(u)
+		}
+		t.mu.Unlock()
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// counts that arrived while the store was being written
+	for user, u := range t.pending {
+		usageOf(usage, user).add(u)
+	}
+	t.usage = usage
+	t.used = make(map[string]int64)
+	for user, u := range usage {
+		if q := t.config.QuotaOf(user); q != nil {
+			t.used[user] = u.Since(q.PeriodStart(now))
+		}
+	}
+	return nil
+}
+
+// FlushEvery flushes periodically, it does not return
+func (t *Tracker) FlushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := t.Flush(); err != nil {
+			logger.Infof("Failed to flush traffic counters: %s", err)
+		}
+	}
+}
+
+// Exceeded reports whether user has used up the quota. A nil Tracker never limits.
+func (t *Tracker) Exceeded(user string) bool {
+	if t == nil {
+		return false
+	}
+	q := t.config.QuotaOf(user)
+	if q == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.used[user] >= q.Bytes
+}
+
+// Open starts counting the traffic of one connection of user.
+// conn is closed if the quota runs out and CutActive is set.
+func (t *Tracker) Open(user string, conn io.Closer) *Session {
+	if t == nil || user == "" {
+		return nil
+	}
+	s := &Session{tracker: t, user: user, conn: conn}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions[user] == nil {
+		t.sessions[user] = make(map[*Session]struct{})
+	}
+	t.sessions[user][s] = struct{}{}
+	return s
+}
+
+// collect folds the counts of the open sessions in and returns the
+// connections of users whose quota ran out, if CutActive is set.
+// t.mu must be held.
+func (t *Tracker) collect() map[string][]io.Closer {
+	hour := time.Now().Unix() / 3600
+	cut := make(map[string][]io.Closer)
+	for user, sessions := range t.sessions {
+		for s := range sessions {
+			t.fold(s, hour)
+		}
+		if q := t.config.QuotaOf(user); t.config.CutActive && q != nil && t.used[user] >= q.Bytes {
+			for s := range sessions {
+				cut[user] = append(cut[user], s.conn)
+			}
+		}
+	}
+	return cut
+}
+
+// fold moves the bytes counted by s since the last fold to the counts of
+// its user, t.mu must be held
+func (t *Tracker) fold(s *Session, hour int64) {
+	up := atomic.SwapInt64(&s.upload, 0)
+	down := atomic.SwapInt64(&s.download, 0)
+	if up == 0 && down == 0 {
+		return
+	}
+	delta := &Usage{Upload: up, Download: down, Hours: map[int64]int64{hour: up + down}}
+	t.pendingOf(s.user).add(delta)
+	usageOf(t.usage, s.user).add(delta)
+	t.used[s.user] += up + down
+}
+
+func closeExhausted(cut map[string][]io.Closer) {
+	for user, conns := range cut {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		logger.Infof("Traffic quota of user %q is exhausted, closed %d sessions", user, len(conns))
+	}
+}
+
+func (t *Tracker) pendingOf(user string) *Usage {
+	return usageOf(t.pending, user)
+}
+
+func usageOf(m map[string]*Usage, user string) *Usage {
+	u, ok := m[user]
+	if !ok {
+		u = &Usage{Hours: make(map[int64]int64)}
+		m[user] = u
+	}
+	return u
+}
+
+// Session counts the traffic of one connection
+type Session struct {
+	// bytes not folded into the tracker yet, first in the struct so the
+	// atomic operations are 64-bit aligned on 32-bit platforms too
+	upload   int64
+	download int64
+
+	tracker *Tracker
+	user    string
+	conn    io.Closer
+}
+
+// Close stops tracking the connection
+func (s *Session) Close() {
+	if s == nil {
+		return
+	}
+	t := s.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fold(s, time.Now().Unix()/3600)
+	delete(t.sessions[s.user], s)
+	if len(t.sessions[s.user]) == 0 {
+		delete(t.sessions, s.user)
+	}
+}
+
+// AddUpload counts n bytes sent to the destination
+func (s *Session) AddUpload(n int) {
+	if s != nil && n > 0 {
+		atomic.AddInt64(&s.upload, int64(n))
+	}
+}
+
+// AddDownload counts n bytes sent to the client
+func (s *Session) AddDownload(n int) {
+	if s != nil && n > 0 {
+		atomic.AddInt64(&s.download, int64(n))
+	}
+}
+
+// Upload wraps a reader of client data
+func (s *Session) Upload(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &counter{r: r, add: s.AddUpload}
+}
+
+// Download wraps a reader of destination data
+func (s *Session) Download(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &counter{r: r, add: s.AddDownload}
+}
+
+type counter struct {
+	r   io.Reader
+	add func(n int)
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.add(n)
+	return n, err
+}
@@ -0,0 +1,163 @@
+package quota
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type closer struct {
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func newTracker(t *testing.T, config Config) *Tracker {
+	t.Helper()
+	config.Store = filepath.Join(t.TempDir(), "quota.db")
+	for _, q := range config.Users {
+		if err := q.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracker
+}
+
+func TestQuotaInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		quota   Quota
+		wantErr bool
+	}{
+		{"daily", Quota{Period: PeriodDaily, Bytes: 1}, false},
+		{"monthly", Quota{Period: PeriodMonthly, Bytes: 1}, false},
+		{"rolling", Quota{Period: PeriodRolling, Window: "24h", Bytes: 1}, false},
+		{"rolling without window", Quota{Period: PeriodRolling, Bytes: 1}, true},
+		{"unknown period", Quota{Period: "weekly", Bytes: 1}, true},
+		{"no bytes", Quota{Period: PeriodDaily}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.quota.init(); (err != nil) != tt.wantErr {
+				t.Errorf("init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	now := time.Date(2024, 3, 15, 13, 45, 0, 0, time.UTC)
+	tests := []struct {
+		quota Quota
+		want  time.Time
+	}{
+		{Quota{Period: PeriodDaily}, time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{Quota{Period: PeriodMonthly}, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Quota{Period: PeriodRolling, window: 2 * time.Hour}, now.Add(-2 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.quota.Period, func(t *testing.T) {
+			if got := tt.quota.PeriodStart(now); !got.Equal(tt.want) {
+				t.Errorf("PeriodStart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsageSince(t *testing.T) {
+	start := time.Unix(10*3600+1800, 0)
+	u := &Usage{Hours: map[int64]int64{9: 1, 10: 2, 11: 4}}
+	if got := u.Since(start); got != 6 {
+		t.Errorf("Since() = %d, want 6", got)
+	}
+}
+
+func TestTrackerEnforcesQuota(t *testing.T) {
+	tracker := newTracker(t, Config{
+		CutActive: true,
+		Users:     map[string]*Quota{"alice": {Period: PeriodDaily, Bytes: 100}},
+	})
+	conn := &closer{}
+	s := tracker.Open("alice", conn)
+	if tracker.Open("", conn) != nil {
+		t.Error("anonymous session is accounted")
+	}
+
+	if _, err := io.Copy(io.Discard, s.Upload(bytes.NewReader(make([]byte, 60)))); err != nil {
+		t.Fatal(err)
+	}
+	s.AddDownload(50)
+	if tracker.Exceeded("alice") {
+		t.Error("quota exceeded before the counts were folded in")
+	}
+	if err := tracker.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !tracker.Exceeded("alice") {
+		t.Error("quota not exceeded after 110 of 100 bytes")
+	}
+	if !conn.closed {
+		t.Error("session of an exhausted quota left open")
+	}
+	if tracker.Exceeded("bob") {
+		t.Error("user without a quota exceeded it")
+	}
+	s.Close()
+}
+
+func TestTrackerPersists(t *testing.T) {
+	tracker := newTracker(t, Config{
+		Users: map[string]*Quota{"alice": {Period: PeriodDaily, Bytes: 1000}},
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := tracker.Open("alice", &closer{})
+			defer s.Close()
+			for j := 0; j < 100; j++ {
+				s.AddUpload(1)
+				s.AddDownload(2)
+			}
+		}()
+	}
+	wg.Wait()
+	// closed sessions fold their counts in
+	if err := tracker.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := ReadUsage(tracker.config.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := usage["alice"]
+	if alice == nil || alice.Upload != 400 || alice.Download != 800 {
+		t.Fatalf("stored usage = %+v, want 400 up and 800 down", alice)
+	}
+	if !tracker.Exceeded("alice") {
+		t.Error("quota not exceeded after 1200 of 1000 bytes")
+	}
+
+	if err := ResetUsage(tracker.config.Store, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if tracker.Exceeded("alice") {
+		t.Error("quota still exceeded after a reset")
+	}
+}
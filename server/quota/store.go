@@ -0,0 +1,141 @@
+package quota
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var usageBucket = []byte("usage")
+
+// the store is only held open while reading or writing so the admin
+// command can use it next to a running server
+const storeLockTimeout = 5 * time.Second
+
+// Usage is the persisted traffic record of a user
+type Usage struct {
+	// Lifetime totals
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	// Bytes per hour, keyed by unix time / 3600
+	Hours map[int64]int64 `json:"hours"`
+}
+
+func (u *Usage) add(other *Usage) {
+	u.Upload += other.Upload
+	u.Download += other.Download
+	for hour, n := range other.Hours {
+		u.Hours[hour] += n
+	}
+}
+
+// Since returns the bytes counted from the hour containing start on
+func (u *Usage) Since(start time.Time) int64 {
+	first := start.Unix() / 3600
+	var total int64
+	for hour, n := range u.Hours {
+		if hour >= first {
+			total += n
+		}
+	}
+	return total
+}
+
+func openStore(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: storeLockTimeout})
+}
+
+// mergeUsage adds pending to the stored records, drops hourly slots before
+// oldest and returns the updated records of every user
+func mergeUsage(path string, pending map[string]*Usage, oldest time.Time) (map[string]*Usage, error) {
+	db, err := openStore(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	usage := make(map[string]*Usage)
+	oldestHour := oldest.Unix() / 3600
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		for user, u := range pending {
+			stored, err := decodeUsage(bucket.Get([]byte(user)))
+			if err != nil {
+				return err
+			}
+			stored.add(u)
+			for hour := range stored.Hours {
+				if hour < oldestHour {
+					delete(stored.Hours, hour)
+				}
+			}
+			data, err := json.Marshal(stored)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(user), data); err != nil {
+				return err
+			}
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			u, err := decodeUsage(v)
+			if err != nil {
+				return err
+			}
+			usage[string(k)] = u
+			return nil
+		})
+	})
+	return usage, err
+}
+
+func decodeUsage(data []byte) (*Usage, error) {
+	u := &Usage{}
+	if data != nil {
+		if err := json.Unmarshal(data, u); err != nil {
+			return nil, err
+		}
+	}
+	if u.Hours == nil {
+		u.Hours = make(map[int64]int64)
+	}
+	return u, nil
+}
+
+// ReadUsage returns the stored records of every user
+func ReadUsage(path string) (map[string]*Usage, error) {
+	return mergeUsage(path, nil, time.Time{})
+}
+
+// ResetUsage deletes the records of the given users, or of everyone if none
+// are given. A running server picks the reset up on its next flush.
+func ResetUsage(path string, users ...string) error {
+	db, err := openStore(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if len(users) == 0 {
+			if tx.Bucket(usageBucket) == nil {
+				return nil
+			}
+			return tx.DeleteBucket(usageBucket)
+		}
+		bucket, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := bucket.Delete([]byte(user)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// longest single sleep while waiting, so rate changes are picked up quickly
+const maxWaitSlice = 100 * time.Millisecond
+
+// Bucket is a token bucket holding up to one second worth of bytes.
+// Consumers take tokens first and then wait while the bucket is in debt,
+// which lets a single read larger than the bucket go through at the set rate.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a bucket refilled with rate bytes per second, rate <= 0 means unlimited
+func NewBucket(rate int64) *Bucket {
+	b := &Bucket{last: time.Now()}
+	b.SetRate(rate)
+	return b
+}
+
+// SetRate changes the refill rate, waiters pick up the new rate on their next slice
+func (b *Bucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if rate <= 0 {
+		b.rate = 0
+		b.tokens = 0
+		return
+	}
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// Rate returns the current rate in bytes per second, 0 if unlimited
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// Wait takes n tokens and blocks until the bucket is out of debt or done is closed
+func (b *Bucket) Wait(n int, done <-chan struct{}) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	if b.rate == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.tokens -= float64(n)
+	for b.tokens < 0 && b.rate > 0 {
+		wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+		if wait > maxWaitSlice {
+			wait = maxWaitSlice
+		}
+		b.mu.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+		b.mu.Lock()
+		b.refill(time.Now())
+	}
+	b.mu.Unlock()
+}
+
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if b.rate == 0 {
+		return
+	}
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
@@ -0,0 +1,213 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Rates in bytes per second, 0 means unlimited.
+// Upload is client to destination, Download is destination to client.
+type Rates struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// Limits configures the buckets a relay goes through
+type Limits struct {
+	// Shared by every connection
+	Global Rates `json:"global"`
+	// Shared by all connections of one user
+	PerUser Rates `json:"perUser"`
+	// For each connection
+	PerConn Rates `json:"perConn"`
+	// Overrides PerUser for the listed users
+	Users map[string]Rates `json:"users"`
+}
+
+func (l Limits) userRates(user string) Rates {
+	if rates, ok := l.Users[user]; ok {
+		return rates
+	}
+	return l.PerUser
+}
+
+// Load reads limits from a JSON file
+func Load(path string) (Limits, error) {
+	var limits Limits
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return limits, err
+	}
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return limits, fmt.Errorf("invalid rate limit file %s: %v", path, err)
+	}
+	return limits, nil
+}
+
+type pair struct {
+	up   *Bucket
+	down *Bucket
+}
+
+func newPair(rates Rates) pair {
+	return pair{up: NewBucket(rates.Upload), down: NewBucket(rates.Download)}
+}
+
+func (p pair) set(rates Rates) {
+	p.up.SetRate(rates.Upload)
+	p.down.SetRate(rates.Download)
+}
+
+type userBuckets struct {
+	pair
+	refs int
+}
+
+// Limiter hands out per connection sessions and keeps the shared
+// global and per user buckets
+type Limiter struct {
+	mu       sync.Mutex
+	limits   Limits
+	global   pair
+	users    map[string]*userBuckets
+	sessions map[*Session]struct{}
+}
+
+func New(limits Limits) *Limiter {
+	return &Limiter{
+		limits:   limits,
+		global:   newPair(limits.Global),
+		users:    make(map[string]*userBuckets),
+		sessions: make(map[*Session]struct{}),
+	}
+}
+
+// SetLimits applies new limits to every bucket, including those of live connections
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	l.global.set(limits.Global)
+	for user, buckets := range l.users {
+		buckets.set(limits.userRates(user))
+	}
+	for s := range l.sessions {
+		s.conn.set(limits.PerConn)
+	}
+}
+
+// Limits returns the limits currently in effect
+func (l *Limiter) Limits() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+// Open starts a session for one connection of user, empty for anonymous
+// connections which only get the global and per connection limits.
+// A nil Limiter returns a nil Session which does not limit.
+func (l *Limiter) Open(user string) *Session {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &Session{limiter: l, user: user, conn: newPair(l.limits.PerConn), done: make(chan struct{})}
+	if user != "" {
+		buckets, ok := l.users[user]
+		if !ok {
+			buckets = &userBuckets{pair: newPair(l.limits.userRates(user))}
+			l.users[user] = buckets
+		}
+		buckets.refs++
+		s.userBuckets = buckets
+	}
+	l.sessions[s] = struct{}{}
+	return s
+}
+
+// Session limits the traffic of one connection
+type Session struct {
+	limiter     *Limiter
+	user        string
+	conn        pair
+	userBuckets *userBuckets
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// Close releases the session and wakes up any waiting relay
+func (s *Session) Close() {
+	if s == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		close(s.done)
+		l := s.limiter
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.sessions, s)
+		if s.userBuckets != nil {
+			s.userBuckets.refs--
+			if s.userBuckets.refs == 0 {
+				delete(l.users, s.user)
+			}
+		}
+	})
+}
+
+// WaitUpload blocks until n bytes may be sent to the destination
+func (s *Session) WaitUpload(n int) {
+	if s == nil {
+		return
+	}
+	s.conn.up.Wait(n, s.done)
+	if s.userBuckets != nil {
+		s.userBuckets.up.Wait(n, s.done)
+	}
+	s.limiter.global.up.Wait(n, s.done)
+}
+
+// WaitDownload blocks until n bytes may be sent to the client
+func (s *Session) WaitDownload(n int) {
+	if s == nil {
+		return
+	}
+	s.conn.down.Wait(n, s.done)
+	if s.userBuckets != nil {
+		s.userBuckets.down.Wait(n, s.done)
+	}
+	s.limiter.global.down.Wait(n, s.done)
+}
+
+// Upload wraps a reader of client data
+func (s *Session) Upload(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &reader{r: r, wait: s.WaitUpload}
+}
+
+// Download wraps a reader of destination data
+func (s *Session) Download(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &reader{r: r, wait: s.WaitDownload}
+}
+
+type reader struct {
+	r    io.Reader
+	wait func(n int)
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBucketWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    int64
+		n       int
+		minWait time.Duration
+		maxWait time.Duration
+	}{
+		{"unlimited", 0, 1 << 20, 0, 50 * time.Millisecond},
+		{"within the burst", 1000, 1000, 0, 50 * time.Millisecond},
+		{"debt", 1000, 1200, 150 * time.Millisecond, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBucket(tt.rate)
+			// a new bucket starts empty, fill it up
+			b.last = time.Now().Add(-time.Second)
+			start := time.Now()
+			b.Wait(tt.n, nil)
+			if elapsed := time.Since(start); elapsed < tt.minWait || elapsed > tt.maxWait {
+				t.Errorf("Wait(%d) took %v, want between %v and %v", tt.n, elapsed, tt.minWait, tt.maxWait)
+			}
+		})
+	}
+}
+
+func TestBucketWaitDone(t *testing.T) {
+	b := NewBucket(10)
+	done := make(chan struct{})
+	close(done)
+	start := time.Now()
+	b.Wait(1000, done)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Wait returned after %v once done was closed", elapsed)
+	}
+}
+
+func TestBucketSetRate(t *testing.T) {
+	b := NewBucket(1000)
+	b.last = time.Now().Add(-time.Second)
+	b.SetRate(100)
+	if got := b.Rate(); got != 100 {
+		t.Errorf("Rate() = %d, want 100", got)
+	}
+	if b.tokens > 100 {
+		t.Errorf("tokens = %v, want at most the new rate", b.tokens)
+	}
+	b.SetRate(-1)
+	if got := b.Rate(); got != 0 {
+		t.Errorf("Rate() = %d, want 0", got)
+	}
+}
+
+func TestLimiterUserBuckets(t *testing.T) {
+	l := New(Limits{
+		PerUser: Rates{Upload: 100},
+		Users:   map[string]Rates{"alice": {Upload: 200}},
+	})
+	a1 := l.Open("alice")
+	a2 := l.Open("alice")
+	bob := l.Open("bob")
+	anonymous := l.Open("")
+
+	if a1.userBuckets != a2.userBuckets {
+		t.Error("connections of one user do not share buckets")
+	}
+	if got := a1.userBuckets.up.Rate(); got != 200 {
+		t.Errorf("alice upload rate = %d, want 200", got)
+	}
+	if got := bob.userBuckets.up.Rate(); got != 100 {
+		t.Errorf("bob upload rate = %d, want 100", got)
+	}
+	if anonymous.userBuckets != nil {
+		t.Error("anonymous connection got user buckets")
+	}
+
+	l.SetLimits(Limits{PerUser: Rates{Upload: 50}, PerConn: Rates{Download: 10}})
+	if got := a1.userBuckets.up.Rate(); got != 50 {
+		t.Errorf("alice upload rate after SetLimits = %d, want 50", got)
+	}
+	if got := anonymous.conn.down.Rate(); got != 10 {
+		t.Errorf("connection download rate after SetLimits = %d, want 10", got)
+	}
+
+	a1.Close()
+	if _, ok := l.users["alice"]; !ok {
+		t.Error("user buckets released while a connection is open")
+	}
+	a2.Close()
+	a2.Close()
+	if _, ok := l.users["alice"]; ok {
+		t.Error("user buckets kept after the last connection closed")
+	}
+	bob.Close()
+	anonymous.Close()
+	if len(l.sessions) != 0 {
+		t.Errorf("%d sessions left open", len(l.sessions))
+	}
+}
+
+func TestNilSession(t *testing.T) {
+	var l *Limiter
+	s := l.Open("alice")
+	r := s.Upload(bytes.NewReader([]byte("data")))
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "data" {
+		t.Errorf("ReadAll() = %q, %v", data, err)
+	}
+	s.Close()
+}
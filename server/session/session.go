@@ -0,0 +1,349 @@
+// Package session keeps track of the sessions being served, so that they
+// can be listed, logged when they end and killed
+package session
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrDisabled refuses the sessions of users whose access is turned off
+	ErrDisabled = errors.New("access of the user is disabled")
+	// ErrKilled is the error of sessions ended by Kill or KillUser
+	ErrKilled = errors.New("session killed")
+)
+
+// Info describes a session, Duration and Error are set once it ended
+type Info struct {
+	ID       uint64 `json:"id"`
+	Client   string `json:"client"`
+	User     string `json:"user"`
+	Protocol string `json:"protocol"`
+	Command  string `json:"command,omitempty"`
+	// Destination as requested, a fake address replaced by its name
+	Destination string `json:"destination,omitempty"`
+	// Address the destination was reached at, the local address used for it
+	Resolved string `json:"resolved,omitempty"`
+	Outbound string `json:"outbound,omitempty"`
+	// Bytes sent by and to the client
+	BytesUp   uint64    `json:"bytesUp"`
+	BytesDown uint64    `json:"bytesDown"`
+	Start     time.Time `json:"start"`
+	// Seconds the session lasted so far
+	Duration float64 `json:"duration"`
+	// Last reply code sent to the client
+	Reply *int   `json:"reply,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Registry holds the open sessions and the users whose access is disabled
+type Registry struct {
+	// first for 64-bit alignment of atomic access
+	nextID uint64
+
+	// OnClose is called with every session that ends
+	OnClose func(Info)
+
+	mu       sync.Mutex
+	sessions map[uint64]*Session
+	disabled map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[uint64]*Session), disabled: make(map[string]bool)}
+}
+
+// Session is one client being served. Its methods do nothing on nil.
+type Session struct {
+	// first for 64-bit alignment of atomic access
+	bytesUp, bytesDown uint64
+
+	id       uint64
+	client   string
+	start    time.Time
+	registry *Registry
+	// closed to kill the session
+	conn io.Closer
+
+	mu          sync.Mutex
+	protocol    string
+	user        string
+	command     string
+	destination string
+	resolved    string
+	outbound    string
+	reply       *int
+	killed      bool
+}
+
+// Open registers a session of the client, killing it closes conn
+func (r *Registry) Open(protocol string, client net.Addr, conn io.Closer) *Session {
+	s := &Session{
+		id:       atomic.AddUint64(&r.nextID, 1),
+		client:   client.String(),
+		start:    time.Now(),
+		registry: r,
+		conn:     conn,
+		protocol: protocol,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.id] = s
+	return s
+}
+
+// List describes the open sessions in the order they started
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	infos := make([]Info, len(sessions))
+	for i, s := range sessions {
+		infos[i] = s.Info()
+	}
+	return infos
+}
+
+// Kill closes the connection of a session, false if there is none with the id
+func (r *Registry) Kill(id uint64) bool {
+	r.mu.Lock()
+	s := r.sessions[id]
+	r.mu.Unlock()
+	if s == nil {
+		return false
+	}
+	s.kill()
+	return true
+}
+
+// KillUser closes the connections of every session of the user and returns
+// how many there were
+func (r *Registry) KillUser(user string) int {
+	r.mu.Lock()
+	var sessions []*Session
+	for _, s := range r.sessions {
+		if s.User() == user {
+			sessions = append(sessions, s)
+		}
+	}
+	r.mu.Unlock()
+	for _, s := range sessions {
+		s.kill()
+	}
+	return len(sessions)
+}
+
+// Len returns the number of open sessions
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// KillAll closes the connections of every session and returns how many
+// there were
+func (r *Registry) KillAll() int {
+	r.mu.Lock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.Unlock()
+	for _, s := range sessions {
+		s.kill()
+	}
+	return len(sessions)
+}
+
+// SetEnabled turns the access of a user on or off, open sessions are kept
+func (r *Registry) SetEnabled(user string, enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if enabled {
+		delete(r.disabled, user)
+	} else {
+		r.disabled[user] = true
+	}
+}
+
+// Enabled reports whether the user may open sessions
+func (r *Registry) Enabled(user string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.disabled[user]
+}
+
+// Disabled lists the users whose access is turned off
+func (r *Registry) Disabled() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	users := make([]string, 0, len(r.disabled))
+	for user := range r.disabled {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+func (s *Session) ID() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.id
+}
+
+func (s *Session) User() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+func (s *Session) SetProtocol(protocol string) {
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.protocol = protocol
+	}
+}
+
+func (s *Session) SetUser(user string) {
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.user = user
+	}
+}
+
+// SetRequest records the command and the host and port it is for
+func (s *Session) SetRequest(command, host string, port uint16) {
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.command = command
+		s.destination = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+}
+
+// SetDialed records the addresses of the connection to the destination
+func (s *Session) SetDialed(conn net.Conn) {
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.resolved = conn.RemoteAddr().String()
+		s.outbound = conn.LocalAddr().String()
+	}
+}
+
+func (s *Session) SetReply(code int) {
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reply = &code
+	}
+}
+
+// AddUpload counts n bytes sent by the client
+func (s *Session) AddUpload(n int) {
+	if s != nil && n > 0 {
+		atomic.AddUint64(&s.bytesUp, uint64(n))
+	}
+}
+
+// AddDownload counts n bytes sent to the client
+func (s *Session) AddDownload(n int) {
+	if s != nil && n > 0 {
+		atomic.AddUint64(&s.bytesDown, uint64(n))
+	}
+}
+
+// Upload wraps a reader of client data
+func (s *Session) Upload(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &counter{r: r, add: s.AddUpload}
+}
+
+// Download wraps a reader of destination data
+func (s *Session) Download(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &counter{r: r, add: s.AddDownload}
+}
+
+type counter struct {
+	r   io.Reader
+	add func(n int)
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.add(n)
+	return n, err
+}
+
+func (s *Session) kill() {
+	s.mu.Lock()
+	s.killed = true
+	s.mu.Unlock()
+	s.conn.Close()
+}
+
+// Info describes the session as it is now
+func (s *Session) Info() Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Info{
+		ID:          s.id,
+		Client:      s.client,
+		User:        s.user,
+		Protocol:    s.protocol,
+		Command:     s.command,
+		Destination: s.destination,
+		Resolved:    s.resolved,
+		Outbound:    s.outbound,
+		BytesUp:     atomic.LoadUint64(&s.bytesUp),
+		BytesDown:   atomic.LoadUint64(&s.bytesDown),
+		Start:       s.start,
+		Duration:    time.Since(s.start).Seconds(),
+		Reply:       s.reply,
+	}
+}
+
+// Close unregisters the session, err is the error it ended with
+func (s *Session) Close(err error) {
+	if s == nil {
+		return
+	}
+	r := s.registry
+	r.mu.Lock()
+	delete(r.sessions, s.id)
+	r.mu.Unlock()
+	if r.OnClose != nil {
+		info := s.Info()
+		s.mu.Lock()
+		if s.killed {
+			err = ErrKilled
+		}
+		s.mu.Unlock()
+		if err != nil {
+			info.Error = err.Error()
+		}
+		r.OnClose(info)
+	}
+}
@@ -0,0 +1,207 @@
+package session
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testConn counts how often the registry closes it
+type testConn struct {
+	closed int
+}
+
+func (c *testConn) Close() error {
+	c.closed++
+	return nil
+}
+
+func addr(s string) net.Addr {
+	a, _ := net.ResolveTCPAddr("tcp", s)
+	return a
+}
+
+func TestList(t *testing.T) {
+	r := NewRegistry()
+	tests := []struct {
+		protocol, client, user string
+	}{
+		{"socks5", "192.0.2.1:1000", "alice"},
+		{"socks4", "192.0.2.2:2000", "bob"},
+		{"transparent", "192.0.2.3:3000", ""},
+	}
+	var sessions []*Session
+	for _, tt := range tests {
+		s := r.Open(tt.protocol, addr(tt.client), &testConn{})
+		s.SetUser(tt.user)
+		sessions = append(sessions, s)
+	}
+	sessions[0].SetRequest("connect", "example.com", 443)
+	sessions[0].SetReply(0)
+
+	infos := r.List()
+	if len(infos) != len(tests) || r.Len() != len(tests) {
+		t.Fatalf("List() holds %d sessions, Len() = %d, want %d", len(infos), r.Len(), len(tests))
+	}
+	for i, tt := range tests {
+		info := infos[i]
+		if info.ID != sessions[i].ID() || info.Protocol != tt.protocol || info.Client != tt.client || info.User != tt.user {
+			t.Errorf("session %d is %+v, want %+v", i, info, tt)
+		}
+	}
+	if infos[0].Command != "connect" || infos[0].Destination != "example.com:443" || infos[0].Reply == nil || *infos[0].Reply != 0 {
+		t.Errorf("request not recorded: %+v", infos[0])
+	}
+
+	sessions[1].Close(nil)
+	if infos := r.List(); len(infos) != 2 || infos[0].ID != sessions[0].ID() || infos[1].ID != sessions[2].ID() {
+		t.Errorf("List() after a close = %+v", infos)
+	}
+}
+
+func TestKill(t *testing.T) {
+	tests := []struct {
+		name       string
+		kill       func(r *Registry, ids []uint64) int
+		want       int
+		wantKilled []bool
+	}{
+		{"session", func(r *Registry, ids []uint64) int {
+			if r.Kill(ids[1]) {
+				return 1
+			}
+			return 0
+		}, 1, []bool{false, true, false}},
+		{"unknown session", func(r *Registry, ids []uint64) int {
+			if r.Kill(ids[2] + 1) {
+				return 1
+			}
+			return 0
+		}, 0, []bool{false, false, false}},
+		{"user", func(r *Registry, ids []uint64) int { return r.KillUser("alice") }, 2, []bool{true, false, true}},
+		{"unknown user", func(r *Registry, ids []uint64) int { return r.KillUser("carol") }, 0, []bool{false, false, false}},
+		{"all", func(r *Registry, ids []uint64) int { return r.KillAll() }, 3, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			var closed []Info
+			r.OnClose = func(info Info) { closed = append(closed, info) }
+			var conns []*testConn
+			var sessions []*Session
+			var ids []uint64
+			for _, user := range []string{"alice", "bob", "alice"} {
+				conn := &testConn{}
+				s := r.Open("socks5", addr("192.0.2.1:1000"), conn)
+				s.SetUser(user)
+				conns = append(conns, conn)
+				sessions = append(sessions, s)
+				ids = append(ids, s.ID())
+			}
+			if got := tt.kill(r, ids); got != tt.want {
+				t.Errorf("killed %d, want %d", got, tt.want)
+			}
+			for i, conn := range conns {
+				if killed := conn.closed > 0; killed != tt.wantKilled[i] {
+					t.Errorf("session %d killed %v, want %v", i, killed, tt.wantKilled[i])
+				}
+			}
+
+			// the handlers end with the error the connection gave them
+			for _, s := range sessions {
+				s.Close(io.ErrUnexpectedEOF)
+			}
+			if r.Len() != 0 {
+				t.Errorf("Len() = %d after closing every session", r.Len())
+			}
+			for i, info := range closed {
+				want := io.ErrUnexpectedEOF.Error()
+				if tt.wantKilled[i] {
+					want = ErrKilled.Error()
+				}
+				if info.Error != want {
+					t.Errorf("session %d closed with %q, want %q", i, info.Error, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	r := NewRegistry()
+	tests := []struct {
+		user         string
+		enabled      bool
+		wantDisabled []string
+	}{
+		{"bob", false, []string{"bob"}},
+		{"alice", false, []string{"alice", "bob"}},
+		{"alice", false, []string{"alice", "bob"}},
+		{"bob", true, []string{"alice"}},
+		{"carol", true, []string{"alice"}},
+		{"alice", true, []string{}},
+	}
+	for _, tt := range tests {
+		r.SetEnabled(tt.user, tt.enabled)
+		if got := r.Enabled(tt.user); got != tt.enabled {
+			t.Errorf("Enabled(%q) = %v, want %v", tt.user, got, tt.enabled)
+		}
+		if got := r.Disabled(); strings.Join(got, ",") != strings.Join(tt.wantDisabled, ",") || got == nil {
+			t.Errorf("Disabled() = %#v, want %v", got, tt.wantDisabled)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	r := NewRegistry()
+	var closed Info
+	r.OnClose = func(info Info) { closed = info }
+	s := r.Open("socks5", addr("192.0.2.1:1000"), &testConn{})
+
+	tests := []struct {
+		data             string
+		upload           bool
+		wantUp, wantDown uint64
+	}{
+		{"hello", true, 5, 0},
+		{"world!", false, 5, 6},
+		{"", true, 5, 6},
+		{"again", true, 10, 6},
+	}
+	for _, tt := range tests {
+		wrap := s.Download
+		if tt.upload {
+			wrap = s.Upload
+		}
+		data, err := io.ReadAll(wrap(strings.NewReader(tt.data)))
+		if err != nil || string(data) != tt.data {
+			t.Fatalf("ReadAll() = %q, %v", data, err)
+		}
+		if info := s.Info(); info.BytesUp != tt.wantUp || info.BytesDown != tt.wantDown {
+			t.Errorf("counted %d up %d down, want %d and %d", info.BytesUp, info.BytesDown, tt.wantUp, tt.wantDown)
+		}
+	}
+	s.Close(nil)
+	if closed.ID != s.ID() || closed.BytesUp != 10 || closed.BytesDown != 6 || closed.Error != "" {
+		t.Errorf("closed session %+v", closed)
+	}
+}
+
+func TestNilSession(t *testing.T) {
+	var s *Session
+	s.SetProtocol("socks5")
+	s.SetUser("alice")
+	s.SetRequest("connect", "example.com", 443)
+	s.SetReply(0)
+	s.AddUpload(1)
+	s.AddDownload(1)
+	s.Close(nil)
+	if s.ID() != 0 || s.User() != "" {
+		t.Errorf("nil session has id %d and user %q", s.ID(), s.User())
+	}
+	r := strings.NewReader("data")
+	if s.Upload(r) != io.Reader(r) || s.Download(r) != io.Reader(r) {
+		t.Error("nil session wraps readers")
+	}
+}
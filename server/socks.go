@@ -3,36 +3,82 @@ package server
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/thifnmi/proxy-socks-server/logger"
+	"github.com/thifnmi/proxy-socks-server/metrics"
 	"github.com/thifnmi/proxy-socks-server/server/auth"
+	"github.com/thifnmi/proxy-socks-server/server/connlimit"
+	"github.com/thifnmi/proxy-socks-server/server/listenfd"
+	"github.com/thifnmi/proxy-socks-server/server/session"
 	"github.com/thifnmi/proxy-socks-server/server/socks4a"
 	"github.com/thifnmi/proxy-socks-server/server/socks5"
+	"github.com/thifnmi/proxy-socks-server/server/transparent"
 	"github.com/thifnmi/proxy-socks-server/utils"
 )
 
+const (
+	// how often Shutdown checks whether the sessions ended
+	shutdownPollInterval = 100 * time.Millisecond
+	// how long Shutdown waits for killed sessions to finish their records
+	killGrace = time.Second
+	// how long a connection over a limit has to send its version byte
+	rejectTimeout = time.Second
+	// bounds of the wait after a temporary accept error
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// ErrServerClosed is returned by the Serve and ListenAndServe methods after
+// Shutdown
+var ErrServerClosed = errors.New("socks: server closed")
+
 type SocksServer struct {
 	config      *utils.Config
 	authMethods map[uint8]auth.Authenticator
+	sessions    *session.Registry
+
+	mu sync.Mutex
+	// listeners and UDP sockets being served
+	listeners map[io.Closer]struct{}
+	closed    bool
+	// serving loops, Shutdown waits for them to stop accepting
+	loops sync.WaitGroup
 }
 
 // authenticate is used to handle connection authentication
 func (s *SocksServer) SocksServerAuthenticate(conn net.Conn, bufConn io.Reader) (*auth.AuthContext, error) {
+	return s.authenticate(conn, bufConn, false)
+}
+
+// authenticate lets clients from trusted networks (noAuth) skip
+// authentication when they offer the "No Authentication" method
+func (s *SocksServer) authenticate(conn net.Conn, bufConn io.Reader, noAuth bool) (*auth.AuthContext, error) {
 	// Get the methods
 	methods, err := auth.ReadMethods(bufConn)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get auth methods: %v", err)
 	}
 
+	if noAuth {
+		for _, method := range methods {
+			if method == auth.NoAuth {
+				return countAuth(method)(auth.NoAuthAuthenticator{}.Authenticate(bufConn, conn))
+			}
+		}
+	}
+
 	// Select a usable method
 	for _, method := range methods {
 		cator, found := s.authMethods[method]
 		if found {
-			return cator.Authenticate(bufConn, conn)
+			return countAuth(method)(cator.Authenticate(bufConn, conn))
 		}
 	}
 
@@ -40,6 +86,19 @@ func (s *SocksServer) SocksServerAuthenticate(conn net.Conn, bufConn io.Reader)
 	return nil, noAcceptableAuth(conn)
 }
 
+// countAuth returns a function counting the outcome of an authentication
+// with method and passing it on
+func countAuth(method uint8) func(*auth.AuthContext, error) (*auth.AuthContext, error) {
+	return func(authCtx *auth.AuthContext, err error) (*auth.AuthContext, error) {
+		result := metrics.Result(err)
+		if err == auth.UserAuthLocked {
+			result = "locked"
+		}
+		metrics.Auth.With(auth.MethodName(method), result).Inc()
+		return authCtx, err
+	}
+}
+
 // noAcceptableAuth is used to handle when we have no eligible
 // authentication mechanism
 func noAcceptableAuth(conn io.Writer) error {
@@ -47,10 +106,43 @@ func noAcceptableAuth(conn io.Writer) error {
 	return auth.NoSupportedAuth
 }
 
+// reject answers a connection refused for reason with the failure reply of
+// its SOCKS version, read within rejectTimeout, and closes it
+func reject(conn net.Conn, reason error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return
+	}
+	switch version[0] {
+	case auth.SocksVersion4:
+		socks4a.Reject(conn, reason)
+	case auth.SocksVersion5:
+		socks5.Reject(conn, reason)
+	default:
+		return
+	}
+	// closing with the rest of the request unread would reset the
+	// connection and could discard the reply
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// rejectReason is the reason label of a connection refused with err
+func rejectReason(err error) string {
+	if limitErr, ok := err.(*connlimit.LimitError); ok {
+		return limitErr.Reason
+	}
+	return "other"
+}
+
 func NewSocksServer(config *utils.Config) *SocksServer {
 	if len(config.AuthMethods) == 0 {
 		if config.Credentials != nil {
-			config.AuthMethods = []auth.Authenticator{&auth.UserPassAuthenticator{config.Credentials}}
+			config.AuthMethods = []auth.Authenticator{&auth.UserPassAuthenticator{Credentials: config.Credentials}}
 		} else {
 			config.AuthMethods = []auth.Authenticator{&auth.NoAuthAuthenticator{}}
 		}
@@ -59,69 +151,314 @@ func NewSocksServer(config *utils.Config) *SocksServer {
 		config.Resolv = utils.DefaultResolver{}
 	}
 	if config.Dial == nil {
-		config.Dial = func(_ context.Context, network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, 5*time.Second)
-		}
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		config.Dial = dialer.DialContext
 	}
 	authMethods := make(map[uint8]auth.Authenticator)
 
 	for _, a := range config.AuthMethods {
 		authMethods[a.GetCode()] = a
 	}
-	return &SocksServer{config: config, authMethods: authMethods}
+	sessions := session.NewRegistry()
+	if config.AccessLog != nil {
+		sessions.OnClose = config.AccessLog.Write
+	}
+	return &SocksServer{config: config, authMethods: authMethods, sessions: sessions, listeners: make(map[io.Closer]struct{})}
+}
+
+// track registers a listener to close on Shutdown and counts its serving
+// loop, false if the server is shut down
+func (s *SocksServer) track(l io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	s.loops.Add(1)
+	return true
+}
+
+func (s *SocksServer) untrack(l io.Closer) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+	s.loops.Done()
+}
+
+func (s *SocksServer) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// accept waits for the next connection, retrying with backoff after
+// temporary errors like running out of file descriptors
+func (s *SocksServer) accept(l net.Listener) (net.Conn, error) {
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if s.shuttingDown() {
+			return nil, ErrServerClosed
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return nil, err
+		}
+		if backoff == 0 {
+			backoff = minAcceptBackoff
+		} else if backoff *= 2; backoff > maxAcceptBackoff {
+			backoff = maxAcceptBackoff
+		}
+		logger.Infof("Accept error on %s: %s, retrying in %s", l.Addr(), err, backoff)
+		time.Sleep(backoff)
+	}
+}
+
+// Shutdown stops accepting connections and waits for the open sessions to
+// end. Once ctx is done the remaining sessions are killed and its error is
+// returned.
+func (s *SocksServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+	s.loops.Wait()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.sessions.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			logger.Infof("Killing %d sessions still open at shutdown", s.sessions.KillAll())
+			for deadline := time.Now().Add(killGrace); s.sessions.Len() > 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Sessions returns the registry of the sessions being served
+func (s *SocksServer) Sessions() *session.Registry {
+	return s.sessions
 }
 
 func (s *SocksServer) ListenAndServe(network, bindAddr string) error {
 	// init socks4 and socks5 config
 	socks4a.InitConfig(s.config)
 	socks5.InitConfig(s.config)
-	listener, err := net.Listen(network, bindAddr)
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	listener, err := listenfd.Listen(network, bindAddr)
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
 	logger.Infof("Serving on %s", bindAddr)
-	return s.Serve(listener)
+	return s.serve(listener, bindAddr)
 }
 
-func (s *SocksServer) Serve(l net.Listener) error {
+// ListenAndServeTransparent relays the TCP connections an iptables REDIRECT
+// rule, or a TPROXY rule if tproxy is set, sends to bindAddr
+func (s *SocksServer) ListenAndServeTransparent(bindAddr string, tproxy bool) error {
+	transparent.InitConfig(s.config)
+	listener, err := listenfd.Listener(bindAddr, func() (net.Listener, error) {
+		return transparent.Listen(bindAddr, tproxy)
+	})
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if !s.track(listener) {
+		return ErrServerClosed
+	}
+	defer s.untrack(listener)
+	logger.Infof("Serving transparent proxy on %s", bindAddr)
 	for {
-		conn, err := l.Accept()
+		conn, err := s.accept(listener)
 		if err != nil {
 			return err
 		}
+		metrics.ConnectionsAccepted.With("transparent").Inc()
+		if allowed, _ := s.config.ACL.Check(bindAddr, conn.RemoteAddr()); !allowed {
+			logger.Infof("Denied connection from %s on %s by acl", conn.RemoteAddr(), bindAddr)
+			metrics.ConnectionsRejected.With("acl").Inc()
+			conn.Close()
+			continue
+		}
+		remoteAddr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		release, err := s.config.ConnLimiter.Acquire(remoteAddr)
+		if err != nil {
+			logger.Infof("Rejected transparent connection from %s: %s", conn.RemoteAddr(), err)
+			metrics.ConnectionsRejected.With(rejectReason(err)).Inc()
+			conn.Close()
+			continue
+		}
+		active := metrics.ConnectionsActive.With("transparent")
+		active.Inc()
+		sess := s.sessions.Open("transparent", conn.RemoteAddr(), conn)
+		go func() {
+			defer active.Dec()
+			defer conn.Close()
+			defer release()
+			err := transparent.HandleConnection(conn, listener.Addr(), sess)
+			sess.Close(err)
+			if err != nil {
+				logger.Infof("handle transparent connection from %s err: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ListenAndServeTransparentUDP relays the datagrams a TPROXY rule sends to bindAddr
+func (s *SocksServer) ListenAndServeTransparentUDP(bindAddr string) error {
+	transparent.InitConfig(s.config)
+	packetConn, err := listenfd.PacketConn(bindAddr, func() (net.PacketConn, error) {
+		return transparent.ListenUDP(bindAddr)
+	})
+	if err != nil {
+		return err
+	}
+	defer packetConn.Close()
+	conn, ok := packetConn.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("inherited socket on %s is not a UDP socket", bindAddr)
+	}
+	if !s.track(conn) {
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+	logger.Infof("Serving transparent UDP proxy on %s", bindAddr)
+	err = transparent.ServeUDP(conn, func(client *net.UDPAddr) bool {
+		allowed, _ := s.config.ACL.Check(bindAddr, client)
+		return allowed
+	}, s.sessions)
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+func (s *SocksServer) Serve(l net.Listener) error {
+	return s.serve(l, l.Addr().String())
+}
+
+// serve accepts connections on l, listenAddr selects the listener's ACL section
+func (s *SocksServer) serve(l net.Listener, listenAddr string) error {
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+	for {
+		conn, err := s.accept(l)
 		if err != nil {
 			return err
 		}
+		metrics.ConnectionsAccepted.With("socks").Inc()
+		allowed, noAuth := s.config.ACL.Check(listenAddr, conn.RemoteAddr())
+		if !allowed {
+			logger.Infof("Denied connection from %s on %s by acl", conn.RemoteAddr(), listenAddr)
+			metrics.ConnectionsRejected.With("acl").Inc()
+			conn.Close()
+			continue
+		}
 		bufConn := bufio.NewReader(conn)
 		remoteAddr, remotePortStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
 		logger.Infof("Received connection from %s:%s", remoteAddr, remotePortStr)
-		go func() error {
+		release, err := s.config.ConnLimiter.Acquire(remoteAddr)
+		if err != nil {
+			// connections over the global or per IP limit get no session
+			logger.Infof("Rejected connection from %s:%s: %s", remoteAddr, remotePortStr, err)
+			metrics.ConnectionsRejected.With(rejectReason(err)).Inc()
+			go reject(conn, err)
+			continue
+		}
+		active := metrics.ConnectionsActive.With("socks")
+		active.Inc()
+		sess := s.sessions.Open("socks", conn.RemoteAddr(), conn)
+		go func() (err error) {
+			defer func() { sess.Close(err) }()
+			defer active.Dec()
 			defer conn.Close()
+			defer release()
 			var buf [1]byte
-			_, err := io.ReadFull(conn, buf[:])
+			_, err = io.ReadFull(conn, buf[:])
 			if err != nil {
 				logger.Infof("Read socks version error: %s", err)
+				metrics.Handshakes.With("unknown", "failure").Inc()
 				return err
 			}
-			_, err = s.SocksServerAuthenticate(conn, bufConn)
+			version := "other"
+			if buf[0] == auth.SocksVersion4 || buf[0] == auth.SocksVersion5 {
+				version = strconv.Itoa(int(buf[0]))
+				sess.SetProtocol("socks" + version)
+			}
+			authCtx, err := s.authenticate(conn, bufConn, noAuth)
 			if err != nil {
+				result := "failure"
+				if err == auth.NoSupportedAuth {
+					result = "no_acceptable_method"
+				}
+				metrics.Handshakes.With(version, result).Inc()
 				err = fmt.Errorf("Failed to authenticate: %v", err)
 				logger.Infof("[ERR] socks: %v", err)
 				return err
 			}
 
 			logger.Infof("Authenticated with method %d from host %s:%s", buf[0], remoteAddr, remotePortStr)
+			metrics.Handshakes.With(version, "success").Inc()
+			sess.SetUser(authCtx.Username())
+			var limitErr error
+			if !s.sessions.Enabled(authCtx.Username()) {
+				limitErr = session.ErrDisabled
+				metrics.ConnectionsRejected.With("disabled").Inc()
+			} else {
+				var releaseUser func()
+				releaseUser, limitErr = s.config.ConnLimiter.AcquireUser(authCtx.Username())
+				defer releaseUser()
+				if limitErr != nil {
+					metrics.ConnectionsRejected.With(rejectReason(limitErr)).Inc()
+				}
+			}
+			if limitErr != nil {
+				// answered at once, without waiting for the request
+				logger.Infof("Rejected connection from %s:%s user %q: %s", remoteAddr, remotePortStr, authCtx.Username(), limitErr)
+				switch buf[0] {
+				case auth.SocksVersion4:
+					socks4a.Reject(conn, limitErr)
+				case auth.SocksVersion5:
+					socks5.Reject(conn, limitErr)
+				}
+				return limitErr
+			}
+
+			// accounts outside their time window lose the session
+			if expires := authCtx.Expires(); !expires.IsZero() {
+				timer := time.AfterFunc(time.Until(expires), func() {
+					logger.Infof("Ending session of user %q from %s:%s, account window closed", authCtx.Username(), remoteAddr, remotePortStr)
+					conn.Close()
+				})
+				defer timer.Stop()
+			}
+
 			switch buf[0] {
 			case auth.SocksVersion4:
-				err = socks4a.HandleConnection(conn)
+				err = socks4a.HandleConnection(conn, authCtx, sess)
 			case auth.SocksVersion5:
-				err = socks5.HandleConnection(conn)
+				err = socks5.HandleConnection(conn, authCtx, sess)
 			default:
 				err = fmt.Errorf("unacceptable socks version -> (%d) <-", buf[0])
 			}
 			if err != nil {
-				logger.Infof("handle socks connection err: %s",err)
+				logger.Infof("handle socks connection err: %s", err)
 				return err
 			}
 			return nil
@@ -10,6 +10,12 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/thifnmi/proxy-socks-server/metrics"
+	"github.com/thifnmi/proxy-socks-server/server/auth"
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/server/quota"
+	"github.com/thifnmi/proxy-socks-server/server/ratelimit"
+	"github.com/thifnmi/proxy-socks-server/server/session"
 	"github.com/thifnmi/proxy-socks-server/utils"
 )
 
@@ -22,6 +28,16 @@ const (
 	bind    command = 2
 )
 
+func (cmd command) String() string {
+	switch cmd {
+	case connect:
+		return policy.CmdConnect
+	case bind:
+		return policy.CmdBind
+	}
+	return strconv.Itoa(int(cmd))
+}
+
 type addrType byte
 
 const (
@@ -51,18 +67,35 @@ func InitConfig(config *utils.Config) {
 	currConfig = config
 }
 
-func HandleConnection(conn net.Conn) error {
-	c := newClient(conn)
+// HandleConnection serves the request of an authenticated client, the
+// session is described in sess
+func HandleConnection(conn net.Conn, authCtx *auth.AuthContext, sess *session.Session) error {
+	c := newClient(conn, authCtx)
+	c.sess = sess
 	return c.handle()
 }
 
+// Reject answers the request of a connection refused by a connection limit,
+// or because its user is disabled, with a failure. The reply is sent
+// without reading the request so that the connection is not held.
+func Reject(conn net.Conn, reason error) error {
+	c := newClient(conn, nil)
+	return c.sendFailure(requestRejectedOrFailed)
+}
+
 type client struct {
-	conn net.Conn
-	req  *request
+	conn    net.Conn
+	authCtx *auth.AuthContext
+	req     *request
+	// allowed addresses of the destination, nil if the dialer resolves it
+	ips   []net.IP
+	limit *ratelimit.Session
+	usage *quota.Session
+	sess  *session.Session
 }
 
-func newClient(conn net.Conn) *client {
-	return &client{conn: conn}
+func newClient(conn net.Conn, authCtx *auth.AuthContext) *client {
+	return &client{conn: conn, authCtx: authCtx}
 }
 
 func (c *client) handle() error {
@@ -72,22 +105,76 @@ func (c *client) handle() error {
 	}
 	c.req = req
 	ctx := context.Background()
-
-	if c.req.addressType == domainname {
-		resolvedIP, err := currConfig.Resolv.Resolve(ctx, c.req.DestHost)
-		if err != nil {
-			return err
+	metrics.Commands.With("socks4", c.req.cmd.String()).Inc()
+
+	// connections to fake addresses go to the name they were handed out for
+	if ip := net.ParseIP(c.req.DestHost); currConfig.FakeIP.Contains(ip) {
+		name, ok := currConfig.FakeIP.Lookup(ip)
+		if !ok {
+			c.sendFailure(requestRejectedOrFailed)
+			return fmt.Errorf("fake ip %s is not mapped to a name", ip)
+		}
+		c.req.addressType = domainname
+		c.req.DestHost = name
+	}
+	requestedHost := c.req.DestHost
+	c.sess.SetRequest(c.req.cmd.String(), requestedHost, c.req.DestPort)
+
+	switch {
+	case c.sniffing():
+		// the policy is checked once the first client bytes may have named the host
+		c.ips = []net.IP{net.ParseIP(c.req.DestHost)}
+	case c.remote():
+		// the dialer resolves the name, the policy only sees the name
+		if !c.allowed(requestedHost, nil) {
+			c.sendFailure(requestRejectedOrFailed)
+			return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, requestedHost, c.req.DestPort, c.authCtx.Username())
+		}
+	default:
+		ips := []net.IP{net.ParseIP(c.req.DestHost)}
+		if c.req.addressType == domainname {
+			// names the policy denies are not even looked up
+			if currConfig.Policy.DeniesName(c.policyRequest(requestedHost, nil)) {
+				c.sendFailure(requestRejectedOrFailed)
+				return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, requestedHost, c.req.DestPort, c.authCtx.Username())
+			}
+			start := time.Now()
+			ips, err = utils.LookupAll(ctx, currConfig.Resolv, c.req.DestHost)
+			metrics.DNSResolveDuration.ObserveSince(start, metrics.Result(err))
+			if err != nil {
+				return err
+			}
 		}
 
-		if ip4 := net.IP(resolvedIP).To4(); ip4 != nil {
+		// addresses the policy denies are never dialed
+		for _, ip := range ips {
+			if c.allowed(requestedHost, ip) {
+				c.ips = append(c.ips, ip)
+			}
+		}
+		if len(c.ips) == 0 {
+			c.sendFailure(requestRejectedOrFailed)
+			return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, requestedHost, c.req.DestPort, c.authCtx.Username())
+		}
+		if ip4 := c.ips[0].To4(); ip4 != nil {
 			c.req.addressType = ipv4
 			c.req.DestHost = ip4.String()
 		} else {
 			c.req.addressType = ipv6
-			c.req.DestHost = net.IP(resolvedIP).To16().String()
+			c.req.DestHost = c.ips[0].To16().String()
 		}
 	}
 
+	if currConfig.Quota.Exceeded(c.authCtx.Username()) {
+		c.sendFailure(requestRejectedOrFailed)
+		return fmt.Errorf("traffic quota of user %q is exhausted", c.authCtx.Username())
+	}
+
+	c.limit = currConfig.RateLimiter.Open(c.authCtx.Username())
+	defer c.limit.Close()
+	c.usage = currConfig.Quota.Open(c.authCtx.Username(), c.conn)
+	defer c.usage.Close()
+
 	switch c.req.cmd {
 	case connect:
 		return c.handleConnectCmd(ctx)
@@ -99,16 +186,132 @@ func (c *client) handle() error {
 	}
 }
 
+// remote reports whether the destination name is left for the dialer to
+// resolve, which only connect requests do
+func (c *client) remote() bool {
+	return c.req.cmd == connect && c.req.addressType == domainname &&
+		currConfig.ResolveRemotely != nil && currConfig.ResolveRemotely(c.req.DestHost)
+}
+
+// sniffing reports whether the host name of a connect request to an address
+// is looked for in the first client bytes
+func (c *client) sniffing() bool {
+	return c.req.cmd == connect && c.req.addressType != domainname && currConfig.SniffTimeout > 0
+}
+
+// allowed checks the request to one address of the host against the configured policy
+func (c *client) allowed(requestedHost string, ip net.IP) bool {
+	return currConfig.Policy.Allowed(c.policyRequest(requestedHost, ip))
+}
+
+// policyRequest describes the request to one address of the host to the policy
+func (c *client) policyRequest(requestedHost string, ip net.IP) policy.Request {
+	return policy.Request{
+		User:       c.authCtx.Username(),
+		Attributes: c.authCtx.Attributes(),
+		Command:    c.req.cmd.String(),
+		Host:       requestedHost,
+		IP:         ip,
+		Port:       c.req.DestPort,
+	}
+}
+
+// upload wraps a reader of client data with shaping and accounting
+func (c *client) upload(r io.Reader) io.Reader {
+	return c.sess.Upload(metrics.CountReader(c.usage.Upload(c.limit.Upload(r)), metrics.Bytes.With(c.authCtx.Username(), "upload")))
+}
+
+// download wraps a reader of destination data with shaping and accounting
+func (c *client) download(r io.Reader) io.Reader {
+	return c.sess.Download(metrics.CountReader(c.usage.Download(c.limit.Download(r)), metrics.Bytes.With(c.authCtx.Username(), "download")))
+}
+
 func (c *client) handleConnectCmd(ctx context.Context) error {
-	// serverConn, err := net.DialTimeout("tcp", net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort))), timeoutDuration)
-	serverConn, err := currConfig.Dial(ctx, "tcp", net.JoinHostPort(c.req.DestHost, strconv.Itoa(int(c.req.DestPort))))
+	if c.sniffing() {
+		return c.handleSniffedConnect(ctx)
+	}
+	serverConn, err := c.dial(ctx)
 	if err != nil {
 		c.sendFailure(requestRejectedOrFailed)
 		return err
 	}
 	defer serverConn.Close()
 
-	bindAddr, bindPortStr, _ := net.SplitHostPort(serverConn.LocalAddr().String())
+	if err := c.sendSuccess(serverConn.LocalAddr()); err != nil {
+		return err
+	}
+	return c.relay(serverConn)
+}
+
+// handleSniffedConnect dials the address asked for and answers, so that the
+// client sends its first bytes, which may name the host it wants. Requests
+// the address alone is denied for are refused before that. The policy then
+// goes by the name if it resolves to the address, a client may not pick a
+// name the policy allows for any address. A name routed to remote
+// resolution is checked alone and dialed instead of the address.
+func (c *client) handleSniffedConnect(ctx context.Context) error {
+	ip := c.ips[0]
+	if currConfig.Policy.DeniesAddress(c.policyRequest(c.req.DestHost, ip)) {
+		c.sendFailure(requestRejectedOrFailed)
+		return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, c.req.DestHost, c.req.DestPort, c.authCtx.Username())
+	}
+	serverConn, err := c.dial(ctx)
+	if err != nil {
+		c.sendFailure(requestRejectedOrFailed)
+		return err
+	}
+	defer func() { serverConn.Close() }()
+	if err := c.sendSuccess(serverConn.LocalAddr()); err != nil {
+		return err
+	}
+
+	host, conn := utils.Sniff(c.conn, currConfig.SniffTimeout)
+	c.conn = conn
+	requestedHost := c.req.DestHost
+	switch {
+	case host == "":
+	case currConfig.ResolveRemotely != nil && currConfig.ResolveRemotely(host):
+		if !c.allowed(host, nil) {
+			return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, host, c.req.DestPort, c.authCtx.Username())
+		}
+		serverConn.Close()
+		c.ips = nil
+		c.req.DestHost = host
+		if serverConn, err = c.dial(ctx); err != nil {
+			return err
+		}
+		return c.relay(serverConn)
+	case utils.ResolvesTo(ctx, currConfig.Resolv, host, ip):
+		requestedHost = host
+	}
+	if !c.allowed(requestedHost, ip) {
+		return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, requestedHost, c.req.DestPort, c.authCtx.Username())
+	}
+	return c.relay(serverConn)
+}
+
+// dial connects to the allowed addresses of the destination, or lets the
+// dialer resolve its name
+func (c *client) dial(ctx context.Context) (net.Conn, error) {
+	// serverConn, err := net.DialTimeout("tcp", net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort))), timeoutDuration)
+	start := time.Now()
+	var serverConn net.Conn
+	var err error
+	if c.ips == nil {
+		serverConn, err = currConfig.Dial(ctx, "tcp", net.JoinHostPort(c.req.DestHost, strconv.Itoa(int(c.req.DestPort))))
+	} else {
+		serverConn, err = currConfig.HappyEyeballs.Dial(ctx, currConfig.Dial, "tcp", c.ips, c.req.DestPort)
+	}
+	metrics.DialDuration.ObserveSince(start, metrics.Result(err))
+	if err == nil {
+		c.sess.SetDialed(serverConn)
+	}
+	return serverConn, err
+}
+
+// sendSuccess grants the request with the address the server uses
+func (c *client) sendSuccess(addr net.Addr) error {
+	bindAddr, bindPortStr, _ := net.SplitHostPort(addr.String())
 	bindPort, _ := strconv.Atoi(bindPortStr)
 
 	rep := &reply{resCode: requestGranted, bindAddr: bindAddr, bindPort: uint16(bindPort)}
@@ -118,15 +321,20 @@ func (c *client) handleConnectCmd(ctx context.Context) error {
 		return err
 	}
 
+	c.sess.SetReply(int(requestGranted))
 	_, err = c.conn.Write(buf)
 	if err != nil {
 		return fmt.Errorf("could not write reply to the client")
 	}
+	return nil
+}
 
+// relay copies between the client and the destination until one side is done
+func (c *client) relay(serverConn net.Conn) error {
 	errc := make(chan error, 2)
 
 	go func() {
-		_, err := io.Copy(serverConn, c.conn)
+		_, err := io.Copy(serverConn, c.upload(c.conn))
 		if err != nil {
 			err = fmt.Errorf("could not copy from client to server, %v", err)
 		}
@@ -134,14 +342,20 @@ func (c *client) handleConnectCmd(ctx context.Context) error {
 	}()
 
 	go func() {
-		_, err := io.Copy(c.conn, serverConn)
+		_, err := io.Copy(c.conn, c.download(serverConn))
 		if err != nil {
 			err = fmt.Errorf("could not copy from server to client, %v", err)
 		}
 		errc <- err
 	}()
 
-	return <-errc
+	// the traffic is counted until both directions stopped, closing both
+	// connections stops the other one
+	err := <-errc
+	serverConn.Close()
+	c.conn.Close()
+	<-errc
+	return err
 }
 
 func (c *client) handleBindCmd(ctx context.Context) error {
@@ -164,6 +378,7 @@ func (c *client) handleBindCmd(ctx context.Context) error {
 	}
 
 	// first reply
+	c.sess.SetReply(int(requestGranted))
 	_, err = c.conn.Write(buf)
 	if err != nil {
 		c.sendFailure(requestRejectedOrFailed)
@@ -177,6 +392,7 @@ func (c *client) handleBindCmd(ctx context.Context) error {
 		return err
 	}
 	defer bindConn.Close()
+	c.sess.SetDialed(bindConn)
 
 	connectedIP := bindConn.RemoteAddr().(*net.TCPAddr).IP
 	if !net.IP.IsUnspecified(connectedIP) && net.IP.Equal(net.ParseIP(c.req.DestHost), connectedIP) {
@@ -194,7 +410,7 @@ func (c *client) handleBindCmd(ctx context.Context) error {
 	errc := make(chan error, 2)
 
 	go func() {
-		_, err := io.Copy(c.conn, bindConn)
+		_, err := io.Copy(c.conn, c.download(bindConn))
 		if err != nil {
 			err = fmt.Errorf("could not copy from server to client, %v", err)
 		}
@@ -202,7 +418,7 @@ func (c *client) handleBindCmd(ctx context.Context) error {
 	}()
 
 	go func() {
-		_, err := io.Copy(bindConn, c.conn)
+		_, err := io.Copy(bindConn, c.upload(c.conn))
 		if err != nil {
 			err = fmt.Errorf("could not copy from client to server, %v", err)
 		}
@@ -215,6 +431,7 @@ func (c *client) handleBindCmd(ctx context.Context) error {
 func (c *client) sendFailure(code resultCode) error {
 	rep := &reply{resCode: code, bindAddr: "0.0.0.0", bindPort: 0}
 	buf, _ := rep.marshal()
+	c.sess.SetReply(int(code))
 	_, err := c.conn.Write(buf)
 	return err
 }
@@ -222,7 +439,8 @@ func (c *client) sendFailure(code resultCode) error {
 // +----+----+----+----+----+----+----+----+----+----+....+----+
 // | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
 // +----+----+----+----+----+----+----+----+----+----+....+----+
-//    1    1      2              4           variable       1
+//
+//	1    1      2              4           variable       1
 type request struct {
 	cmd         command
 	addressType addrType
@@ -278,7 +496,8 @@ func isDomainUnresolved(ip []byte) bool {
 // +----+----+----+----+----+----+----+----+
 // | VN | CD | DSTPORT |      DSTIP        |
 // +----+----+----+----+----+----+----+----+
-//    1    1      2              4
+//
+//	1    1      2              4
 type reply struct {
 	resCode  resultCode
 	bindAddr string
@@ -0,0 +1,201 @@
+package socks4a
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/utils"
+)
+
+// testResolver answers from a table
+type testResolver map[string][]net.IP
+
+func (r testResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (r testResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	if ips, ok := r[name]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// testConn is a pipe with TCP addresses
+type testConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *testConn) LocalAddr() net.Addr  { return c.local }
+func (c *testConn) RemoteAddr() net.Addr { return c.remote }
+
+// testDialer records the addresses dialed and the first bytes each
+// destination reads, the destinations close once they read something
+type testDialer struct {
+	mu       sync.Mutex
+	dialed   []string
+	received []string
+	wg       sync.WaitGroup
+}
+
+func (d *testDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+	client, server := net.Pipe()
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer server.Close()
+		server.SetDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 4096)
+		n, _ := server.Read(buf)
+		d.mu.Lock()
+		d.received = append(d.received, string(buf[:n]))
+		d.mu.Unlock()
+	}()
+	local := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 40000}
+	remote, _ := net.ResolveTCPAddr("tcp", addr)
+	return &testConn{Conn: client, local: local, remote: remote}, nil
+}
+
+// relayed returns the addresses dialed and what the destinations read, once
+// they are done
+func (d *testDialer) relayed() ([]string, string) {
+	d.wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dialed, strings.Join(d.received, "")
+}
+
+func loadPolicy(t *testing.T, content string) *policy.Policy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// connectRequest is a connect request to an IPv4 address, after the
+// version byte
+func connectRequest(ip string, port uint16) []byte {
+	req := []byte{byte(connect), byte(port >> 8), byte(port)}
+	req = append(req, net.ParseIP(ip).To4()...)
+	return append(req, 0)
+}
+
+// exchange sends req on a client connection and returns the reply code.
+// Payload follows a granted request. The connection is served with the
+// given config.
+func exchange(t *testing.T, config *utils.Config, req []byte, payload string) resultCode {
+	t.Helper()
+	InitConfig(config)
+	client, server := net.Pipe()
+	conn := &testConn{
+		Conn:   server,
+		local:  &net.TCPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1080},
+		remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 50000},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		HandleConnection(conn, nil, nil)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("writing the request: %v", err)
+	}
+	reply := make([]byte, 8)
+	n, err := client.Read(reply)
+	if err != nil || n < 2 {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	if code := resultCode(reply[1]); code != requestGranted || payload == "" {
+		return code
+	}
+	// fails if the server is done with the connection
+	client.Write([]byte(payload))
+	return requestGranted
+}
+
+// clientHello returns the first bytes a TLS client sends for serverName
+func clientHello(t *testing.T, serverName string) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	hello := make([]byte, 4096)
+	n, err := server.Read(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hello[:n])
+}
+
+func TestSniffedConnect(t *testing.T) {
+	allowlist := loadPolicy(t, `{"rules": [
+		{"hosts": ["203.0.113.0/24"], "action": "deny"},
+		{"hosts": ["allowed.example", "hidden.onion"], "action": "allow"}
+	], "default": "deny"}`)
+	remote := func(name string) bool { return name == "hidden.onion" }
+	hello := clientHello(t, "allowed.example")
+	tests := []struct {
+		name        string
+		ip          string
+		payload     string
+		wantCode    resultCode
+		wantDialed  []string
+		wantRelayed bool
+	}{
+		{"allowed name", "192.0.2.1", hello, requestGranted, []string{"192.0.2.1:443"}, true},
+		{"allowed http host", "192.0.2.1", "GET / HTTP/1.1\r\nHost: allowed.example\r\n\r\n", requestGranted, []string{"192.0.2.1:443"}, true},
+		// the name is not one of the address, so only the address counts
+		{"name of another address", "192.0.2.99", hello, requestGranted, []string{"192.0.2.99:443"}, false},
+		{"denied address", "203.0.113.5", hello, requestRejectedOrFailed, nil, false},
+		{"remote name", "192.0.2.99", "GET / HTTP/1.1\r\nHost: hidden.onion\r\n\r\n", requestGranted, []string{"192.0.2.99:443", "hidden.onion:443"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := testResolver{"allowed.example": {net.ParseIP("192.0.2.1")}}
+			dialer := &testDialer{}
+			config := &utils.Config{Resolv: resolver, Dial: dialer.dial, ResolveRemotely: remote, Policy: allowlist, SniffTimeout: 100 * time.Millisecond}
+			if code := exchange(t, config, connectRequest(tt.ip, 443), tt.payload); code != tt.wantCode {
+				t.Errorf("reply %d, want %d", code, tt.wantCode)
+			}
+			dialed, received := dialer.relayed()
+			if strings.Join(dialed, " ") != strings.Join(tt.wantDialed, " ") {
+				t.Errorf("dialed %v, want %v", dialed, tt.wantDialed)
+			}
+			if relayed := received == tt.payload; relayed != tt.wantRelayed {
+				t.Errorf("payload relayed %v, want %v", relayed, tt.wantRelayed)
+			}
+		})
+	}
+}
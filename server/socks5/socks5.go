@@ -10,6 +10,13 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/thifnmi/proxy-socks-server/metrics"
+	"github.com/thifnmi/proxy-socks-server/server/auth"
+	"github.com/thifnmi/proxy-socks-server/server/connlimit"
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/server/quota"
+	"github.com/thifnmi/proxy-socks-server/server/ratelimit"
+	"github.com/thifnmi/proxy-socks-server/server/session"
 	"github.com/thifnmi/proxy-socks-server/utils"
 )
 
@@ -34,6 +41,18 @@ const (
 	udpAssociate command = 3
 )
 
+func (cmd command) String() string {
+	switch cmd {
+	case connect:
+		return policy.CmdConnect
+	case bind:
+		return policy.CmdBind
+	case udpAssociate:
+		return policy.CmdUDPAssociate
+	}
+	return strconv.Itoa(int(cmd))
+}
+
 type addrType byte
 
 const (
@@ -65,18 +84,39 @@ func InitConfig(config *utils.Config) {
 	currConfig = config
 }
 
-func HandleConnection(conn net.Conn) error {
-	c := newClient(conn)
+// HandleConnection serves the request of an authenticated client, the
+// session is described in sess
+func HandleConnection(conn net.Conn, authCtx *auth.AuthContext, sess *session.Session) error {
+	c := newClient(conn, authCtx)
+	c.sess = sess
 	return c.handle()
 }
 
+// Reject answers the request of a connection refused by a connection limit,
+// or because its user is disabled, with a failure. The reply is sent
+// without reading the request so that the connection is not held.
+func Reject(conn net.Conn, reason error) error {
+	c := newClient(conn, nil)
+	code := generalSocksFailure
+	if limitErr, ok := reason.(*connlimit.LimitError); ok && limitErr.Reason == connlimit.ReasonPerUser || reason == session.ErrDisabled {
+		code = connectionNotAllowed
+	}
+	return c.sendFailure(code)
+}
+
 type client struct {
-	conn net.Conn
-	req  *request
+	conn    net.Conn
+	authCtx *auth.AuthContext
+	req     *request
+	// allowed addresses of the destination, nil if the dialer resolves it
+	ips   []net.IP
+	limit *ratelimit.Session
+	usage *quota.Session
+	sess  *session.Session
 }
 
-func newClient(conn net.Conn) *client {
-	return &client{conn: conn}
+func newClient(conn net.Conn, authCtx *auth.AuthContext) *client {
+	return &client{conn: conn, authCtx: authCtx}
 }
 
 func (c *client) handle() error {
@@ -96,22 +136,76 @@ func (c *client) handle() error {
 	}
 	c.req = req
 	ctx := context.Background()
-
-	if c.req.addressType == domainname {
-		resolvedIP, err := currConfig.Resolv.Resolve(ctx, c.req.DestHost)
-		if err != nil {
-			return err
+	metrics.Commands.With("socks5", c.req.cmd.String()).Inc()
+
+	// connections to fake addresses go to the name they were handed out for
+	if ip := net.ParseIP(c.req.DestHost); currConfig.FakeIP.Contains(ip) {
+		name, ok := currConfig.FakeIP.Lookup(ip)
+		if !ok {
+			c.sendFailure(hostUnreachable)
+			return fmt.Errorf("fake ip %s is not mapped to a name", ip)
+		}
+		c.req.addressType = domainname
+		c.req.DestHost = name
+	}
+	requestedHost := c.req.DestHost
+	c.sess.SetRequest(c.req.cmd.String(), requestedHost, c.req.DestPort)
+
+	switch {
+	case c.sniffing():
+		// the policy is checked once the first client bytes may have named the host
+		c.ips = []net.IP{net.ParseIP(c.req.DestHost)}
+	case c.remote():
+		// the dialer resolves the name, the policy only sees the name
+		if !c.allowed(requestedHost, nil) {
+			c.sendFailure(connectionNotAllowed)
+			return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, requestedHost, c.req.DestPort, c.authCtx.Username())
+		}
+	default:
+		ips := []net.IP{net.ParseIP(c.req.DestHost)}
+		if c.req.addressType == domainname {
+			// names the policy denies are not even looked up
+			if currConfig.Policy.DeniesName(c.policyRequest(requestedHost, nil)) {
+				c.sendFailure(connectionNotAllowed)
+				return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, requestedHost, c.req.DestPort, c.authCtx.Username())
+			}
+			start := time.Now()
+			ips, err = utils.LookupAll(ctx, currConfig.Resolv, c.req.DestHost)
+			metrics.DNSResolveDuration.ObserveSince(start, metrics.Result(err))
+			if err != nil {
+				return err
+			}
 		}
 
-		if ip4 := net.IP(resolvedIP).To4(); ip4 != nil {
+		// addresses the policy denies are never dialed
+		for _, ip := range ips {
+			if c.allowed(requestedHost, ip) {
+				c.ips = append(c.ips, ip)
+			}
+		}
+		if len(c.ips) == 0 {
+			c.sendFailure(connectionNotAllowed)
+			return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, requestedHost, c.req.DestPort, c.authCtx.Username())
+		}
+		if ip4 := c.ips[0].To4(); ip4 != nil {
 			c.req.addressType = ipv4
 			c.req.DestHost = ip4.String()
 		} else {
 			c.req.addressType = ipv6
-			c.req.DestHost = net.IP(resolvedIP).To16().String()
+			c.req.DestHost = c.ips[0].To16().String()
 		}
 	}
 
+	if currConfig.Quota.Exceeded(c.authCtx.Username()) {
+		c.sendFailure(connectionNotAllowed)
+		return fmt.Errorf("traffic quota of user %q is exhausted", c.authCtx.Username())
+	}
+
+	c.limit = currConfig.RateLimiter.Open(c.authCtx.Username())
+	defer c.limit.Close()
+	c.usage = currConfig.Quota.Open(c.authCtx.Username(), c.conn)
+	defer c.usage.Close()
+
 	switch c.req.cmd {
 	case connect:
 		return c.handleConnectCmd(ctx)
@@ -125,16 +219,132 @@ func (c *client) handle() error {
 	}
 }
 
+// remote reports whether the destination name is left for the dialer to
+// resolve, which only connect requests do
+func (c *client) remote() bool {
+	return c.req.cmd == connect && c.req.addressType == domainname &&
+		currConfig.ResolveRemotely != nil && currConfig.ResolveRemotely(c.req.DestHost)
+}
+
+// sniffing reports whether the host name of a connect request to an address
+// is looked for in the first client bytes
+func (c *client) sniffing() bool {
+	return c.req.cmd == connect && c.req.addressType != domainname && currConfig.SniffTimeout > 0
+}
+
+// allowed checks the request to one address of the host against the configured policy
+func (c *client) allowed(requestedHost string, ip net.IP) bool {
+	return currConfig.Policy.Allowed(c.policyRequest(requestedHost, ip))
+}
+
+// policyRequest describes the request to one address of the host to the policy
+func (c *client) policyRequest(requestedHost string, ip net.IP) policy.Request {
+	return policy.Request{
+		User:       c.authCtx.Username(),
+		Attributes: c.authCtx.Attributes(),
+		Command:    c.req.cmd.String(),
+		Host:       requestedHost,
+		IP:         ip,
+		Port:       c.req.DestPort,
+	}
+}
+
+// upload wraps a reader of client data with shaping and accounting
+func (c *client) upload(r io.Reader) io.Reader {
+	return c.sess.Upload(metrics.CountReader(c.usage.Upload(c.limit.Upload(r)), metrics.Bytes.With(c.authCtx.Username(), "upload")))
+}
+
+// download wraps a reader of destination data with shaping and accounting
+func (c *client) download(r io.Reader) io.Reader {
+	return c.sess.Download(metrics.CountReader(c.usage.Download(c.limit.Download(r)), metrics.Bytes.With(c.authCtx.Username(), "download")))
+}
+
 func (c *client) handleConnectCmd(ctx context.Context) error {
-	// serverConn, err := net.DialTimeout("tcp", net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort))), timeoutDuration)
-	serverConn, err := currConfig.Dial(ctx, "tcp", net.JoinHostPort(c.req.DestHost, strconv.Itoa(int(c.req.DestPort))))
+	if c.sniffing() {
+		return c.handleSniffedConnect(ctx)
+	}
+	serverConn, err := c.dial(ctx)
 	if err != nil {
 		c.sendFailure(generalSocksFailure)
 		return err
 	}
 	defer serverConn.Close()
 
-	bindAddr, bindPortStr, _ := net.SplitHostPort(serverConn.LocalAddr().String())
+	if err := c.sendSuccess(serverConn.LocalAddr()); err != nil {
+		return err
+	}
+	return c.relay(serverConn)
+}
+
+// handleSniffedConnect dials the address asked for and answers, so that the
+// client sends its first bytes, which may name the host it wants. Requests
+// the address alone is denied for are refused before that. The policy then
+// goes by the name if it resolves to the address, a client may not pick a
+// name the policy allows for any address. A name routed to remote
+// resolution is checked alone and dialed instead of the address.
+func (c *client) handleSniffedConnect(ctx context.Context) error {
+	ip := c.ips[0]
+	if currConfig.Policy.DeniesAddress(c.policyRequest(c.req.DestHost, ip)) {
+		c.sendFailure(connectionNotAllowed)
+		return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, c.req.DestHost, c.req.DestPort, c.authCtx.Username())
+	}
+	serverConn, err := c.dial(ctx)
+	if err != nil {
+		c.sendFailure(generalSocksFailure)
+		return err
+	}
+	defer func() { serverConn.Close() }()
+	if err := c.sendSuccess(serverConn.LocalAddr()); err != nil {
+		return err
+	}
+
+	host, conn := utils.Sniff(c.conn, currConfig.SniffTimeout)
+	c.conn = conn
+	requestedHost := c.req.DestHost
+	switch {
+	case host == "":
+	case currConfig.ResolveRemotely != nil && currConfig.ResolveRemotely(host):
+		if !c.allowed(host, nil) {
+			return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, host, c.req.DestPort, c.authCtx.Username())
+		}
+		serverConn.Close()
+		c.ips = nil
+		c.req.DestHost = host
+		if serverConn, err = c.dial(ctx); err != nil {
+			return err
+		}
+		return c.relay(serverConn)
+	case utils.ResolvesTo(ctx, currConfig.Resolv, host, ip):
+		requestedHost = host
+	}
+	if !c.allowed(requestedHost, ip) {
+		return fmt.Errorf("%s to %s:%d is not allowed for user %q", c.req.cmd, requestedHost, c.req.DestPort, c.authCtx.Username())
+	}
+	return c.relay(serverConn)
+}
+
+// dial connects to the allowed addresses of the destination, or lets the
+// dialer resolve its name
+func (c *client) dial(ctx context.Context) (net.Conn, error) {
+	// serverConn, err := net.DialTimeout("tcp", net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort))), timeoutDuration)
+	start := time.Now()
+	var serverConn net.Conn
+	var err error
+	if c.ips == nil {
+		serverConn, err = currConfig.Dial(ctx, "tcp", net.JoinHostPort(c.req.DestHost, strconv.Itoa(int(c.req.DestPort))))
+	} else {
+		serverConn, err = currConfig.HappyEyeballs.Dial(ctx, currConfig.Dial, "tcp", c.ips, c.req.DestPort)
+	}
+	metrics.DialDuration.ObserveSince(start, metrics.Result(err))
+	if err == nil {
+		c.sess.SetDialed(serverConn)
+	}
+	return serverConn, err
+}
+
+// sendSuccess answers the request with the address the server uses
+func (c *client) sendSuccess(addr net.Addr) error {
+	bindAddr, bindPortStr, _ := net.SplitHostPort(addr.String())
 	var addressType addrType
 	if ip := net.ParseIP(bindAddr); ip != nil {
 		if ip.To4() != nil {
@@ -154,15 +364,17 @@ func (c *client) handleConnectCmd(ctx context.Context) error {
 		return err
 	}
 
+	c.sess.SetReply(int(succeeded))
 	_, err = c.conn.Write(buf)
-	if err != nil {
-		return err
-	}
+	return err
+}
 
+// relay copies between the client and the destination until one side is done
+func (c *client) relay(serverConn net.Conn) error {
 	errc := make(chan error, 2)
 
 	go func() {
-		_, err := io.Copy(serverConn, c.conn)
+		_, err := io.Copy(serverConn, c.upload(c.conn))
 		if err != nil {
 			err = fmt.Errorf("could not copy from client to server, %v", err)
 		}
@@ -170,14 +382,20 @@ func (c *client) handleConnectCmd(ctx context.Context) error {
 	}()
 
 	go func() {
-		_, err := io.Copy(c.conn, serverConn)
+		_, err := io.Copy(c.conn, c.download(serverConn))
 		if err != nil {
 			err = fmt.Errorf("could not copy from server to client, %v", err)
 		}
 		errc <- err
 	}()
 
-	return <-errc
+	// the traffic is counted until both directions stopped, closing both
+	// connections stops the other one
+	err := <-errc
+	serverConn.Close()
+	c.conn.Close()
+	<-errc
+	return err
 }
 
 func (c *client) handleBindCmd(ctx context.Context) error {
@@ -209,6 +427,7 @@ func (c *client) handleUDPAssociateCmd(ctx context.Context) error {
 		c.sendFailure(generalSocksFailure)
 		return err
 	}
+	c.sess.SetReply(int(succeeded))
 	_, err = c.conn.Write(replyBuf)
 	if err != nil {
 		return err
@@ -246,19 +465,39 @@ func (c *client) handleUDPAssociateCmd(ctx context.Context) error {
 		}
 
 		if net.IP.Equal(senderAddr.IP, associatedAddr.IP) {
+			// datagrams that are malformed, fragmented, denied or can not
+			// be resolved are dropped, the association goes on. So are those
+			// of both directions once the quota ran out.
 			req, err := parseUDPAssociateRequest(buf[:n])
+			if err != nil || req.fragmentNumber != 0 || currConfig.Quota.Exceeded(c.authCtx.Username()) {
+				continue
+			}
+			destAddr, err := c.udpDestination(ctx, req)
 			if err != nil {
-				return err
+				continue
 			}
-			_, err = udpRelaySrv.WriteToUDP(buf[req.payloadIndex:n], req.destAddr)
+			c.limit.WaitUpload(n - req.payloadIndex)
+			c.usage.AddUpload(n - req.payloadIndex)
+			c.sess.AddUpload(n - req.payloadIndex)
+			metrics.Bytes.With(c.authCtx.Username(), "upload").Add(uint64(n - req.payloadIndex))
+			metrics.UDPPackets.With("upload").Inc()
+			_, err = udpRelaySrv.WriteToUDP(buf[req.payloadIndex:n], destAddr)
 			if err != nil {
 				return err
 			}
 		} else {
+			if currConfig.Quota.Exceeded(c.authCtx.Username()) {
+				continue
+			}
 			packet, err := udpAssociateReply(senderAddr, buf[:n])
 			if err != nil {
 				return err
 			}
+			c.limit.WaitDownload(n)
+			c.usage.AddDownload(n)
+			c.sess.AddDownload(n)
+			metrics.Bytes.With(c.authCtx.Username(), "download").Add(uint64(n))
+			metrics.UDPPackets.With("download").Inc()
 			_, err = udpRelaySrv.WriteToUDP(packet, associatedUDPAddr)
 			if err != nil {
 				return err
@@ -267,39 +506,84 @@ func (c *client) handleUDPAssociateCmd(ctx context.Context) error {
 	}
 }
 
+// udpDestination resolves the destination of a datagram the way connect
+// requests are: a fake address goes to its name, a name the policy denies
+// is not looked up and the first allowed IPv4 address is used
+func (c *client) udpDestination(ctx context.Context, req *udpAssociateRequest) (*net.UDPAddr, error) {
+	host := req.destHost
+	if ip := net.ParseIP(host); currConfig.FakeIP.Contains(ip) {
+		name, ok := currConfig.FakeIP.Lookup(ip)
+		if !ok {
+			return nil, fmt.Errorf("fake ip %s is not mapped to a name", ip)
+		}
+		host = name
+	}
+	policyRequest := func(ip net.IP) policy.Request {
+		r := c.policyRequest(host, ip)
+		r.Port = req.destPort
+		return r
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if currConfig.Policy.DeniesName(policyRequest(nil)) {
+			return nil, fmt.Errorf("udp to %s:%d is not allowed for user %q", host, req.destPort, c.authCtx.Username())
+		}
+		var err error
+		start := time.Now()
+		ips, err = utils.LookupAll(ctx, currConfig.Resolv, host)
+		metrics.DNSResolveDuration.ObserveSince(start, metrics.Result(err))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		// the relay socket is IPv4 only
+		if ip4 := ip.To4(); ip4 != nil && currConfig.Policy.Allowed(policyRequest(ip4)) {
+			return &net.UDPAddr{IP: ip4, Port: int(req.destPort)}, nil
+		}
+	}
+	return nil, fmt.Errorf("udp to %s:%d is not allowed for user %q", host, req.destPort, c.authCtx.Username())
+}
+
 type udpAssociateRequest struct {
 	fragmentNumber byte
 	addressType    addrType
-	destAddr       *net.UDPAddr
+	destHost       string
+	destPort       uint16
 	payloadIndex   int
 }
 
 func parseUDPAssociateRequest(b []byte) (*udpAssociateRequest, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("udp associate request too short")
+	}
 	fragmentNumber := b[2]
 	addressType := addrType(b[3])
 	var payloadIndex int
-	var host string
 	switch addressType {
 	case ipv4:
-		host = net.IP(b[4:8]).String()
 		payloadIndex = 10
 	case domainname:
-		length := int(b[4])
-		host = string(b[5 : length+5])
-		payloadIndex = length + 7
+		payloadIndex = int(b[4]) + 7
 	case ipv6:
-		host = net.IP(b[4:20]).String()
 		payloadIndex = 22
 	default:
 		return nil, fmt.Errorf("invalid address type code -> (%v) <-", addressType)
 	}
-	portIndex := payloadIndex - 2
-	port := binary.BigEndian.Uint16(b[portIndex : portIndex+2])
-	destAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
-	if err != nil {
-		return nil, fmt.Errorf("invalid destination in the udp associate request")
+	if len(b) < payloadIndex {
+		return nil, fmt.Errorf("udp associate request too short")
+	}
+	var host string
+	switch addressType {
+	case ipv4:
+		host = net.IP(b[4:8]).String()
+	case domainname:
+		host = string(b[5 : payloadIndex-2])
+	case ipv6:
+		host = net.IP(b[4:20]).String()
 	}
-	return &udpAssociateRequest{fragmentNumber: fragmentNumber, addressType: addressType, destAddr: destAddr, payloadIndex: payloadIndex}, nil
+	port := binary.BigEndian.Uint16(b[payloadIndex-2 : payloadIndex])
+	return &udpAssociateRequest{fragmentNumber: fragmentNumber, addressType: addressType, destHost: host, destPort: port, payloadIndex: payloadIndex}, nil
 }
 
 func udpAssociateReply(addr *net.UDPAddr, payload []byte) ([]byte, error) {
@@ -326,6 +610,7 @@ func (c *client) sendFailure(code resultCode) error {
 	// rep := &reply{resCode: code}
 	rep := &reply{resCode: code, addressType: ipv4, bindAddr: "0.0.0.0", bindPort: 0}
 	buf, _ := rep.marshal()
+	c.sess.SetReply(int(code))
 	_, err := c.conn.Write(buf)
 	return err
 }
@@ -0,0 +1,391 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/utils"
+)
+
+// testResolver answers every name with its addresses and counts lookups
+type testResolver struct {
+	mu      sync.Mutex
+	ips     map[string][]net.IP
+	lookups []string
+}
+
+func (r *testResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (r *testResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups = append(r.lookups, name)
+	if ips, ok := r.ips[name]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// testConn is a pipe with TCP addresses
+type testConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *testConn) LocalAddr() net.Addr  { return c.local }
+func (c *testConn) RemoteAddr() net.Addr { return c.remote }
+
+// testDialer records the addresses dialed and the first bytes each
+// destination reads, the destinations close once they read something
+type testDialer struct {
+	mu       sync.Mutex
+	dialed   []string
+	received []string
+	wg       sync.WaitGroup
+}
+
+func (d *testDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+	client, server := net.Pipe()
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer server.Close()
+		server.SetDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 4096)
+		n, _ := server.Read(buf)
+		d.mu.Lock()
+		d.received = append(d.received, string(buf[:n]))
+		d.mu.Unlock()
+	}()
+	local := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 40000}
+	remote, _ := net.ResolveTCPAddr("tcp", addr)
+	return &testConn{Conn: client, local: local, remote: remote}, nil
+}
+
+func (d *testDialer) addrs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.dialed...)
+}
+
+// relayed returns what the destinations read, once they are done
+func (d *testDialer) relayed() string {
+	d.wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return strings.Join(d.received, "")
+}
+
+func loadPolicy(t *testing.T, content string) *policy.Policy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func connectRequest(host string, port uint16) []byte {
+	req := []byte{socksServerVersion, byte(connect), 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, byte(ipv4)), ip4...)
+		} else {
+			req = append(append(req, byte(ipv6)), ip.To16()...)
+		}
+	} else {
+		req = append(req, byte(domainname), byte(len(host)))
+		req = append(req, host...)
+	}
+	return append(req, byte(port>>8), byte(port))
+}
+
+// exchange sends req on a client connection and returns the reply code.
+// Payload follows a successful reply. The connection is served with the
+// given config.
+func exchange(t *testing.T, config *utils.Config, req []byte, payload string) resultCode {
+	t.Helper()
+	InitConfig(config)
+	client, server := net.Pipe()
+	conn := &testConn{
+		Conn:   server,
+		local:  &net.TCPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1080},
+		remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 50000},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		HandleConnection(conn, nil, nil)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("writing the request: %v", err)
+	}
+	reply := make([]byte, 512)
+	n, err := client.Read(reply)
+	if err != nil || n < 2 {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	if code := resultCode(reply[1]); code != succeeded || payload == "" {
+		return code
+	}
+	// fails if the server is done with the connection
+	client.Write([]byte(payload))
+	return succeeded
+}
+
+func TestRemoteResolution(t *testing.T) {
+	blocked := loadPolicy(t, `{"rules": [{"hosts": ["blocked.example"], "action": "deny"}], "default": "allow"}`)
+	remote := func(name string) bool { return name != "local.example" }
+	tests := []struct {
+		name        string
+		host        string
+		remote      func(string) bool
+		policy      *policy.Policy
+		wantCode    resultCode
+		wantDialed  []string
+		wantLookups int
+	}{
+		{"remote name", "example.com", remote, nil, succeeded, []string{"example.com:443"}, 0},
+		{"local name", "local.example", remote, nil, succeeded, []string{"192.0.2.1:443"}, 1},
+		{"resolved locally without remote mode", "example.com", nil, nil, succeeded, []string{"192.0.2.1:443"}, 1},
+		{"remote name denied", "blocked.example", remote, blocked, connectionNotAllowed, nil, 0},
+		{"denied name not looked up", "blocked.example", nil, blocked, connectionNotAllowed, nil, 0},
+		{"address", "192.0.2.7", remote, nil, succeeded, []string{"192.0.2.7:443"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &testResolver{ips: map[string][]net.IP{
+				"example.com":     {net.ParseIP("192.0.2.1")},
+				"local.example":   {net.ParseIP("192.0.2.1")},
+				"blocked.example": {net.ParseIP("192.0.2.1")},
+			}}
+			dialer := &testDialer{}
+			config := &utils.Config{Resolv: resolver, Dial: dialer.dial, ResolveRemotely: tt.remote, Policy: tt.policy}
+			if code := exchange(t, config, connectRequest(tt.host, 443), ""); code != tt.wantCode {
+				t.Errorf("reply %d, want %d", code, tt.wantCode)
+			}
+			dialed := dialer.addrs()
+			if len(dialed) != len(tt.wantDialed) || len(dialed) > 0 && dialed[0] != tt.wantDialed[0] {
+				t.Errorf("dialed %v, want %v", dialed, tt.wantDialed)
+			}
+			if len(resolver.lookups) != tt.wantLookups {
+				t.Errorf("looked up %v, want %d lookups", resolver.lookups, tt.wantLookups)
+			}
+		})
+	}
+}
+
+// clientHello returns the first bytes a TLS client sends for serverName
+func clientHello(t *testing.T, serverName string) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	hello := make([]byte, 4096)
+	n, err := server.Read(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hello[:n])
+}
+
+func TestSniffedConnect(t *testing.T) {
+	allowlist := loadPolicy(t, `{"rules": [
+		{"hosts": ["203.0.113.0/24"], "action": "deny"},
+		{"hosts": ["allowed.example", "hidden.onion"], "action": "allow"}
+	], "default": "deny"}`)
+	remote := func(name string) bool { return name == "hidden.onion" }
+	hello := clientHello(t, "allowed.example")
+	tests := []struct {
+		name        string
+		host        string
+		payload     string
+		wantCode    resultCode
+		wantDialed  []string
+		wantRelayed bool
+	}{
+		{"allowed name", "192.0.2.1", hello, succeeded, []string{"192.0.2.1:443"}, true},
+		{"allowed http host", "192.0.2.1", "GET / HTTP/1.1\r\nHost: allowed.example\r\n\r\n", succeeded, []string{"192.0.2.1:443"}, true},
+		// the name is not one of the address, so only the address counts
+		{"name of another address", "192.0.2.99", hello, succeeded, []string{"192.0.2.99:443"}, false},
+		{"no name", "192.0.2.1", "SSH-2.0-test\r\n", succeeded, []string{"192.0.2.1:443"}, false},
+		{"denied address", "203.0.113.5", hello, connectionNotAllowed, nil, false},
+		{"remote name", "192.0.2.99", "GET / HTTP/1.1\r\nHost: hidden.onion\r\n\r\n", succeeded, []string{"192.0.2.99:443", "hidden.onion:443"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &testResolver{ips: map[string][]net.IP{
+				"allowed.example": {net.ParseIP("192.0.2.1")},
+			}}
+			dialer := &testDialer{}
+			config := &utils.Config{Resolv: resolver, Dial: dialer.dial, ResolveRemotely: remote, Policy: allowlist, SniffTimeout: 100 * time.Millisecond}
+			if code := exchange(t, config, connectRequest(tt.host, 443), tt.payload); code != tt.wantCode {
+				t.Errorf("reply %d, want %d", code, tt.wantCode)
+			}
+			if dialed := dialer.addrs(); strings.Join(dialed, " ") != strings.Join(tt.wantDialed, " ") {
+				t.Errorf("dialed %v, want %v", dialed, tt.wantDialed)
+			}
+			if relayed := dialer.relayed() == tt.payload; relayed != tt.wantRelayed {
+				t.Errorf("payload relayed %v, want %v", relayed, tt.wantRelayed)
+			}
+		})
+	}
+}
+
+// udpDatagram returns a datagram the client sends to host and port
+func udpDatagram(host string, port uint16, payload string) []byte {
+	// a connect request holds the address the same way
+	req := connectRequest(host, port)
+	return append(append([]byte{0, 0, 0}, req[3:]...), payload...)
+}
+
+func TestParseUDPAssociateRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		datagram    []byte
+		wantHost    string
+		wantPort    uint16
+		wantPayload string
+		wantErr     bool
+	}{
+		{"ipv4", udpDatagram("192.0.2.1", 53, "query"), "192.0.2.1", 53, "query", false},
+		{"ipv6", udpDatagram("2001:db8::1", 53, "query"), "2001:db8::1", 53, "query", false},
+		{"name", udpDatagram("example.com", 443, "hello"), "example.com", 443, "hello", false},
+		{"empty payload", udpDatagram("example.com", 443, ""), "example.com", 443, "", false},
+		{"too short", []byte{0, 0, 0}, "", 0, "", true},
+		{"truncated address", udpDatagram("2001:db8::1", 53, "")[:12], "", 0, "", true},
+		{"truncated name", udpDatagram("example.com", 443, "")[:10], "", 0, "", true},
+		{"address type", []byte{0, 0, 0, 9, 0, 0, 0, 0, 0, 0}, "", 0, "", true},
+	}
+	for _, tt := range tests {
+		req, err := parseUDPAssociateRequest(tt.datagram)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if req.destHost != tt.wantHost || req.destPort != tt.wantPort || string(tt.datagram[req.payloadIndex:]) != tt.wantPayload {
+			t.Errorf("%s: parsed %s:%d %q, want %s:%d %q", tt.name, req.destHost, req.destPort, tt.datagram[req.payloadIndex:], tt.wantHost, tt.wantPort, tt.wantPayload)
+		}
+	}
+}
+
+func TestUDPDestination(t *testing.T) {
+	fakeIPs, err := utils.NewFakeIPPool("198.18.0.0/15", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeIP, _, err := fakeIPs.Assign("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := loadPolicy(t, `{"rules": [
+		{"hosts": ["blocked.example"], "action": "deny"},
+		{"hosts": ["10.0.0.0/8"], "action": "deny"},
+		{"ports": ["25"], "action": "deny"}
+	]}`)
+	tests := []struct {
+		name        string
+		host        string
+		port        uint16
+		want        string
+		wantLookups []string
+	}{
+		{"address", "192.0.2.7", 53, "192.0.2.7:53", nil},
+		{"name", "example.com", 53, "192.0.2.1:53", []string{"example.com"}},
+		{"ipv4 address of a name", "dual.example", 53, "192.0.2.2:53", []string{"dual.example"}},
+		{"denied address of a name skipped", "mixed.example", 53, "192.0.2.3:53", []string{"mixed.example"}},
+		{"fake address", fakeIP.String(), 53, "192.0.2.1:53", []string{"example.com"}},
+		{"denied name not looked up", "blocked.example", 53, "", nil},
+		{"denied address", "10.1.1.1", 53, "", nil},
+		{"denied port", "example.com", 25, "", nil},
+		{"unknown name", "missing.example", 53, "", []string{"missing.example"}},
+		{"ipv6 only", "v6.example", 53, "", []string{"v6.example"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &testResolver{ips: map[string][]net.IP{
+				"example.com":     {net.ParseIP("192.0.2.1")},
+				"dual.example":    {net.ParseIP("2001:db8::2"), net.ParseIP("192.0.2.2")},
+				"mixed.example":   {net.ParseIP("10.0.0.3"), net.ParseIP("192.0.2.3")},
+				"blocked.example": {net.ParseIP("192.0.2.4")},
+				"v6.example":      {net.ParseIP("2001:db8::5")},
+			}}
+			InitConfig(&utils.Config{Resolv: resolver, Policy: p, FakeIP: fakeIPs})
+			c := &client{req: &request{cmd: udpAssociate}}
+			req, err := parseUDPAssociateRequest(udpDatagram(tt.host, tt.port, "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, err := c.udpDestination(context.Background(), req)
+			got := ""
+			if err == nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("destination %q (%v), want %q", got, err, tt.want)
+			}
+			if strings.Join(resolver.lookups, ",") != strings.Join(tt.wantLookups, ",") {
+				t.Errorf("looked up %v, want %v", resolver.lookups, tt.wantLookups)
+			}
+		})
+	}
+}
+
+func TestRelayWaitsForBothDirections(t *testing.T) {
+	clientConn, clientEnd := net.Pipe()
+	serverConn, serverEnd := net.Pipe()
+	c := newClient(clientConn, nil)
+	done := make(chan error, 1)
+	go func() { done <- c.relay(serverConn) }()
+
+	go serverEnd.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(clientEnd, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+	// the client leaving ends the upload, the download must stop too
+	clientEnd.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("relay did not return")
+	}
+	if _, err := serverEnd.Write([]byte("late")); err == nil {
+		t.Error("destination still relayed after relay returned")
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/server/connlimit"
+	"github.com/thifnmi/proxy-socks-server/utils"
+)
+
+func TestLimitReply(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    connlimit.Limits
+		hello     []byte
+		wantReply []byte
+	}{
+		{"global socks5", connlimit.Limits{Global: 1}, []byte{5, 1, 0}, []byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"per ip socks5", connlimit.Limits{PerIP: 1}, []byte{5, 1, 0}, []byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"global socks4", connlimit.Limits{Global: 1}, []byte{4, 1, 0, 80, 192, 0, 2, 1, 0}, []byte{0, 91, 0, 0, 0, 0, 0, 0}},
+		{"per ip socks4", connlimit.Limits{PerIP: 1}, []byte{4, 1, 0, 80, 192, 0, 2, 1, 0}, []byte{0, 91, 0, 0, 0, 0, 0, 0}},
+		{"other version", connlimit.Limits{Global: 1}, []byte{6}, []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := connlimit.New(tt.limits)
+			s := NewSocksServer(&utils.Config{ConnLimiter: limiter})
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go s.Serve(l)
+
+			// takes the only session
+			first, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			for deadline := time.Now().Add(time.Second); limiter.Active() == 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write(tt.hello); err != nil {
+				t.Fatal(err)
+			}
+			// the reply, then the connection is closed
+			reply, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reply, tt.wantReply) {
+				t.Errorf("reply % x, want % x", reply, tt.wantReply)
+			}
+		})
+	}
+}
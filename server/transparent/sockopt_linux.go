@@ -0,0 +1,152 @@
+package transparent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST of linux/netfilter_ipv4.h, IP6T_SO_ORIGINAL_DST has the same value
+const soOriginalDst = 80
+
+// originalDst returns the destination a REDIRECT rule rewrote
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			// a sockaddr_in fits in the IPv6Mreq buffer
+			var mreq *unix.IPv6Mreq
+			if mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst); sockErr == nil {
+				b := mreq.Multiaddr[:]
+				addr = &net.TCPAddr{IP: net.IP(append([]byte(nil), b[4:8]...)), Port: int(binary.BigEndian.Uint16(b[2:4]))}
+			}
+			return
+		}
+		// and a sockaddr_in6 in the IPv6MTUInfo one
+		var info *unix.IPv6MTUInfo
+		if info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst); sockErr == nil {
+			// the port is in network byte order
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{IP: net.IP(append([]byte(nil), info.Addr.Addr[:]...)), Port: int(binary.BigEndian.Uint16(port[:]))}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// setTransparent lets a socket accept connections to, or bind, addresses
+// that are not local, as TPROXY requires. UDP sockets also get the original
+// destination of each datagram.
+func setTransparent(network string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		level, transparent, recvOrigDst := unix.SOL_IP, unix.IP_TRANSPARENT, unix.IP_RECVORIGDSTADDR
+		if network == "tcp6" || network == "udp6" {
+			level, transparent, recvOrigDst = unix.SOL_IPV6, unix.IPV6_TRANSPARENT, unix.IPV6_RECVORIGDSTADDR
+		}
+		if sockErr = unix.SetsockoptInt(int(fd), level, transparent, 1); sockErr != nil {
+			sockErr = fmt.Errorf("set transparent socket option, CAP_NET_ADMIN is required: %w", sockErr)
+			return
+		}
+		udp := network == "udp4" || network == "udp6"
+		if udp {
+			if sockErr = unix.SetsockoptInt(int(fd), level, recvOrigDst, 1); sockErr != nil {
+				return
+			}
+			// reply sockets of several sessions bind the same destination
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+				return
+			}
+		}
+		if level == unix.SOL_IPV6 {
+			// dual stack sockets also take IPv4 traffic, single stack ones refuse these
+			unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			if udp {
+				unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Listen opens a TCP listener, tproxy makes it accept the connections a
+// TPROXY rule sends to it
+func Listen(addr string, tproxy bool) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if tproxy {
+		config.Control = func(network, _ string, c syscall.RawConn) error {
+			return setTransparent(network, c)
+		}
+	}
+	return config.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenUDP opens the UDP socket a TPROXY rule sends datagrams to
+func ListenUDP(addr string) (*net.UDPConn, error) {
+	config := net.ListenConfig{Control: func(network, _ string, c syscall.RawConn) error {
+		return setTransparent(network, c)
+	}}
+	conn, err := config.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// dialReply binds a socket to the original destination of a datagram and
+// connects it to the client, so that answers reach the client from the
+// address it sent to. Being connected, it only takes later datagrams of
+// that client that the kernel hands to it instead of the ListenUDP socket.
+func dialReply(dst, client *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if dst.IP.To4() == nil {
+		network = "udp6"
+	}
+	dialer := net.Dialer{LocalAddr: dst, Control: func(network, _ string, c syscall.RawConn) error {
+		return setTransparent(network, c)
+	}}
+	conn, err := dialer.Dial(network, client.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// origDstFromOOB returns the original destination carried in the control
+// message of a datagram read from a ListenUDP socket
+func origDstFromOOB(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_RECVORIGDSTADDR && len(msg.Data) >= 8:
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), msg.Data[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_RECVORIGDSTADDR && len(msg.Data) >= 24:
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), msg.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("datagram carries no original destination")
+}
@@ -0,0 +1,57 @@
+package transparent
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// controlMessage builds a control message carrying data
+func controlMessage(level, typ int32, data []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = level
+	h.Type = typ
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
+
+func TestOrigDstFromOOB(t *testing.T) {
+	in4 := make([]byte, 16)
+	binary.LittleEndian.PutUint16(in4, unix.AF_INET)
+	binary.BigEndian.PutUint16(in4[2:], 53)
+	copy(in4[4:], net.ParseIP("192.0.2.1").To4())
+	in6 := make([]byte, 28)
+	binary.LittleEndian.PutUint16(in6, unix.AF_INET6)
+	binary.BigEndian.PutUint16(in6[2:], 443)
+	copy(in6[8:], net.ParseIP("2001:db8::1"))
+
+	tests := []struct {
+		name    string
+		oob     []byte
+		want    string
+		wantErr bool
+	}{
+		{"ipv4", controlMessage(unix.SOL_IP, unix.IP_RECVORIGDSTADDR, in4), "192.0.2.1:53", false},
+		{"ipv6", controlMessage(unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, in6), "[2001:db8::1]:443", false},
+		{"after another message", append(controlMessage(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0}), controlMessage(unix.SOL_IP, unix.IP_RECVORIGDSTADDR, in4)...), "192.0.2.1:53", false},
+		{"short", controlMessage(unix.SOL_IP, unix.IP_RECVORIGDSTADDR, in4[:4]), "", true},
+		{"other message", controlMessage(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0}), "", true},
+		{"none", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := origDstFromOOB(tt.oob)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("origDstFromOOB() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && dst.String() != tt.want {
+				t.Errorf("origDstFromOOB() = %s, want %s", dst, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"errors"
+	"net"
+)
+
+var errUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errUnsupported
+}
+
+// Listen opens a TCP listener, tproxy makes it accept the connections a
+// TPROXY rule sends to it
+func Listen(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errUnsupported
+}
+
+// ListenUDP opens the UDP socket a TPROXY rule sends datagrams to
+func ListenUDP(addr string) (*net.UDPConn, error) {
+	return nil, errUnsupported
+}
+
+func dialReply(dst, client *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errUnsupported
+}
+
+func origDstFromOOB(oob []byte) (*net.UDPAddr, error) {
+	return nil, errUnsupported
+}
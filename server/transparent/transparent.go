@@ -0,0 +1,193 @@
+// Package transparent relays the connections and datagrams that iptables
+// REDIRECT or TPROXY rules send to the server to their original
+// destinations, without a SOCKS handshake. They pass the same policy,
+// resolution and dialing as SOCKS requests, as an anonymous user.
+package transparent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/metrics"
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/server/ratelimit"
+	"github.com/thifnmi/proxy-socks-server/server/session"
+	"github.com/thifnmi/proxy-socks-server/utils"
+)
+
+var currConfig *utils.Config
+
+func InitConfig(config *utils.Config) {
+	currConfig = config
+}
+
+// HandleConnection relays a redirected connection, described in sess.
+// Connections made to the listener at listenAddr directly are refused.
+func HandleConnection(conn net.Conn, listenAddr net.Addr, sess *session.Session) error {
+	dst, err := destination(conn, listenAddr)
+	if err != nil {
+		return err
+	}
+	c := &client{conn: conn, dst: dst, sess: sess}
+	return c.handle()
+}
+
+// destination returns where a connection was originally headed
+func destination(conn net.Conn, listenAddr net.Addr) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("transparent connection from %s is not a TCP connection", conn.RemoteAddr())
+	}
+	dst, err := originalDst(tcpConn)
+	if err != nil {
+		// TPROXY keeps the original destination as the local address
+		dst = tcpConn.LocalAddr().(*net.TCPAddr)
+	}
+	if listen, ok := listenAddr.(*net.TCPAddr); ok && dst.Port == listen.Port && isLocal(dst.IP) {
+		return nil, fmt.Errorf("connection from %s was made to the transparent listener itself", conn.RemoteAddr())
+	}
+	return dst, nil
+}
+
+func isLocal(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the host to dial and its allowed addresses, none if the
+// dialer resolves the host. A fake address is replaced by its name, which
+// is resolved unless the dialer does it. A sniffed name routed to remote
+// resolution is dialed, any other only decides the policy if it resolves to
+// the address, which is kept.
+func target(ctx context.Context, ip net.IP, sniffed string, port uint16, command string) (string, []net.IP, error) {
+	host := sniffed
+	ips := []net.IP{ip}
+	if currConfig.FakeIP.Contains(ip) {
+		name, ok := currConfig.FakeIP.Lookup(ip)
+		if !ok {
+			return "", nil, fmt.Errorf("fake ip %s is not mapped to a name", ip)
+		}
+		host, ips = name, nil
+	}
+	remote := func(host string) bool {
+		return currConfig.ResolveRemotely != nil && currConfig.ResolveRemotely(host)
+	}
+	if sniffed != "" && ips != nil && !remote(sniffed) && !utils.ResolvesTo(ctx, currConfig.Resolv, sniffed, ip) {
+		// the client may claim any name, the address decides
+		host = ""
+	}
+	if host == "" {
+		host = ip.String()
+	}
+	req := policy.Request{Command: command, Host: host, Port: port}
+
+	if host != ip.String() && remote(host) {
+		// the dialer resolves the name, the policy only sees the name
+		if !currConfig.Policy.Allowed(req) {
+			return "", nil, fmt.Errorf("%s to %s:%d is not allowed", command, host, port)
+		}
+		return host, nil, nil
+	}
+
+	if ips == nil {
+		// names the policy denies are not even looked up
+		if currConfig.Policy.DeniesName(req) {
+			return "", nil, fmt.Errorf("%s to %s:%d is not allowed", command, host, port)
+		}
+		var err error
+		start := time.Now()
+		ips, err = utils.LookupAll(ctx, currConfig.Resolv, host)
+		metrics.DNSResolveDuration.ObserveSince(start, metrics.Result(err))
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	// addresses the policy denies are never dialed
+	var allowed []net.IP
+	for _, ip := range ips {
+		req.IP = ip
+		if currConfig.Policy.Allowed(req) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return "", nil, fmt.Errorf("%s to %s:%d is not allowed", command, host, port)
+	}
+	return host, allowed, nil
+}
+
+type client struct {
+	conn  net.Conn
+	dst   *net.TCPAddr
+	limit *ratelimit.Session
+	sess  *session.Session
+}
+
+func (c *client) handle() error {
+	ctx := context.Background()
+	port := uint16(c.dst.Port)
+	metrics.Commands.With("transparent", policy.CmdConnect).Inc()
+	// the first client bytes may name the host of an address
+	var sniffed string
+	if currConfig.SniffTimeout > 0 && !currConfig.FakeIP.Contains(c.dst.IP) {
+		sniffed, c.conn = utils.Sniff(c.conn, currConfig.SniffTimeout)
+	}
+	c.sess.SetRequest(policy.CmdConnect, c.dst.IP.String(), port)
+	host, ips, err := target(ctx, c.dst.IP, sniffed, port, policy.CmdConnect)
+	if err != nil {
+		return err
+	}
+	c.sess.SetRequest(policy.CmdConnect, host, port)
+
+	c.limit = currConfig.RateLimiter.Open("")
+	defer c.limit.Close()
+
+	start := time.Now()
+	var serverConn net.Conn
+	if ips == nil {
+		serverConn, err = currConfig.Dial(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	} else {
+		serverConn, err = currConfig.HappyEyeballs.Dial(ctx, currConfig.Dial, "tcp", ips, port)
+	}
+	metrics.DialDuration.ObserveSince(start, metrics.Result(err))
+	if err != nil {
+		return err
+	}
+	defer serverConn.Close()
+	c.sess.SetDialed(serverConn)
+
+	errc := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(serverConn, c.sess.Upload(metrics.CountReader(c.limit.Upload(c.conn), metrics.Bytes.With("", "upload"))))
+		if err != nil {
+			err = fmt.Errorf("could not copy from client to server, %v", err)
+		}
+		errc <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(c.conn, c.sess.Download(metrics.CountReader(c.limit.Download(serverConn), metrics.Bytes.With("", "download"))))
+		if err != nil {
+			err = fmt.Errorf("could not copy from server to client, %v", err)
+		}
+		errc <- err
+	}()
+
+	return <-errc
+}
@@ -0,0 +1,181 @@
+package transparent
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/utils"
+)
+
+// testResolver answers from a table
+type testResolver map[string][]net.IP
+
+func (r testResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (r testResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	if ips, ok := r[name]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func loadPolicy(t *testing.T, content string) *policy.Policy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// accept returns the server side of a local TCP connection to listener
+func accept(t *testing.T, listener net.Listener) net.Conn {
+	t.Helper()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestDestination(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pipe, _ := net.Pipe()
+	defer pipe.Close()
+
+	tests := []struct {
+		name       string
+		conn       net.Conn
+		listenAddr net.Addr
+		wantErr    bool
+	}{
+		// without a REDIRECT rule the local address is the destination
+		{"tproxy", accept(t, listener), &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 1}, false},
+		{"no listen address", accept(t, listener), nil, false},
+		{"made to the listener", accept(t, listener), listener.Addr(), true},
+		{"made to the listener on any address", accept(t, listener), &net.TCPAddr{IP: net.IPv4zero, Port: listener.Addr().(*net.TCPAddr).Port}, true},
+		{"not tcp", pipe, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := destination(tt.conn, tt.listenAddr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("destination() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && dst.String() != tt.conn.LocalAddr().String() {
+				t.Errorf("destination() = %s, want %s", dst, tt.conn.LocalAddr())
+			}
+		})
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"192.0.2.1", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := isLocal(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isLocal(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestTarget(t *testing.T) {
+	fakeIPs, err := utils.NewFakeIPPool("198.18.0.0/24", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, _, err := fakeIPs.Assign("app.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteIP, _, err := fakeIPs.Assign("hidden.onion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockedIP, _, err := fakeIPs.Assign("blocked.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitConfig(&utils.Config{
+		Resolv: testResolver{
+			"app.example":     {net.ParseIP("192.0.2.10"), net.ParseIP("203.0.113.1")},
+			"blocked.example": {net.ParseIP("192.0.2.11")},
+		},
+		FakeIP:          fakeIPs,
+		ResolveRemotely: func(name string) bool { return name == "hidden.onion" },
+		Policy: loadPolicy(t, `{"rules": [
+			{"hosts": ["blocked.example", "203.0.113.0/24"], "action": "deny"}
+		], "default": "allow"}`),
+	})
+
+	tests := []struct {
+		name     string
+		ip       net.IP
+		sniffed  string
+		wantHost string
+		wantIPs  []string
+		wantErr  bool
+	}{
+		{"address", net.ParseIP("192.0.2.1"), "", "192.0.2.1", []string{"192.0.2.1"}, false},
+		{"denied address", net.ParseIP("203.0.113.7"), "", "", nil, true},
+		{"fake address", mapped, "", "app.example", []string{"192.0.2.10"}, false},
+		{"fake address resolved remotely", remoteIP, "", "hidden.onion", nil, false},
+		{"fake address of a denied name", blockedIP, "", "", nil, true},
+		{"fake address not handed out", net.ParseIP("198.18.0.200"), "", "", nil, true},
+		{"sniffed name", net.ParseIP("192.0.2.10"), "app.example", "app.example", []string{"192.0.2.10"}, false},
+		{"sniffed denied name", net.ParseIP("192.0.2.11"), "blocked.example", "", nil, true},
+		// a name that is not one of the address is ignored
+		{"sniffed name of another address", net.ParseIP("192.0.2.50"), "blocked.example", "192.0.2.50", []string{"192.0.2.50"}, false},
+		{"sniffed name resolved remotely", net.ParseIP("192.0.2.50"), "hidden.onion", "hidden.onion", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, ips, err := target(context.Background(), tt.ip, tt.sniffed, 443, policy.CmdConnect)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("target() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost || len(ips) != len(tt.wantIPs) {
+				t.Fatalf("target() = %s, %v, want %s, %v", host, ips, tt.wantHost, tt.wantIPs)
+			}
+			for i := range ips {
+				if !ips[i].Equal(net.ParseIP(tt.wantIPs[i])) {
+					t.Errorf("target() = %s, %v, want %s, %v", host, ips, tt.wantHost, tt.wantIPs)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package transparent
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+	"github.com/thifnmi/proxy-socks-server/metrics"
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/server/ratelimit"
+	"github.com/thifnmi/proxy-socks-server/server/session"
+)
+
+// udpSessionTimeout closes UDP sessions the destination stopped answering
+const udpSessionTimeout = time.Minute
+
+// udpMaxSessions caps the sessions of a socket, datagrams that would open
+// more are dropped
+const udpMaxSessions = 4096
+
+// udpQueueLength bounds the datagrams of a session waiting for its rate
+// limit, more are dropped
+const udpQueueLength = 64
+
+// udpSession relays the datagrams of one client to one destination
+type udpSession struct {
+	// datagrams of the client, relayed by relayQueue
+	queue chan []byte
+	// closed once the fields below are set
+	opened chan struct{}
+	// closed once the session ends
+	closed   chan struct{}
+	upstream net.Conn
+	// bound to the original destination and connected to the client
+	reply *net.UDPConn
+	limit *ratelimit.Session
+	sess  *session.Session
+}
+
+// ServeUDP relays the datagrams a TPROXY rule sends to conn, opened by
+// ListenUDP, to their original destinations. Clients allow refuses get no
+// session, the others are registered in registry. Sessions are opened
+// and shaped aside, so that a slow destination or a rate limited client
+// does not hold up the others. Datagrams arriving while their session is
+// opened, or while udpQueueLength of its datagrams wait, are dropped.
+func ServeUDP(conn *net.UDPConn, allow func(client *net.UDPAddr) bool, registry *session.Registry) error {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	buf := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return err
+		}
+		dst, err := origDstFromOOB(oob[:oobn])
+		if err != nil {
+			logger.Infof("Dropped datagram from %s: %s", client, err)
+			continue
+		}
+		key := client.String() + " " + dst.String()
+		// only this loop adds sessions, the count can only drop meanwhile
+		mu.Lock()
+		s := sessions[key]
+		count := len(sessions)
+		mu.Unlock()
+		if s == nil {
+			if !allow(client) {
+				logger.Infof("Denied datagram from %s by acl", client)
+				continue
+			}
+			if count >= udpMaxSessions {
+				logger.Infof("Dropped datagram from %s to %s: %d udp sessions are open", client, dst, count)
+				continue
+			}
+			s = newUDPSession()
+			mu.Lock()
+			sessions[key] = s
+			mu.Unlock()
+			go func(datagram []byte) {
+				defer func() {
+					mu.Lock()
+					delete(sessions, key)
+					mu.Unlock()
+				}()
+				if err := s.open(dst, client, registry); err != nil {
+					logger.Infof("Dropped datagram from %s to %s: %s", client, dst, err)
+					return
+				}
+				s.queue <- datagram
+				close(s.opened)
+				defer s.close()
+				go s.relayQueue()
+				go s.relayReplySocket()
+				s.relayAnswers()
+			}(append([]byte(nil), buf[:n]...))
+			continue
+		}
+		s.enqueue(buf[:n])
+	}
+}
+
+func newUDPSession() *udpSession {
+	return &udpSession{queue: make(chan []byte, udpQueueLength), opened: make(chan struct{}), closed: make(chan struct{})}
+}
+
+// enqueue queues a copy of a datagram of the client, false if it is dropped
+// because the session is being opened or is held up by its rate limit
+func (s *udpSession) enqueue(datagram []byte) bool {
+	select {
+	case <-s.opened:
+	default:
+		return false
+	}
+	select {
+	case s.queue <- append([]byte(nil), datagram...):
+		return true
+	default:
+		return false
+	}
+}
+
+// open checks the destination of the session and dials it
+func (s *udpSession) open(dst, client *net.UDPAddr, registry *session.Registry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	port := uint16(dst.Port)
+	metrics.Commands.With("transparent", policy.CmdUDPAssociate).Inc()
+	host, ips, err := target(ctx, dst.IP, "", port, policy.CmdUDPAssociate)
+	if err != nil {
+		return err
+	}
+	dialHost := host
+	if ips != nil {
+		dialHost = ips[0].String()
+	}
+	upstream, err := currConfig.Dial(ctx, "udp", net.JoinHostPort(dialHost, strconv.Itoa(int(port))))
+	if err != nil {
+		return err
+	}
+	reply, err := dialReply(dst, client)
+	if err != nil {
+		upstream.Close()
+		return err
+	}
+	// killing the session ends relayAnswers, which closes the rest
+	s.sess = registry.Open("transparent", client, upstream)
+	s.sess.SetRequest(policy.CmdUDPAssociate, host, port)
+	s.sess.SetDialed(upstream)
+	s.upstream = upstream
+	s.reply = reply
+	s.limit = currConfig.RateLimiter.Open("")
+	return nil
+}
+
+// send relays a datagram of the client to the destination
+func (s *udpSession) send(datagram []byte) error {
+	s.limit.WaitUpload(len(datagram))
+	s.sess.AddUpload(len(datagram))
+	metrics.Bytes.With("", "upload").Add(uint64(len(datagram)))
+	metrics.UDPPackets.With("upload").Inc()
+	_, err := s.upstream.Write(datagram)
+	return err
+}
+
+// relayQueue sends the queued datagrams of the client to the destination,
+// until the session is closed
+func (s *udpSession) relayQueue() {
+	for {
+		select {
+		case datagram := <-s.queue:
+			if err := s.send(datagram); err != nil {
+				logger.Infof("Failed to relay datagram to %s: %s", s.upstream.RemoteAddr(), err)
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// relayReplySocket sends the datagrams the kernel delivers to the reply
+// socket to the destination, until the session is closed
+func (s *udpSession) relayReplySocket() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.reply.Read(buf)
+		if err != nil {
+			return
+		}
+		s.send(buf[:n])
+	}
+}
+
+// relayAnswers sends the answers of the destination to the client until
+// none come for udpSessionTimeout
+func (s *udpSession) relayAnswers() {
+	buf := make([]byte, 65535)
+	for {
+		s.upstream.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		s.limit.WaitDownload(n)
+		s.sess.AddDownload(n)
+		metrics.Bytes.With("", "download").Add(uint64(n))
+		metrics.UDPPackets.With("download").Inc()
+		if _, err := s.reply.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (s *udpSession) close() {
+	close(s.closed)
+	s.upstream.Close()
+	s.reply.Close()
+	s.limit.Close()
+	s.sess.Close(nil)
+}
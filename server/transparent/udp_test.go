@@ -0,0 +1,66 @@
+package transparent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/server/ratelimit"
+)
+
+func TestUDPQueue(t *testing.T) {
+	destination, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.Close()
+	upstream, err := net.Dial("udp", destination.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 100 byte datagrams at 10 bytes per second, the first holds up the rest
+	limiter := ratelimit.New(ratelimit.Limits{PerConn: ratelimit.Rates{Upload: 10}})
+	s := newUDPSession()
+	s.upstream, s.reply, s.limit = upstream, reply, limiter.Open("")
+
+	datagram := make([]byte, 100)
+	if s.enqueue(datagram) {
+		t.Error("datagram queued while the session is opened")
+	}
+	close(s.opened)
+	go s.relayQueue()
+
+	queued := 0
+	start := time.Now()
+	for i := 0; i < 2*udpQueueLength; i++ {
+		if s.enqueue(datagram) {
+			queued++
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("queueing took %s, it must not wait for the rate limit", elapsed)
+	}
+	// the one being sent is out of the queue
+	if queued < udpQueueLength || queued > udpQueueLength+1 {
+		t.Errorf("queued %d datagrams, want %d", queued, udpQueueLength)
+	}
+
+	// lifted, the queued datagrams go out
+	limiter.SetLimits(ratelimit.Limits{})
+	destination.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < queued; i++ {
+		if n, _, err := destination.ReadFrom(make([]byte, 200)); err != nil || n != len(datagram) {
+			t.Fatalf("datagram %d: %d, %v", i, n, err)
+		}
+	}
+	s.close()
+	select {
+	case <-s.closed:
+	default:
+		t.Error("session not marked closed")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// debugSignals switch the log level between debug and the configured one
+var debugSignals = []os.Signal{syscall.SIGUSR1}
+
+// upgradeSignals start a new process that takes over the listening sockets
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
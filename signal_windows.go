@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+// debugSignals switch the log level between debug and the configured one,
+// Windows has no spare signal for it
+var debugSignals []os.Signal
+
+// upgradeSignals start a new process that takes over the listening sockets,
+// listening sockets cannot be passed on Windows
+var upgradeSignals []os.Signal
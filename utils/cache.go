@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TTL of answers from resolvers that do not report one
+const defaultTTL = time.Minute
+
+// CacheOptions configure a CachingResolver, zero values get defaults
+type CacheOptions struct {
+	// Maximum number of cached names, 1024 if zero
+	Size int
+	// Bounds applied to record TTLs, MaxTTL defaults to 1h
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// TTL for resolvers that do not report one, 1m if zero
+	DefaultTTL time.Duration
+	// TTL of "no such host" answers without a SOA TTL, 30s if zero.
+	// It is clamped by MinTTL and MaxTTL as well.
+	NegativeTTL time.Duration
+	// How long an expired answer may still be served while it is refreshed
+	// in the background, 0 disables serving stale answers
+	StaleTTL time.Duration
+}
+
+// CacheStats are the counters of a CachingResolver
+type CacheStats struct {
+	// Answered from a fresh entry
+	Hits uint64
+	// Answered from an expired entry while refreshing it
+	StaleHits uint64
+	// Answered "no such host" from the cache
+	NegativeHits uint64
+	// Looked up upstream
+	Misses uint64
+	// Lookups joining one already in flight for the same name
+	Deduplicated uint64
+	// Entries dropped to stay within Size
+	Evictions uint64
+	// Entries currently cached
+	Entries int
+}
+
+type cacheEntry struct {
+	name    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// inflight is a lookup other callers for the same name wait for
+type inflight struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// CachingResolver caches the answers of another Resolver
+type CachingResolver struct {
+	// first for 64-bit alignment of atomic access
+	hits, staleHits, negativeHits, misses, deduplicated, evictions uint64
+
+	resolver Resolver
+	options  CacheOptions
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // front is most recently used
+	inflight map[string]*inflight
+}
+
+func NewCachingResolver(resolver Resolver, options CacheOptions) *CachingResolver {
+	if options.Size <= 0 {
+		options.Size = 1024
+	}
+	if options.MaxTTL <= 0 {
+		options.MaxTTL = time.Hour
+	}
+	if options.DefaultTTL <= 0 {
+		options.DefaultTTL = defaultTTL
+	}
+	if options.NegativeTTL <= 0 {
+		options.NegativeTTL = 30 * time.Second
+	}
+	return &CachingResolver{
+		resolver: resolver,
+		options:  options,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*inflight),
+	}
+}
+
+func (r *CachingResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (r *CachingResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	now := time.Now()
+
+	r.mu.Lock()
+	if elem, ok := r.entries[name]; ok {
+		entry := elem.Value.(*cacheEntry)
+		r.lru.MoveToFront(elem)
+		if now.Before(entry.expires) {
+			r.mu.Unlock()
+			if entry.err != nil {
+				atomic.AddUint64(&r.negativeHits, 1)
+				return nil, entry.err
+			}
+			atomic.AddUint64(&r.hits, 1)
+			return entry.ips, nil
+		}
+		if entry.err == nil && now.Before(entry.expires.Add(r.options.StaleTTL)) {
+			r.lookupLocked(name)
+			r.mu.Unlock()
+			atomic.AddUint64(&r.staleHits, 1)
+			return entry.ips, nil
+		}
+	}
+	call := r.lookupLocked(name)
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.ips, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookupLocked starts a lookup of name unless one is in flight already.
+// The lookup runs detached from the callers, so it also completes refreshes
+// nobody waits for.
+func (r *CachingResolver) lookupLocked(name string) *inflight {
+	if call, ok := r.inflight[name]; ok {
+		atomic.AddUint64(&r.deduplicated, 1)
+		return call
+	}
+	atomic.AddUint64(&r.misses, 1)
+	call := &inflight{done: make(chan struct{})}
+	r.inflight[name] = call
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*dnsTimeout)
+		defer cancel()
+		var ttl time.Duration
+		if ttlResolver, ok := r.resolver.(TTLResolver); ok {
+			call.ips, ttl, call.err = ttlResolver.ResolveTTL(ctx, name)
+		} else {
+			call.ips, call.err = LookupAll(ctx, r.resolver, name)
+			ttl = r.options.DefaultTTL
+		}
+
+		r.mu.Lock()
+		delete(r.inflight, name)
+		r.storeLocked(name, call.ips, ttl, call.err)
+		r.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+func (r *CachingResolver) storeLocked(name string, ips []net.IP, ttl time.Duration, err error) {
+	if err != nil {
+		var notFound *notFoundError
+		var dnsErr *net.DNSError
+		switch {
+		case errors.As(err, &notFound):
+			ttl = notFound.ttl
+		case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			ttl = 0
+		default:
+			// failures like timeouts are not cached, an older answer stays
+			return
+		}
+		if ttl <= 0 {
+			ttl = r.options.NegativeTTL
+		}
+	}
+	if ttl < r.options.MinTTL {
+		ttl = r.options.MinTTL
+	}
+	if ttl > r.options.MaxTTL {
+		ttl = r.options.MaxTTL
+	}
+
+	entry := &cacheEntry{name: name, ips: ips, err: err, expires: time.Now().Add(ttl)}
+	if elem, ok := r.entries[name]; ok {
+		elem.Value = entry
+		r.lru.MoveToFront(elem)
+		return
+	}
+	r.entries[name] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.options.Size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).name)
+		atomic.AddUint64(&r.evictions, 1)
+	}
+}
+
+// Stats returns a snapshot of the counters
+func (r *CachingResolver) Stats() CacheStats {
+	r.mu.Lock()
+	entries := r.lru.Len()
+	r.mu.Unlock()
+	return CacheStats{
+		Hits:         atomic.LoadUint64(&r.hits),
+		StaleHits:    atomic.LoadUint64(&r.staleHits),
+		NegativeHits: atomic.LoadUint64(&r.negativeHits),
+		Misses:       atomic.LoadUint64(&r.misses),
+		Deduplicated: atomic.LoadUint64(&r.deduplicated),
+		Evictions:    atomic.LoadUint64(&r.evictions),
+		Entries:      entries,
+	}
+}
@@ -0,0 +1,312 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeAnswer struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// fakeResolver answers from a table and counts the lookups per name
+type fakeResolver struct {
+	mu      sync.Mutex
+	answers map[string]fakeAnswer
+	lookups map[string]int
+	// if set, lookups wait for it to be closed
+	block chan struct{}
+}
+
+func newFakeResolver(answers map[string]fakeAnswer) *fakeResolver {
+	return &fakeResolver{answers: answers, lookups: make(map[string]int)}
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	ips, _, err := r.ResolveTTL(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (r *fakeResolver) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if r.block != nil {
+		select {
+		case <-r.block:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups[name]++
+	answer, ok := r.answers[name]
+	if !ok {
+		return nil, 0, &notFoundError{name: name}
+	}
+	return answer.ips, answer.ttl, answer.err
+}
+
+func (r *fakeResolver) set(name string, answer fakeAnswer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.answers[name] = answer
+}
+
+func (r *fakeResolver) count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups[name]
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	upstream := newFakeResolver(map[string]fakeAnswer{
+		"example.com": {ips: []net.IP{ip1}, ttl: 50 * time.Millisecond},
+	})
+	r := NewCachingResolver(upstream, CacheOptions{})
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		query       string
+		before      func()
+		wantIP      net.IP
+		wantLookups int
+	}{
+		{"miss", "example.com", nil, ip1, 1},
+		{"hit", "example.com", nil, ip1, 1},
+		{"hit ignores case and trailing dot", "Example.COM.", nil, ip1, 1},
+		{"expired", "example.com", func() {
+			upstream.set("example.com", fakeAnswer{ips: []net.IP{ip2}, ttl: time.Minute})
+			time.Sleep(60 * time.Millisecond)
+		}, ip2, 2},
+	}
+	for _, tt := range tests {
+		if tt.before != nil {
+			tt.before()
+		}
+		ip, err := r.Resolve(ctx, tt.query)
+		if err != nil {
+			t.Fatalf("%s: Resolve() error = %v", tt.name, err)
+		}
+		if !ip.Equal(tt.wantIP) {
+			t.Errorf("%s: Resolve() = %v, want %v", tt.name, ip, tt.wantIP)
+		}
+		if got := upstream.count("example.com"); got != tt.wantLookups {
+			t.Errorf("%s: %d upstream lookups, want %d", tt.name, got, tt.wantLookups)
+		}
+	}
+	if stats := r.Stats(); stats.Hits != 2 || stats.Misses != 2 || stats.Entries != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestCachingResolverTTLBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		options CacheOptions
+		want    time.Duration
+	}{
+		{"record ttl", 10 * time.Second, CacheOptions{}, 10 * time.Second},
+		{"below minimum", time.Second, CacheOptions{MinTTL: 5 * time.Second}, 5 * time.Second},
+		{"above maximum", time.Hour, CacheOptions{MaxTTL: time.Minute}, time.Minute},
+		{"default maximum", 48 * time.Hour, CacheOptions{}, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newFakeResolver(map[string]fakeAnswer{
+				"example.com": {ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: tt.ttl},
+			})
+			r := NewCachingResolver(upstream, tt.options)
+			start := time.Now()
+			if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+				t.Fatal(err)
+			}
+			r.mu.Lock()
+			expires := r.entries["example.com"].Value.(*cacheEntry).expires
+			r.mu.Unlock()
+			if got := expires.Sub(start); got < tt.want || got > tt.want+time.Second {
+				t.Errorf("cached for %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachingResolverNegative(t *testing.T) {
+	timeout := &net.DNSError{Err: "timeout", Name: "slow.example", IsTimeout: true}
+	upstream := newFakeResolver(map[string]fakeAnswer{
+		"slow.example": {err: timeout},
+		"soa.example":  {err: &notFoundError{name: "soa.example", ttl: 50 * time.Millisecond}},
+	})
+	r := NewCachingResolver(upstream, CacheOptions{NegativeTTL: time.Minute})
+	ctx := context.Background()
+
+	tests := []struct {
+		query       string
+		wantLookups int
+	}{
+		// not in the table, negative TTL from the options
+		{"missing.example", 1},
+		{"missing.example", 1},
+		// failures other than "no such host" are not cached
+		{"slow.example", 2},
+		{"soa.example", 1},
+	}
+	for _, tt := range tests {
+		_, err := r.ResolveAll(ctx, tt.query)
+		if err == nil {
+			t.Fatalf("ResolveAll(%q) succeeded", tt.query)
+		}
+		_, err = r.ResolveAll(ctx, tt.query)
+		if err == nil {
+			t.Fatalf("ResolveAll(%q) succeeded", tt.query)
+		}
+		if got := upstream.count(tt.query); got != tt.wantLookups {
+			t.Errorf("%s: %d upstream lookups, want %d", tt.query, got, tt.wantLookups)
+		}
+	}
+
+	// the TTL of the SOA record is used
+	time.Sleep(60 * time.Millisecond)
+	r.ResolveAll(ctx, "soa.example")
+	if got := upstream.count("soa.example"); got != 2 {
+		t.Errorf("negative answer cached past its TTL, %d lookups", got)
+	}
+	if stats := r.Stats(); stats.NegativeHits != 4 {
+		t.Errorf("NegativeHits = %d, want 4", stats.NegativeHits)
+	}
+}
+
+func TestCachingResolverStale(t *testing.T) {
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	upstream := newFakeResolver(map[string]fakeAnswer{
+		"example.com": {ips: []net.IP{ip1}, ttl: 20 * time.Millisecond},
+	})
+	r := NewCachingResolver(upstream, CacheOptions{StaleTTL: time.Minute})
+	ctx := context.Background()
+	if _, err := r.Resolve(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	upstream.set("example.com", fakeAnswer{ips: []net.IP{ip2}, ttl: time.Minute})
+	time.Sleep(30 * time.Millisecond)
+
+	// the expired answer is served while it is refreshed
+	ip, err := r.Resolve(ctx, "example.com")
+	if err != nil || !ip.Equal(ip1) {
+		t.Fatalf("Resolve() = %v, %v, want stale %v", ip, err, ip1)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		ip, err = r.Resolve(ctx, "example.com")
+		if err == nil && ip.Equal(ip2) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Resolve() = %v, %v, refresh did not complete", ip, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := r.Stats(); stats.StaleHits == 0 {
+		t.Errorf("StaleHits = 0")
+	}
+}
+
+func TestCachingResolverDeduplicates(t *testing.T) {
+	upstream := newFakeResolver(map[string]fakeAnswer{
+		"example.com": {ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Minute},
+	})
+	upstream.block = make(chan struct{})
+	r := NewCachingResolver(upstream, CacheOptions{})
+
+	const callers = 10
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+		}()
+	}
+	for r.Stats().Deduplicated < callers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.block)
+	wg.Wait()
+	if failed != 0 {
+		t.Errorf("%d lookups failed", failed)
+	}
+	if got := upstream.count("example.com"); got != 1 {
+		t.Errorf("%d upstream lookups, want 1", got)
+	}
+}
+
+func TestCachingResolverCanceled(t *testing.T) {
+	upstream := newFakeResolver(map[string]fakeAnswer{})
+	upstream.block = make(chan struct{})
+	defer close(upstream.block)
+	r := NewCachingResolver(upstream, CacheOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Resolve(ctx, "example.com"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Resolve() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCachingResolverEviction(t *testing.T) {
+	upstream := newFakeResolver(map[string]fakeAnswer{})
+	for _, name := range []string{"a.example", "b.example", "c.example"} {
+		upstream.set(name, fakeAnswer{ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Minute})
+	}
+	r := NewCachingResolver(upstream, CacheOptions{Size: 2})
+	ctx := context.Background()
+	for _, name := range []string{"a.example", "b.example", "a.example", "c.example"} {
+		if _, err := r.Resolve(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b.example was the least recently used
+	tests := []struct {
+		name        string
+		wantLookups int
+	}{
+		{"a.example", 1},
+		{"c.example", 1},
+		{"b.example", 2},
+	}
+	for _, tt := range tests {
+		if _, err := r.Resolve(ctx, tt.name); err != nil {
+			t.Fatal(err)
+		}
+		if got := upstream.count(tt.name); got != tt.wantLookups {
+			t.Errorf("%s: %d upstream lookups, want %d", tt.name, got, tt.wantLookups)
+		}
+	}
+	if stats := r.Stats(); stats.Evictions != 2 || stats.Entries != 2 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestCachingResolverLiteral(t *testing.T) {
+	upstream := newFakeResolver(map[string]fakeAnswer{})
+	r := NewCachingResolver(upstream, CacheOptions{})
+	ips, err := r.ResolveAll(context.Background(), "2001:db8::1")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("ResolveAll() = %v, %v", ips, err)
+	}
+	if stats := r.Stats(); stats.Misses != 0 {
+		t.Errorf("literal looked up upstream")
+	}
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// FamilyPreference decides which address family is tried first
+type FamilyPreference int
+
+const (
+	// PreferIPv6 tries IPv6 first as RFC 8305 recommends
+	PreferIPv6 FamilyPreference = iota
+	PreferIPv4
+	// IPv4Only and IPv6Only skip addresses of the other family
+	IPv4Only
+	IPv6Only
+)
+
+// ParseFamilyPreference reads "ipv6", "ipv4", "ipv4only" or "ipv6only"
+func ParseFamilyPreference(s string) (FamilyPreference, error) {
+	switch s {
+	case "ipv6", "":
+		return PreferIPv6, nil
+	case "ipv4":
+		return PreferIPv4, nil
+	case "ipv4only":
+		return IPv4Only, nil
+	case "ipv6only":
+		return IPv6Only, nil
+	}
+	return 0, fmt.Errorf("invalid address family preference %q", s)
+}
+
+// HappyEyeballs dials the addresses of a host in parallel, staggered
+// attempts like RFC 8305 describes. The zero value prefers IPv6 and waits
+// 250ms between attempts.
+type HappyEyeballs struct {
+	Prefer FamilyPreference
+	// Connection Attempt Delay, 250ms if zero
+	AttemptDelay time.Duration
+}
+
+// Sort orders the addresses to dial: the first one of the preferred
+// family, then alternating families
+func (h HappyEyeballs) Sort(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	switch h.Prefer {
+	case PreferIPv4:
+		first, second = v4, v6
+	case IPv4Only:
+		first, second = v4, nil
+	case IPv6Only:
+		second = nil
+	}
+	if len(first) == 0 {
+		first, second = second, nil
+	}
+	sorted := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+func (h HappyEyeballs) attemptDelay() time.Duration {
+	if h.AttemptDelay <= 0 {
+		return 250 * time.Millisecond
+	}
+	return h.AttemptDelay
+}
+
+// Dial connects to port on one of the addresses. An attempt is started
+// every AttemptDelay, or as soon as the previous one fails, and the first
+// established connection wins. The error of the first failed attempt is
+// returned if none succeeds.
+func (h HappyEyeballs) Dial(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, ips []net.IP, port uint16) (net.Conn, error) {
+	ips = h.Sort(ips)
+	portStr := strconv.Itoa(int(port))
+	switch len(ips) {
+	case 0:
+		return nil, fmt.Errorf("no address of the allowed family to dial")
+	case 1:
+		return dial(ctx, network, net.JoinHostPort(ips[0].String(), portStr))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), portStr)
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	delay := time.NewTimer(h.attemptDelay())
+	defer delay.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close connections of attempts that complete too late
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+				if !delay.Stop() {
+					select {
+					case <-delay.C:
+					default:
+					}
+				}
+				delay.Reset(h.attemptDelay())
+			}
+		case <-delay.C:
+			if next < len(ips) {
+				start()
+				delay.Reset(h.attemptDelay())
+			}
+		}
+	}
+	return nil, firstErr
+}
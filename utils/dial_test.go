@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func parseIPs(addrs ...string) []net.IP {
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = net.ParseIP(addr)
+	}
+	return ips
+}
+
+func TestParseFamilyPreference(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    FamilyPreference
+		wantErr bool
+	}{
+		{"", PreferIPv6, false},
+		{"ipv6", PreferIPv6, false},
+		{"ipv4", PreferIPv4, false},
+		{"ipv4only", IPv4Only, false},
+		{"ipv6only", IPv6Only, false},
+		{"both", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFamilyPreference(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseFamilyPreference(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestHappyEyeballsSort(t *testing.T) {
+	ips := parseIPs("192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2", "2001:db8::3")
+	tests := []struct {
+		name   string
+		prefer FamilyPreference
+		ips    []net.IP
+		want   []net.IP
+	}{
+		{"prefer ipv6", PreferIPv6, ips,
+			parseIPs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3")},
+		{"prefer ipv4", PreferIPv4, ips,
+			parseIPs("192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "2001:db8::3")},
+		{"ipv4 only", IPv4Only, ips, parseIPs("192.0.2.1", "192.0.2.2")},
+		{"ipv6 only", IPv6Only, ips, parseIPs("2001:db8::1", "2001:db8::2", "2001:db8::3")},
+		{"preferred family missing", PreferIPv6, parseIPs("192.0.2.1"), parseIPs("192.0.2.1")},
+		{"only family missing", IPv6Only, parseIPs("192.0.2.1"), []net.IP{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := HappyEyeballs{Prefer: tt.prefer}.Sort(tt.ips)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Sort() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Fatalf("Sort() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+type fakeConn struct {
+	net.Conn
+	addr   string
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+type fakeDial struct {
+	delay time.Duration
+	err   error
+}
+
+// fakeDialer connects to every address after its delay, attempts are
+// abandoned when their context ends
+type fakeDialer struct {
+	addrs map[string]fakeDial
+
+	mu       sync.Mutex
+	dialed   []string
+	canceled []string
+}
+
+func (d *fakeDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+	fake := d.addrs[addr]
+	select {
+	case <-time.After(fake.delay):
+	case <-ctx.Done():
+		d.mu.Lock()
+		d.canceled = append(d.canceled, addr)
+		d.mu.Unlock()
+		return nil, ctx.Err()
+	}
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	return &fakeConn{addr: addr}, nil
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	refused := errors.New("connection refused")
+	tests := []struct {
+		name     string
+		addrs    map[string]fakeDial
+		want     string
+		wantErr  error
+		wantDial []string
+	}{
+		{"first wins", map[string]fakeDial{
+			"[2001:db8::1]:80": {},
+			"192.0.2.1:80":     {},
+		}, "[2001:db8::1]:80", nil, []string{"[2001:db8::1]:80"}},
+		{"failure starts the next attempt", map[string]fakeDial{
+			"[2001:db8::1]:80": {err: refused},
+			"192.0.2.1:80":     {},
+		}, "192.0.2.1:80", nil, []string{"[2001:db8::1]:80", "192.0.2.1:80"}},
+		{"slow attempt loses", map[string]fakeDial{
+			"[2001:db8::1]:80": {delay: time.Second},
+			"192.0.2.1:80":     {},
+		}, "192.0.2.1:80", nil, []string{"[2001:db8::1]:80", "192.0.2.1:80"}},
+		{"first error", map[string]fakeDial{
+			"[2001:db8::1]:80": {err: refused},
+			"192.0.2.1:80":     {err: errors.New("no route to host")},
+		}, "", refused, []string{"[2001:db8::1]:80", "192.0.2.1:80"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDialer{addrs: tt.addrs}
+			h := HappyEyeballs{AttemptDelay: 20 * time.Millisecond}
+			conn, err := h.Dial(context.Background(), d.dial, "tcp", parseIPs("192.0.2.1", "2001:db8::1"), 80)
+			if err != tt.wantErr {
+				t.Fatalf("Dial() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && conn.(*fakeConn).addr != tt.want {
+				t.Errorf("Dial() connected to %s, want %s", conn.(*fakeConn).addr, tt.want)
+			}
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if len(d.dialed) != len(tt.wantDial) {
+				t.Fatalf("dialed %v, want %v", d.dialed, tt.wantDial)
+			}
+			for i := range d.dialed {
+				if d.dialed[i] != tt.wantDial[i] {
+					t.Fatalf("dialed %v, want %v", d.dialed, tt.wantDial)
+				}
+			}
+		})
+	}
+}
+
+func TestHappyEyeballsCancelsLosers(t *testing.T) {
+	d := &fakeDialer{addrs: map[string]fakeDial{
+		"[2001:db8::1]:80": {delay: time.Minute},
+		"192.0.2.1:80":     {},
+	}}
+	h := HappyEyeballs{AttemptDelay: 10 * time.Millisecond}
+	if _, err := h.Dial(context.Background(), d.dial, "tcp", parseIPs("192.0.2.1", "2001:db8::1"), 80); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.mu.Lock()
+		canceled := len(d.canceled)
+		d.mu.Unlock()
+		if canceled == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("losing attempt was not canceled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHappyEyeballsClosesLateConnections(t *testing.T) {
+	// the dialer ignores the context, so both attempts connect
+	var mu sync.Mutex
+	var conns []*fakeConn
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "[2001:db8::1]:80" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		conn := &fakeConn{addr: addr}
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		return conn, nil
+	}
+	h := HappyEyeballs{AttemptDelay: 10 * time.Millisecond}
+	conn, err := h.Dial(context.Background(), dial, "tcp", parseIPs("192.0.2.1", "2001:db8::1"), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.(*fakeConn).addr != "192.0.2.1:80" {
+		t.Fatalf("Dial() connected to %s", conn.(*fakeConn).addr)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		late := len(conns) == 2 && conns[1].isClosed()
+		mu.Unlock()
+		if late {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("late connection was not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if conn.(*fakeConn).isClosed() {
+		t.Error("winning connection closed")
+	}
+}
+
+func TestHappyEyeballsNoAddress(t *testing.T) {
+	d := &fakeDialer{}
+	h := HappyEyeballs{Prefer: IPv4Only}
+	if _, err := h.Dial(context.Background(), d.dial, "tcp", parseIPs("2001:db8::1"), 80); err == nil {
+		t.Error("Dial() succeeded without an address of the allowed family")
+	}
+}
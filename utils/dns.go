@@ -0,0 +1,448 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsTimeout = 3 * time.Second
+
+// TTLResolver is a Resolver that also reports how long the answer may be cached
+type TTLResolver interface {
+	Resolver
+	ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error)
+}
+
+// LookupTTL returns the addresses of name and their TTL, resolvers that do
+// not report one get defaultTTL
+func LookupTTL(ctx context.Context, r Resolver, name string) ([]net.IP, time.Duration, error) {
+	if ttlResolver, ok := r.(TTLResolver); ok {
+		return ttlResolver.ResolveTTL(ctx, name)
+	}
+	ips, err := LookupAll(ctx, r, name)
+	return ips, defaultTTL, err
+}
+
+// DNSOptions configure resolvers querying a DNS server directly
+type DNSOptions struct {
+	// Addresses of the server, used instead of resolving its host name
+	// with the system resolver
+	Bootstrap []net.IP
+	// Time allowed for one query, 3s if zero
+	Timeout time.Duration
+	// DNS-over-HTTPS: send queries with GET instead of POST
+	UseGET bool
+	// DNS-over-TLS and DNS-over-HTTPS: TLS settings like RootCAs, the
+	// server name is set from the server address
+	TLSConfig *tls.Config
+	// How a resolver with several servers queries them
+	Strategy Strategy
+	// Keep the AD (authenticated data) bit of answers forwarded by Exchange,
+	// for clients trusting the servers and the path to them to validate
+	// DNSSEC. It is cleared otherwise.
+	ADPassThrough bool
+}
+
+func (o DNSOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return dnsTimeout
+	}
+	return o.Timeout
+}
+
+// dial connects to addr, through the bootstrap addresses if there are any
+func (o DNSOptions) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	if len(o.Bootstrap) == 0 {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	return HappyEyeballs{}.Dial(ctx, dialer.DialContext, network, o.Bootstrap, uint16(port))
+}
+
+// NewDNSResolver returns a resolver querying server, given as
+//
+//	ip:port or udp://host[:53]      plain DNS, over TCP if the answer is truncated
+//	tls://host[:853]                DNS-over-TLS (RFC 7858)
+//	https://host[:443][/path]       DNS-over-HTTPS (RFC 8484), path /dns-query by default
+func NewDNSResolver(server string, options DNSOptions) (Resolver, error) {
+	u, err := parseServer(server)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := newUpstream(u, options)
+	if err != nil {
+		return nil, err
+	}
+	client := newDNSClient(options, upstream)
+	switch upstream.(type) {
+	case *tlsUpstream:
+		return &DoTResolver{client}, nil
+	case *httpsUpstream:
+		return &DoHResolver{client}, nil
+	}
+	return &CustomResolver{client}, nil
+}
+
+// DNSResolver queries several DNS servers, of any transport, following
+// the Strategy of its options. Servers failing repeatedly are skipped for
+// a while.
+type DNSResolver struct {
+	dnsClient
+}
+
+// NewDNSResolvers returns a resolver for servers given like for NewDNSResolver
+func NewDNSResolvers(servers []string, options DNSOptions) (*DNSResolver, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no dns server")
+	}
+	upstreams := make([]upstream, 0, len(servers))
+	for _, server := range servers {
+		u, err := parseServer(server)
+		if err != nil {
+			return nil, err
+		}
+		upstream, err := newUpstream(u, options)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return &DNSResolver{newDNSClient(options, upstreams...)}, nil
+}
+
+func newUpstream(u *url.URL, options DNSOptions) (upstream, error) {
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: hostPort(u, "53"), options: options}, nil
+	case "tls":
+		return newTLSUpstream(hostPort(u, "853"), options), nil
+	case "https":
+		return newHTTPSUpstream(u.String(), options)
+	}
+	return nil, fmt.Errorf("unsupported dns server scheme %q", u.Scheme)
+}
+
+// parseServer reads a server address, plain ip:port means udp
+func parseServer(server string) (*url.URL, error) {
+	server = strings.TrimSpace(server)
+	if !strings.Contains(server, "://") {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("dns server should be ip:port or a udp://, tls:// or https:// URL")
+		}
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns server %q: %v", server, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid dns server %q: no host", server)
+	}
+	return u, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// upstream carries DNS messages to one server
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	// close releases the connections kept for later queries
+	close()
+	String() string
+}
+
+// dnsClient resolves names through a group of upstreams, it is embedded by
+// the resolvers of each transport
+type dnsClient struct {
+	upstream upstream
+	options  DNSOptions
+}
+
+func newDNSClient(options DNSOptions, upstreams ...upstream) dnsClient {
+	return dnsClient{upstream: newServerGroup(upstreams, options), options: options}
+}
+
+// Close releases the connections kept open to the servers, queries still
+// running complete first
+func (c *dnsClient) Close() error {
+	c.upstream.close()
+	return nil
+}
+
+// Exchange forwards a DNS message to the servers and returns the answer
+func (c *dnsClient) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	answer, err := c.upstream.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if !c.options.ADPassThrough {
+		// AD flag of the header
+		answer[3] &^= 0x20
+	}
+	return answer, nil
+}
+
+func (c *dnsClient) Resolve(ctx context.Context, name string) (net.IP, error) {
+	ips, _, err := c.ResolveTTL(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// ResolveTTL looks up the IPv4 and IPv6 addresses of name
+func (c *dnsClient) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	return resolveBoth(ctx, name, func(ctx context.Context, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+		return c.query(ctx, name, qtype)
+	})
+}
+
+func (c *dnsClient) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	query, id, err := newQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := c.upstream.exchange(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("dns query to %s: %w", c.upstream, err)
+	}
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(answer); err != nil {
+		return nil, fmt.Errorf("dns answer from %s: %w", c.upstream, err)
+	}
+	if msg.ID != id {
+		return nil, fmt.Errorf("dns answer from %s: id mismatch", c.upstream)
+	}
+	return msg, nil
+}
+
+// notFoundError is returned for names without an address, ttl is how long
+// that answer may be cached, 0 if the server did not say
+type notFoundError struct {
+	name string
+	ttl  time.Duration
+}
+
+func (e *notFoundError) Error() string {
+	return (&net.DNSError{Err: "no such host", Name: e.name, IsNotFound: true}).Error()
+}
+
+func newQuery(name string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid name %q", name)
+	}
+	// an unpredictable ID keeps forged answers from being accepted, DoH
+	// sends 0 instead
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	return query, id, err
+}
+
+// udpUpstream is a plain DNS server, answers are retried over TCP if they
+// are truncated
+type udpUpstream struct {
+	addr    string
+	options DNSOptions
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+func (u *udpUpstream) close() {}
+
+func (u *udpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.options.dial(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams with another id
+		if n < 3 || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(query) {
+			continue
+		}
+		// TC bit of the header flags
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		break
+	}
+
+	tcpConn, err := u.options.dial(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	return exchangeStream(ctx, tcpConn, query)
+}
+
+// exchangeStream sends a query over a TCP or TLS connection, where messages
+// are prefixed with their length
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	framed := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	length := []byte{0, 0}
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return answer, nil
+}
+
+// addresses returns the addresses of the answer and the lowest TTL of the
+// records leading to them
+func addresses(msg *dnsmessage.Message, name string) ([]net.IP, time.Duration, error) {
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &notFoundError{name: name, ttl: negativeTTL(msg)}
+	default:
+		return nil, 0, &net.DNSError{Err: "server answered " + msg.RCode.String(), Name: name, IsTemporary: true}
+	}
+	var ips []net.IP
+	var ttl uint32
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		case *dnsmessage.CNAMEResource:
+		default:
+			continue
+		}
+		if ttl == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, &notFoundError{name: name, ttl: negativeTTL(msg)}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// resolveBoth queries the A and AAAA records of name in parallel, IPv4
+// addresses come first. The name is only reported as not found if both
+// queries say so.
+func resolveBoth(ctx context.Context, name string, query func(ctx context.Context, qtype dnsmessage.Type) (*dnsmessage.Message, error)) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	var results [2]result
+	var wg sync.WaitGroup
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		wg.Add(1)
+		go func(r *result, qtype dnsmessage.Type) {
+			defer wg.Done()
+			msg, err := query(ctx, qtype)
+			if err != nil {
+				r.err = err
+				return
+			}
+			r.ips, r.ttl, r.err = addresses(msg, name)
+		}(&results[i], qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	for _, r := range results {
+		if r.err != nil {
+			var notFound *notFoundError
+			if err == nil || errors.As(err, &notFound) {
+				err = r.err
+			}
+			continue
+		}
+		ips = append(ips, r.ips...)
+		if ttl == 0 || r.ttl < ttl {
+			ttl = r.ttl
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, err
+	}
+	return ips, ttl, nil
+}
+
+// negativeTTL reads how long a missing name may be cached from the SOA
+// record of the authority section (RFC 2308)
+func negativeTTL(msg *dnsmessage.Message) time.Duration {
+	for _, authority := range msg.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			ttl := authority.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return 0
+}
@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubAnswer answers queries for example.com with 192.0.2.1 and
+// 2001:db8::1, big.example with more addresses than fit in 512 bytes and
+// any other name with NXDOMAIN and a SOA TTL of 60s. The AD bit is set.
+func stubAnswer(query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.AuthenticData = true
+	question := msg.Questions[0]
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 300}
+	switch question.Name.String() {
+	case "example.com.":
+		switch question.Type {
+		case dnsmessage.TypeA:
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+		case dnsmessage.TypeAAAA:
+			body := &dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], net.ParseIP("2001:db8::1"))
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: body})
+		}
+	case "big.example.":
+		if question.Type == dnsmessage.TypeA {
+			for i := 1; i <= 40; i++ {
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}}})
+			}
+		}
+	default:
+		msg.RCode = dnsmessage.RCodeNameError
+		msg.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.example."),
+				MBox:   dnsmessage.MustNewName("hostmaster.example."),
+				MinTTL: 60,
+			},
+		}}
+	}
+	answer, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return answer
+}
+
+// serveStub answers length prefixed queries on conn
+func serveStub(conn net.Conn) {
+	defer conn.Close()
+	for {
+		length := []byte{0, 0}
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		answer := stubAnswer(query)
+		framed := make([]byte, 2, 2+len(answer))
+		binary.BigEndian.PutUint16(framed, uint16(len(answer)))
+		if _, err := conn.Write(append(framed, answer...)); err != nil {
+			return
+		}
+	}
+}
+
+// startUDPStub serves stubAnswer over UDP and TCP on the same port,
+// UDP answers over 512 bytes are truncated
+func startUDPStub(t *testing.T) string {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packetConn.Close() })
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			answer := stubAnswer(buf[:n])
+			if len(answer) > 512 {
+				var msg dnsmessage.Message
+				msg.Unpack(answer)
+				msg.Truncated = true
+				msg.Answers = nil
+				answer, _ = msg.Pack()
+			}
+			packetConn.WriteTo(answer, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveStub(conn)
+		}
+	}()
+	return packetConn.LocalAddr().String()
+}
+
+// testResolve checks the answers of the stub through r
+func testResolve(t *testing.T, r TTLResolver) {
+	t.Helper()
+	ctx := context.Background()
+	ips, ttl, err := r.ResolveTTL(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("ResolveTTL() error = %v", err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.1")) || !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("ResolveTTL() = %v", ips)
+	}
+	if ttl != 300*time.Second {
+		t.Errorf("ttl = %v, want 5m", ttl)
+	}
+
+	_, _, err = r.ResolveTTL(ctx, "missing.example")
+	var notFound *notFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("ResolveTTL() error = %v, want not found", err)
+	}
+	if notFound.ttl != 60*time.Second {
+		t.Errorf("negative ttl = %v, want 1m", notFound.ttl)
+	}
+}
+
+func TestCustomResolver(t *testing.T) {
+	addr := startUDPStub(t)
+	r := NewCustomResolver(addr)
+	testResolve(t, r)
+
+	// truncated answers are retried over TCP
+	ips, err := LookupAll(context.Background(), r, "big.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 40 {
+		t.Errorf("%d addresses, want 40", len(ips))
+	}
+}
+
+func TestExchangeADBit(t *testing.T) {
+	addr := startUDPStub(t)
+	query, _, err := newQuery("example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		adPassThrough bool
+		want          bool
+	}{
+		{"cleared", false, false},
+		{"passed through", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewDNSResolvers([]string{addr}, DNSOptions{ADPassThrough: tt.adPassThrough})
+			if err != nil {
+				t.Fatal(err)
+			}
+			answer, err := r.Exchange(context.Background(), query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(answer); err != nil {
+				t.Fatal(err)
+			}
+			if msg.AuthenticData != tt.want {
+				t.Errorf("AD = %v, want %v", msg.AuthenticData, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDNSResolver(t *testing.T) {
+	tests := []struct {
+		server  string
+		want    string
+		wantErr bool
+	}{
+		{"192.0.2.53:53", "udp://192.0.2.53:53", false},
+		{"udp://dns.example", "udp://dns.example:53", false},
+		{"tls://dns.example", "tls://dns.example:853", false},
+		{"tls://dns.example:8853", "tls://dns.example:8853", false},
+		{"https://dns.example", "https://dns.example/dns-query", false},
+		{"https://dns.example/resolve", "https://dns.example/resolve", false},
+		{"192.0.2.53", "", true},
+		{"http://dns.example", "", true},
+		{"tls://", "", true},
+	}
+	for _, tt := range tests {
+		r, err := NewDNSResolver(tt.server, DNSOptions{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewDNSResolver(%q) error = %v, wantErr %v", tt.server, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var client dnsClient
+		switch r := r.(type) {
+		case *CustomResolver:
+			client = r.dnsClient
+		case *DoTResolver:
+			client = r.dnsClient
+		case *DoHResolver:
+			client = r.dnsClient
+		}
+		if got := client.upstream.(*serverGroup).String(); got != tt.want {
+			t.Errorf("NewDNSResolver(%q) queries %s, want %s", tt.server, got, tt.want)
+		}
+	}
+}
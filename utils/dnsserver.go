@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+	"github.com/thifnmi/proxy-socks-server/server/acl"
+	"github.com/thifnmi/proxy-socks-server/server/listenfd"
+)
+
+// Queries answered at once over UDP, more are dropped, and TCP
+// connections served at once, more are closed
+const (
+	dnsMaxQueries = 256
+	dnsMaxStreams = 64
+)
+
+// ErrDNSServerClosed is returned by ListenAndServe after Close
+var ErrDNSServerClosed = errors.New("dns: server closed")
+
+// Exchanger forwards raw DNS messages, the resolvers of -dns servers are one
+type Exchanger interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// DNSServer answers A and AAAA queries from a Resolver, over UDP and TCP.
+// Other queries are passed to Forward, or refused without one.
+type DNSServer struct {
+	Resolver Resolver
+	Forward  Exchanger
+	// ACL restricts the clients, with the listen address selecting the
+	// section. Nil answers everyone.
+	ACL *acl.ACL
+
+	addr    string
+	queries chan struct{}
+	streams chan struct{}
+
+	mu sync.Mutex
+	// sockets and TCP connections being served
+	conns  map[io.Closer]struct{}
+	closed bool
+}
+
+// ListenAndServe serves UDP and TCP on addr, it returns when either fails
+func (s *DNSServer) ListenAndServe(addr string) error {
+	packetConn, err := listenfd.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer packetConn.Close()
+	listener, err := listenfd.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	logger.Infof("Serving dns on %s", addr)
+	return s.serve(addr, packetConn, listener)
+}
+
+// serve answers on the sockets bound to addr
+func (s *DNSServer) serve(addr string, packetConn net.PacketConn, listener net.Listener) error {
+	if !s.track(packetConn) {
+		return ErrDNSServerClosed
+	}
+	defer s.untrack(packetConn)
+	if !s.track(listener) {
+		return ErrDNSServerClosed
+	}
+	defer s.untrack(listener)
+	s.addr = addr
+	s.queries = make(chan struct{}, dnsMaxQueries)
+	s.streams = make(chan struct{}, dnsMaxStreams)
+	errc := make(chan error, 2)
+	go func() { errc <- s.servePacket(packetConn) }()
+	go func() { errc <- s.serveStream(listener) }()
+	err := <-errc
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrDNSServerClosed
+	}
+	return err
+}
+
+// Close stops answering, it closes the sockets and the TCP connections
+// being served. Queries being answered over UDP get no answer.
+func (s *DNSServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *DNSServer) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[io.Closer]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *DNSServer) untrack(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *DNSServer) servePacket(conn net.PacketConn) error {
+	for {
+		buf := make([]byte, 4096)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if allowed, _ := s.ACL.Check(s.addr, addr); !allowed {
+			continue
+		}
+		select {
+		case s.queries <- struct{}{}:
+		default:
+			// overloaded, the client asks again
+			continue
+		}
+		go func() {
+			defer func() { <-s.queries }()
+			if answer := s.answer(buf[:n]); answer != nil {
+				conn.WriteTo(answer, addr)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) serveStream(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if allowed, _ := s.ACL.Check(s.addr, conn.RemoteAddr()); !allowed {
+			conn.Close()
+			continue
+		}
+		select {
+		case s.streams <- struct{}{}:
+		default:
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-s.streams }()
+			s.handleStream(conn)
+		}()
+	}
+}
+
+func (s *DNSServer) handleStream(conn net.Conn) {
+	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		length := []byte{0, 0}
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		answer := s.answer(query)
+		if answer == nil {
+			return
+		}
+		framed := make([]byte, 2, 2+len(answer))
+		binary.BigEndian.PutUint16(framed, uint16(len(answer)))
+		if _, err := conn.Write(append(framed, answer...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the answer to a query, nil if it is not worth one
+func (s *DNSServer) answer(query []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil && !errors.Is(err, dnsmessage.ErrSectionDone) {
+		return nil
+	}
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+	}
+	if err == nil {
+		reply.Questions = []dnsmessage.Question{question}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	switch {
+	case header.OpCode != 0 || err != nil:
+		reply.RCode = dnsmessage.RCodeNotImplemented
+	case question.Class == dnsmessage.ClassINET && (question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA):
+		s.resolve(ctx, &reply, question)
+	case s.Forward != nil:
+		answer, err := s.Forward.Exchange(ctx, query)
+		if err == nil {
+			return answer
+		}
+		logger.Infof("Failed to forward dns query for %s: %s", question.Name, err)
+		reply.RCode = dnsmessage.RCodeServerFailure
+	default:
+		reply.RCode = dnsmessage.RCodeRefused
+	}
+	answer, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return answer
+}
+
+// resolve fills the reply with the addresses of the question's family
+func (s *DNSServer) resolve(ctx context.Context, reply *dnsmessage.Message, question dnsmessage.Question) {
+	name := strings.TrimSuffix(question.Name.String(), ".")
+	ips, ttl, err := LookupTTL(ctx, s.Resolver, name)
+	if err != nil {
+		var notFound *notFoundError
+		var dnsErr *net.DNSError
+		if errors.As(err, &notFound) || errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			reply.RCode = dnsmessage.RCodeNameError
+		} else {
+			logger.Infof("Failed to resolve %s: %s", name, err)
+			reply.RCode = dnsmessage.RCodeServerFailure
+		}
+		return
+	}
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: uint32(ttl / time.Second)}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			body := &dnsmessage.AResource{}
+			copy(body.A[:], ip4)
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: body})
+		} else if ip4 == nil && question.Type == dnsmessage.TypeAAAA {
+			body := &dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], ip.To16())
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: body})
+		}
+	}
+}
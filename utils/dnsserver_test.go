@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/thifnmi/proxy-socks-server/server/acl"
+)
+
+// listenDNS opens UDP and TCP sockets on the same local port
+func listenDNS(t *testing.T) (net.PacketConn, net.Listener, string) {
+	t.Helper()
+	// the TCP port of the same number may be taken, another one is tried
+	var err error
+	for i := 0; i < 10; i++ {
+		var packetConn net.PacketConn
+		packetConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var listener net.Listener
+		listener, err = net.Listen("tcp", packetConn.LocalAddr().String())
+		if err == nil {
+			return packetConn, listener, packetConn.LocalAddr().String()
+		}
+		packetConn.Close()
+	}
+	t.Fatal(err)
+	return nil, nil, ""
+}
+
+// startDNSServer serves s on a local port and returns the address
+func startDNSServer(t *testing.T, s *DNSServer) string {
+	t.Helper()
+	packetConn, listener, addr := listenDNS(t)
+	serveDNS(t, s, packetConn, listener, addr)
+	return addr
+}
+
+// serveDNS serves s on the sockets until the test ends
+func serveDNS(t *testing.T, s *DNSServer, packetConn net.PacketConn, listener net.Listener, addr string) {
+	t.Helper()
+	started := make(chan struct{})
+	go func() {
+		s.serve(addr, packetConn, &notifyListener{Listener: listener, started: started})
+	}()
+	<-started
+	t.Cleanup(func() {
+		packetConn.Close()
+		listener.Close()
+	})
+}
+
+// notifyListener tells when the server started accepting
+type notifyListener struct {
+	net.Listener
+	started chan struct{}
+}
+
+func (l *notifyListener) Accept() (net.Conn, error) {
+	if l.started != nil {
+		close(l.started)
+		l.started = nil
+	}
+	return l.Listener.Accept()
+}
+
+// query asks the server at addr for name over network, it returns nil if
+// there is no answer within 200ms
+func query(t *testing.T, network, addr, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	t.Helper()
+	q, id, err := newQuery(name, qtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var answer []byte
+	switch network {
+	case "udp":
+		answer, err = (&udpUpstream{addr: addr}).exchange(ctx, q)
+	case "tcp":
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", addr); err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		answer, err = exchangeStream(ctx, conn, q)
+	}
+	if err != nil {
+		return nil
+	}
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(answer); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != id {
+		t.Fatalf("answer id %d, want %d", msg.ID, id)
+	}
+	return msg
+}
+
+type fakeExchanger struct{}
+
+func (fakeExchanger) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	return stubAnswer(q), nil
+}
+
+func TestDNSServerAnswers(t *testing.T) {
+	resolver := newFakeResolver(map[string]fakeAnswer{
+		"example.com":    {ips: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, ttl: 30 * time.Second},
+		"broken.example": {err: errors.New("connection refused")},
+	})
+	tests := []struct {
+		name      string
+		forward   Exchanger
+		qname     string
+		qtype     dnsmessage.Type
+		wantRCode dnsmessage.RCode
+		wantIPs   int
+	}{
+		{"a", nil, "example.com", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1},
+		{"aaaa", nil, "example.com", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 1},
+		{"not found", nil, "missing.example", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0},
+		{"failure", nil, "broken.example", dnsmessage.TypeA, dnsmessage.RCodeServerFailure, 0},
+		{"other type refused", nil, "example.com", dnsmessage.TypeMX, dnsmessage.RCodeRefused, 0},
+		{"other type forwarded", fakeExchanger{}, "example.com", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 0},
+	}
+	for _, tt := range tests {
+		addr := startDNSServer(t, &DNSServer{Resolver: resolver, Forward: tt.forward})
+		for _, network := range []string{"udp", "tcp"} {
+			t.Run(tt.name+" "+network, func(t *testing.T) {
+				msg := query(t, network, addr, tt.qname, tt.qtype)
+				if msg == nil {
+					t.Fatal("no answer")
+				}
+				if msg.RCode != tt.wantRCode {
+					t.Errorf("rcode %v, want %v", msg.RCode, tt.wantRCode)
+				}
+				if len(msg.Answers) != tt.wantIPs {
+					t.Errorf("%d answers, want %d", len(msg.Answers), tt.wantIPs)
+				}
+				for _, answer := range msg.Answers {
+					if answer.Header.TTL != 30 {
+						t.Errorf("ttl %d, want 30", answer.Header.TTL)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDNSServerACL(t *testing.T) {
+	resolver := newFakeResolver(map[string]fakeAnswer{
+		"example.com": {ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Minute},
+	})
+	tests := []struct {
+		name   string
+		acl    string
+		answer bool
+	}{
+		{"allowed", `{"allow": ["127.0.0.0/8"]}`, true},
+		{"denied", `{"deny": ["127.0.0.0/8"]}`, false},
+		{"not allowed", `{"allow": ["192.0.2.0/24"]}`, false},
+		{"listener section", `{"deny": ["127.0.0.0/8"], "listeners": {"ADDR": {"allow": ["127.0.0.1"]}}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the listener section needs the address
+			packetConn, listener, addr := listenDNS(t)
+			path := filepath.Join(t.TempDir(), "acl.json")
+			writeFile(t, path, strings.ReplaceAll(tt.acl, "ADDR", addr))
+			clients, err := acl.Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serveDNS(t, &DNSServer{Resolver: resolver, ACL: clients}, packetConn, listener, addr)
+			for _, network := range []string{"udp", "tcp"} {
+				if msg := query(t, network, addr, "example.com", dnsmessage.TypeA); (msg != nil) != tt.answer {
+					t.Errorf("%s answered %v, want %v", network, msg != nil, tt.answer)
+				}
+			}
+		})
+	}
+}
+
+func TestDNSServerOverload(t *testing.T) {
+	resolver := newFakeResolver(map[string]fakeAnswer{
+		"example.com": {ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Minute},
+	})
+	s := &DNSServer{Resolver: resolver}
+	addr := startDNSServer(t, s)
+	// take every slot as if that many queries were being answered
+	for i := 0; i < dnsMaxQueries; i++ {
+		s.queries <- struct{}{}
+	}
+	if msg := query(t, "udp", addr, "example.com", dnsmessage.TypeA); msg != nil {
+		t.Error("query answered beyond the limit")
+	}
+	for i := 0; i < dnsMaxQueries; i++ {
+		<-s.queries
+	}
+	if msg := query(t, "udp", addr, "example.com", dnsmessage.TypeA); msg == nil {
+		t.Error("query not answered after the load went")
+	}
+
+	for i := 0; i < dnsMaxStreams; i++ {
+		s.streams <- struct{}{}
+	}
+	if msg := query(t, "tcp", addr, "example.com", dnsmessage.TypeA); msg != nil {
+		t.Error("connection served beyond the limit")
+	}
+}
+
+func TestDNSServerClose(t *testing.T) {
+	resolver := newFakeResolver(map[string]fakeAnswer{
+		"example.com": {ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Minute},
+	})
+	s := &DNSServer{Resolver: resolver}
+	packetConn, listener, addr := listenDNS(t)
+	defer packetConn.Close()
+	defer listener.Close()
+	started := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(addr, packetConn, &notifyListener{Listener: listener, started: started})
+	}()
+	<-started
+
+	// a client keeping its TCP connection open
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	q, _, err := newQuery("example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := exchangeStream(ctx, conn, q); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Close()
+	select {
+	case err := <-served:
+		if err != ErrDNSServerClosed {
+			t.Errorf("serve() = %v, want %v", err, ErrDNSServerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve() did not return after Close")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read on the open connection = %v, want EOF", err)
+	}
+	if msg := query(t, "udp", addr, "example.com", dnsmessage.TypeA); msg != nil {
+		t.Error("udp answered after Close")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("tcp listener open after Close")
+	}
+	// serving again is refused
+	if err := s.serve(addr, packetConn, listener); err != ErrDNSServerClosed {
+		t.Errorf("serve() after Close = %v, want %v", err, ErrDNSServerClosed)
+	}
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// DoHResolver queries a DNS-over-HTTPS server (RFC 8484)
+type DoHResolver struct {
+	dnsClient
+}
+
+// NewDoHResolver returns a resolver for the server URL, like
+// https://dns.example/dns-query
+func NewDoHResolver(serverURL string, options DNSOptions) (*DoHResolver, error) {
+	upstream, err := newHTTPSUpstream(serverURL, options)
+	if err != nil {
+		return nil, err
+	}
+	return &DoHResolver{newDNSClient(options, upstream)}, nil
+}
+
+func newHTTPSUpstream(serverURL string, options DNSOptions) (*httpsUpstream, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("dns-over-https server must be an https:// URL")
+	}
+	if u.Path == "" {
+		u.Path = "/dns-query"
+	}
+	transport := &http.Transport{
+		DialContext:         options.dial,
+		TLSClientConfig:     options.TLSConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &httpsUpstream{url: u, client: &http.Client{Transport: transport}, useGET: options.UseGET}, nil
+}
+
+// httpsUpstream sends queries as HTTP requests, the HTTP client keeps
+// connections open for later queries
+type httpsUpstream struct {
+	url    *url.URL
+	client *http.Client
+	useGET bool
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url.String()
+}
+
+// close closes the idle connections, connections of running queries are
+// closed by the idle timeout once they complete
+func (u *httpsUpstream) close() {
+	u.client.CloseIdleConnections()
+}
+
+func (u *httpsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	// the ID is 0 so that HTTP caches can share answers, the answer gets
+	// the original one back
+	id := []byte{query[0], query[1]}
+	query = append([]byte{0, 0}, query[2:]...)
+
+	var req *http.Request
+	var err error
+	if u.useGET {
+		getURL := *u.url
+		params := getURL.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		getURL.RawQuery = params.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, getURL.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.url.String(), bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server answered %s", resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, 0xffff))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 2 {
+		return nil, fmt.Errorf("short answer")
+	}
+	copy(answer, id)
+	return answer, nil
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// dohStub answers like a DNS-over-HTTPS server and records the requests
+type dohStub struct {
+	mu      sync.Mutex
+	methods []string
+	ids     []uint16
+}
+
+func (s *dohStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var query []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(req.Body)
+	}
+	if err != nil || len(query) < 12 || req.URL.Path != "/dns-query" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.methods = append(s.methods, req.Method)
+	s.ids = append(s.ids, uint16(query[0])<<8|uint16(query[1]))
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Write(stubAnswer(query))
+}
+
+func startDoHStub(t *testing.T) (*dohStub, *httptest.Server, *x509.CertPool) {
+	t.Helper()
+	stub := &dohStub{}
+	server := httptest.NewTLSServer(stub)
+	t.Cleanup(server.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return stub, server, roots
+}
+
+func TestDoHResolver(t *testing.T) {
+	tests := []struct {
+		name   string
+		useGET bool
+		want   string
+	}{
+		{"post", false, http.MethodPost},
+		{"get", true, http.MethodGet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, server, roots := startDoHStub(t)
+			r, err := NewDoHResolver(server.URL, DNSOptions{UseGET: tt.useGET, TLSConfig: &tls.Config{RootCAs: roots}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			testResolve(t, r)
+
+			stub.mu.Lock()
+			defer stub.mu.Unlock()
+			if len(stub.methods) != 4 {
+				t.Fatalf("%d requests, want 4", len(stub.methods))
+			}
+			for i, method := range stub.methods {
+				if method != tt.want {
+					t.Errorf("request with %s, want %s", method, tt.want)
+				}
+				if stub.ids[i] != 0 {
+					t.Errorf("query id %d, want 0", stub.ids[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDoHResolverErrors(t *testing.T) {
+	_, server, roots := startDoHStub(t)
+	tests := []struct {
+		name    string
+		url     string
+		config  *tls.Config
+		wantErr bool
+	}{
+		{"http url", "http://dns.example/dns-query", nil, true},
+		{"wrong path", server.URL + "/resolve", &tls.Config{RootCAs: roots}, false},
+		{"unknown authority", server.URL, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewDoHResolver(tt.url, DNSOptions{TLSConfig: tt.config})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewDoHResolver() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, _, err := r.ResolveTTL(context.Background(), "example.com"); err == nil {
+				t.Error("ResolveTTL() succeeded")
+			}
+		})
+	}
+}
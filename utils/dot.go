@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// idle connections kept open per DNS-over-TLS server
+const dotIdleConns = 4
+
+// DoTResolver queries a DNS-over-TLS server (RFC 7858)
+type DoTResolver struct {
+	dnsClient
+}
+
+// NewDoTResolver returns a resolver for the server at addr (host:port),
+// the host is also the name its certificate is checked against
+func NewDoTResolver(addr string, options DNSOptions) *DoTResolver {
+	return &DoTResolver{newDNSClient(options, newTLSUpstream(addr, options))}
+}
+
+// tlsUpstream sends queries over TLS connections that are reused for
+// later queries
+type tlsUpstream struct {
+	addr    string
+	config  *tls.Config
+	options DNSOptions
+	idle    chan *tls.Conn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newTLSUpstream(addr string, options DNSOptions) *tlsUpstream {
+	config := &tls.Config{}
+	if options.TLSConfig != nil {
+		config = options.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return &tlsUpstream{addr: addr, config: config, options: options, idle: make(chan *tls.Conn, dotIdleConns)}
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+func (u *tlsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	for {
+		conn, reused, err := u.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		answer, err := exchangeStream(ctx, conn, query)
+		if err == nil {
+			u.release(conn)
+			return answer, nil
+		}
+		conn.Close()
+		// the server may have closed an idle connection, retry on a new one
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// conn returns an idle connection or dials a new one
+func (u *tlsUpstream) conn(ctx context.Context) (*tls.Conn, bool, error) {
+	select {
+	case conn := <-u.idle:
+		return conn, true, nil
+	default:
+	}
+	rawConn, err := u.options.dial(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	conn := tls.Client(rawConn, u.config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+// release keeps the connection for the next query if there is room
+func (u *tlsUpstream) release(conn *tls.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// close closes the idle connections, connections of running queries are
+// closed when they complete
+func (u *tlsUpstream) close() {
+	u.mu.Lock()
+	u.closed = true
+	u.mu.Unlock()
+	for {
+		select {
+		case conn := <-u.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
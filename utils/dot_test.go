@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// startDoTStub serves stubAnswer over TLS with the certificate of an
+// httptest server. Connections are closed after one answer if
+// closeAfterAnswer is set.
+func startDoTStub(t *testing.T, closeAfterAnswer bool) (addr string, roots *x509.CertPool, accepted *int32) {
+	t.Helper()
+	certServer := httptest.NewTLSServer(nil)
+	t.Cleanup(certServer.Close)
+	roots = x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certServer.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted = new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			if closeAfterAnswer {
+				conn = &oneAnswerConn{Conn: conn}
+			}
+			go serveStub(conn)
+		}
+	}()
+	return listener.Addr().String(), roots, accepted
+}
+
+// oneAnswerConn fails reads after the first answer was written
+type oneAnswerConn struct {
+	net.Conn
+	answered bool
+}
+
+func (c *oneAnswerConn) Read(b []byte) (int, error) {
+	if c.answered {
+		c.Conn.Close()
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *oneAnswerConn) Write(b []byte) (int, error) {
+	c.answered = true
+	return c.Conn.Write(b)
+}
+
+func TestDoTResolver(t *testing.T) {
+	addr, roots, accepted := startDoTStub(t, false)
+	r := NewDoTResolver(addr, DNSOptions{TLSConfig: &tls.Config{RootCAs: roots}})
+	for i := 0; i < 3; i++ {
+		testResolve(t, r)
+	}
+	// the A and AAAA queries run in parallel, later queries reuse the
+	// connections
+	if n := atomic.LoadInt32(accepted); n > 2 {
+		t.Errorf("%d connections for 6 queries", n)
+	}
+}
+
+func TestDoTResolverReconnects(t *testing.T) {
+	addr, roots, accepted := startDoTStub(t, true)
+	r := NewDoTResolver(addr, DNSOptions{TLSConfig: &tls.Config{RootCAs: roots}})
+	for i := 0; i < 3; i++ {
+		testResolve(t, r)
+	}
+	if n := atomic.LoadInt32(accepted); n < 3 {
+		t.Errorf("%d connections, closed connections were reused", n)
+	}
+}
+
+func TestDoTResolverVerifiesCertificate(t *testing.T) {
+	addr, roots, _ := startDoTStub(t, false)
+	tests := []struct {
+		name   string
+		config *tls.Config
+	}{
+		{"unknown authority", nil},
+		{"wrong name", &tls.Config{RootCAs: roots, ServerName: "dns.example"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewDoTResolver(addr, DNSOptions{TLSConfig: tt.config})
+			if _, _, err := r.ResolveTTL(context.Background(), "example.com"); err == nil {
+				t.Error("ResolveTTL() succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+)
+
+// fakeIPTTL is the TTL of fake answers, short so that clients ask again
+// before a recycled address could reach them
+const fakeIPTTL = time.Second
+
+// fakeIPRecycleAfter is how long a name must have been neither asked for
+// nor connected to before its addresses can go to another name, so that
+// clients asking for many names can not take the addresses of names in use
+const fakeIPRecycleAfter = 10 * time.Minute
+
+// ErrFakeIPExhausted is returned when every address of the pool is in use
+var ErrFakeIPExhausted = errors.New("fake ip pool exhausted")
+
+var fakeIPBucket = []byte("fakeip")
+
+// FakeIPPool hands out addresses of reserved ranges to domain names and
+// maps them back. The IPv4 range bounds the number of names; each name also
+// gets the IPv6 address at the same offset if an IPv6 range is set. When
+// the pool is exhausted the least recently used name loses its addresses,
+// unless it was used within fakeIPRecycleAfter.
+type FakeIPPool struct {
+	prefix4, prefix6 *net.IPNet
+	size             uint32
+	store            string
+
+	mu       sync.Mutex
+	lru      *list.List // of *fakeIPEntry, most recently used first
+	byName   map[string]*list.Element
+	byOffset map[uint32]*list.Element
+	next     uint32
+	// offsets of the mappings to store on the next flush
+	changed map[uint32]bool
+}
+
+type fakeIPEntry struct {
+	name   string
+	offset uint32
+	used   time.Time
+}
+
+type storedFakeIP struct {
+	Name string `json:"name"`
+	Used int64  `json:"used"`
+}
+
+// NewFakeIPPool returns a pool for the IPv4 range, like 198.18.0.0/15, and
+// the optional IPv6 range. The mappings are kept in the store file if one
+// is given, Flush writes them.
+func NewFakeIPPool(range4, range6, store string) (*FakeIPPool, error) {
+	_, prefix4, err := net.ParseCIDR(range4)
+	if err != nil || prefix4.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid fake ip range %q", range4)
+	}
+	ones, bits := prefix4.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("fake ip range %s is too small", range4)
+	}
+	p := &FakeIPPool{
+		prefix4: prefix4,
+		// the network and broadcast addresses are never handed out
+		size:     uint32(1)<<(bits-ones) - 2,
+		store:    store,
+		lru:      list.New(),
+		byName:   make(map[string]*list.Element),
+		byOffset: make(map[uint32]*list.Element),
+		changed:  make(map[uint32]bool),
+	}
+	if range6 != "" {
+		_, prefix6, err := net.ParseCIDR(range6)
+		if err != nil || prefix6.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid fake ip range %q", range6)
+		}
+		if ones, bits := prefix6.Mask.Size(); bits-ones < 32 {
+			return nil, fmt.Errorf("fake ip range %s must be a /96 or larger", range6)
+		}
+		p.prefix6 = prefix6
+	}
+	if store != "" {
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Assign returns the addresses of name, handing out new ones if it has none
+func (p *FakeIPPool) Assign(name string) (net.IP, net.IP, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.byName[name]; ok {
+		entry := elem.Value.(*fakeIPEntry)
+		entry.used = now
+		p.lru.MoveToFront(elem)
+		p.changed[entry.offset] = true
+		ip4, ip6 := p.addresses(entry.offset)
+		return ip4, ip6, nil
+	}
+	var offset uint32
+	if p.next < p.size {
+		p.next++
+		offset = p.next
+	} else {
+		// recycle the addresses of the least recently used name
+		oldest := p.lru.Back()
+		old := oldest.Value.(*fakeIPEntry)
+		if now.Sub(old.used) < fakeIPRecycleAfter {
+			return nil, nil, ErrFakeIPExhausted
+		}
+		p.lru.Remove(oldest)
+		delete(p.byName, old.name)
+		delete(p.byOffset, old.offset)
+		offset = old.offset
+	}
+	p.insertLocked(&fakeIPEntry{name: name, offset: offset, used: now}, true)
+	p.changed[offset] = true
+	ip4, ip6 := p.addresses(offset)
+	return ip4, ip6, nil
+}
+
+func (p *FakeIPPool) insertLocked(entry *fakeIPEntry, front bool) {
+	var elem *list.Element
+	if front {
+		elem = p.lru.PushFront(entry)
+	} else {
+		elem = p.lru.PushBack(entry)
+	}
+	p.byName[entry.name] = elem
+	p.byOffset[entry.offset] = elem
+}
+
+func (p *FakeIPPool) addresses(offset uint32) (net.IP, net.IP) {
+	ip4 := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip4, binary.BigEndian.Uint32(p.prefix4.IP.To4())+offset)
+	if p.prefix6 == nil {
+		return ip4, nil
+	}
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, p.prefix6.IP)
+	binary.BigEndian.PutUint32(ip6[12:], binary.BigEndian.Uint32(ip6[12:])+offset)
+	return ip4, ip6
+}
+
+// offset returns the position of ip in the pool, false if it is not a
+// fake address
+func (p *FakeIPPool) offset(ip net.IP) (uint32, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		if !p.prefix4.Contains(ip4) {
+			return 0, false
+		}
+		return binary.BigEndian.Uint32(ip4) - binary.BigEndian.Uint32(p.prefix4.IP.To4()), true
+	}
+	// addresses beyond the low 32 bits are not handed out
+	if p.prefix6 == nil || !p.prefix6.Contains(ip) || !ip[:12].Equal(p.prefix6.IP[:12]) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip[12:]) - binary.BigEndian.Uint32(p.prefix6.IP[12:]), true
+}
+
+// Contains reports whether ip lies in a range of the pool
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.offset(ip)
+	return ok
+}
+
+// Lookup returns the name ip was handed out to. The mapping counts as used,
+// but only assignments are stored.
+func (p *FakeIPPool) Lookup(ip net.IP) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	offset, ok := p.offset(ip)
+	if !ok {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.byOffset[offset]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*fakeIPEntry)
+	entry.used = time.Now()
+	p.lru.MoveToFront(elem)
+	return entry.name, true
+}
+
+func (p *FakeIPPool) openStore() (*bolt.DB, error) {
+	return bolt.Open(p.store, 0600, &bolt.Options{Timeout: 5 * time.Second})
+}
+
+// load reads the stored mappings, those outside the current ranges are dropped
+func (p *FakeIPPool) load() error {
+	db, err := p.openStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var entries []*fakeIPEntry
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fakeIPBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var stored storedFakeIP
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			offset, ok := p.offset(net.IP(k))
+			if !ok || offset == 0 || offset > p.size {
+				return nil
+			}
+			entries = append(entries, &fakeIPEntry{name: stored.Name, offset: offset, used: time.Unix(stored.Used, 0)})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	// most recently used first
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].used.After(entries[j].used) })
+	for _, entry := range entries {
+		if _, ok := p.byName[entry.name]; ok {
+			continue
+		}
+		p.insertLocked(entry, false)
+		if entry.offset > p.next {
+			p.next = entry.offset
+		}
+	}
+	return nil
+}
+
+// Flush writes the mappings assigned since the last flush to the store
+func (p *FakeIPPool) Flush() error {
+	if p.store == "" {
+		return nil
+	}
+	p.mu.Lock()
+	if len(p.changed) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	changed := p.changed
+	p.changed = make(map[uint32]bool)
+	stored := make(map[string][]byte, len(changed))
+	for offset := range changed {
+		elem, ok := p.byOffset[offset]
+		if !ok {
+			continue
+		}
+		entry := elem.Value.(*fakeIPEntry)
+		ip4, _ := p.addresses(offset)
+		data, _ := json.Marshal(storedFakeIP{Name: entry.name, Used: entry.used.Unix()})
+		stored[string(ip4)] = data
+	}
+	p.mu.Unlock()
+
+	db, err := p.openStore()
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(fakeIPBucket)
+			if err != nil {
+				return err
+			}
+			for ip, data := range stored {
+				if err := bucket.Put([]byte(ip), data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		db.Close()
+	}
+	if err != nil {
+		// try again on the next flush
+		p.mu.Lock()
+		for offset := range changed {
+			p.changed[offset] = true
+		}
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// FlushEvery flushes periodically, it does not return
+func (p *FakeIPPool) FlushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := p.Flush(); err != nil {
+			logger.Infof("Failed to store fake ip mappings: %s", err)
+		}
+	}
+}
+
+// FakeIPResolver answers names with addresses of a FakeIPPool. Names under
+// the Exclude domains are passed to Real.
+type FakeIPResolver struct {
+	Pool    *FakeIPPool
+	Real    Resolver
+	Exclude []string
+}
+
+func (r *FakeIPResolver) excluded(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range r.Exclude {
+		domain = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(domain, "*."), "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *FakeIPResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	ips, _, err := r.ResolveTTL(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (r *FakeIPResolver) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	if r.excluded(name) {
+		return LookupTTL(ctx, r.Real, name)
+	}
+	ip4, ip6, err := r.Pool.Assign(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ip6 == nil {
+		return []net.IP{ip4}, fakeIPTTL, nil
+	}
+	return []net.IP{ip4, ip6}, fakeIPTTL, nil
+}
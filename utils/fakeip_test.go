@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func assign(t *testing.T, p *FakeIPPool, name string) (net.IP, net.IP) {
+	t.Helper()
+	ip4, ip6, err := p.Assign(name)
+	if err != nil {
+		t.Fatalf("Assign(%q) error = %v", name, err)
+	}
+	return ip4, ip6
+}
+
+// age makes the mapping of name look unused for d
+func age(p *FakeIPPool, name string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.byName[name].Value.(*fakeIPEntry).used = time.Now().Add(-d)
+}
+
+func TestNewFakeIPPool(t *testing.T) {
+	tests := []struct {
+		range4, range6 string
+		wantErr        bool
+	}{
+		{"198.18.0.0/15", "", false},
+		{"198.18.0.0/15", "fc00::/64", false},
+		{"198.18.0.0/31", "", true},
+		{"fc00::/64", "", true},
+		{"198.18.0.0/15", "198.19.0.0/16", true},
+		{"198.18.0.0/15", "fc00::/112", true},
+		{"garbage", "", true},
+	}
+	for _, tt := range tests {
+		_, err := NewFakeIPPool(tt.range4, tt.range6, "")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewFakeIPPool(%q, %q) error = %v, wantErr %v", tt.range4, tt.range6, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFakeIPPoolAssign(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/24", "fc00::/96", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a4, a6 := assign(t, p, "a.example")
+	b4, b6 := assign(t, p, "B.example.")
+	again4, _ := assign(t, p, "A.Example")
+
+	tests := []struct {
+		name string
+		ip   net.IP
+		want string
+		ok   bool
+	}{
+		{"first", a4, "a.example", true},
+		{"first ipv6", a6, "a.example", true},
+		{"normalized", b4, "b.example", true},
+		{"normalized ipv6", b6, "b.example", true},
+		{"same name", again4, "a.example", true},
+		{"network address", net.ParseIP("198.18.0.0"), "", false},
+		{"not handed out", net.ParseIP("198.18.0.200"), "", false},
+		{"outside the range", net.ParseIP("192.0.2.1"), "", false},
+		{"ipv6 beyond the offsets", net.ParseIP("fc00::1:0:1"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, ok := p.Lookup(tt.ip)
+			if name != tt.want || ok != tt.ok {
+				t.Errorf("Lookup(%s) = %q, %v, want %q, %v", tt.ip, name, ok, tt.want, tt.ok)
+			}
+		})
+	}
+	if !a4.Equal(net.ParseIP("198.18.0.1")) || !a6.Equal(net.ParseIP("fc00::1")) {
+		t.Errorf("first addresses %s %s, want 198.18.0.1 fc00::1", a4, a6)
+	}
+	if !p.Contains(net.ParseIP("198.18.0.200")) || p.Contains(net.ParseIP("192.0.2.1")) {
+		t.Error("Contains() does not follow the range")
+	}
+	var nilPool *FakeIPPool
+	if nilPool.Contains(a4) {
+		t.Error("nil pool contains an address")
+	}
+}
+
+func TestFakeIPPoolRecycling(t *testing.T) {
+	// two usable addresses
+	p, err := NewFakeIPPool("198.18.0.0/30", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := assign(t, p, "a.example")
+	b, _ := assign(t, p, "b.example")
+
+	// names in use keep their addresses
+	if _, _, err := p.Assign("c.example"); err != ErrFakeIPExhausted {
+		t.Fatalf("Assign() error = %v, want %v", err, ErrFakeIPExhausted)
+	}
+
+	age(p, "a.example", time.Hour)
+	age(p, "b.example", time.Hour)
+	// a connection to a keeps it in use
+	p.Lookup(a)
+	c, _ := assign(t, p, "c.example")
+	if !c.Equal(b) {
+		t.Errorf("c.example got %s, want the address of b.example %s", c, b)
+	}
+	if name, _ := p.Lookup(b); name != "c.example" {
+		t.Errorf("Lookup(%s) = %q, want c.example", b, name)
+	}
+	if name, _ := p.Lookup(a); name != "a.example" {
+		t.Errorf("Lookup(%s) = %q, want a.example", a, name)
+	}
+}
+
+func TestFakeIPPoolStore(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "fakeip.db")
+	p, err := NewFakeIPPool("198.18.0.0/24", "", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := assign(t, p, "a.example")
+	b, _ := assign(t, p, "b.example")
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// lookups are not written
+	p.Lookup(a)
+	if len(p.changed) != 0 {
+		t.Errorf("lookup marked %d mappings changed", len(p.changed))
+	}
+
+	// a mapping stored by another process is kept by later flushes
+	db, err := bolt.Open(store, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		data, _ := json.Marshal(storedFakeIP{Name: "other.example", Used: time.Now().Unix()})
+		return tx.Bucket(fakeIPBucket).Put(net.ParseIP("198.18.0.9").To4(), data)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assign(t, p, "c.example")
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewFakeIPPool("198.18.0.0/24", "", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   net.IP
+		want string
+	}{
+		{a, "a.example"},
+		{b, "b.example"},
+		{net.ParseIP("198.18.0.3"), "c.example"},
+		{net.ParseIP("198.18.0.9"), "other.example"},
+	}
+	for _, tt := range tests {
+		if name, ok := reloaded.Lookup(tt.ip); !ok || name != tt.want {
+			t.Errorf("Lookup(%s) = %q, %v after reload, want %q", tt.ip, name, ok, tt.want)
+		}
+	}
+	// new names do not take stored addresses
+	if d, _ := assign(t, reloaded, "d.example"); !d.Equal(net.ParseIP("198.18.0.10")) {
+		t.Errorf("d.example got %s, want 198.18.0.10", d)
+	}
+
+	// mappings outside a changed range are dropped
+	smaller, err := NewFakeIPPool("198.18.0.0/29", "", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := smaller.Lookup(net.ParseIP("198.18.0.9")); ok {
+		t.Error("mapping outside the range loaded")
+	}
+	if name, ok := smaller.Lookup(a); !ok || name != "a.example" {
+		t.Errorf("Lookup(%s) = %q, %v", a, name, ok)
+	}
+}
+
+func TestFakeIPResolver(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/24", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := newFakeResolver(map[string]fakeAnswer{
+		"corp.internal":     {ips: []net.IP{net.ParseIP("10.0.0.1")}, ttl: time.Minute},
+		"App.corp.internal": {ips: []net.IP{net.ParseIP("10.0.0.2")}, ttl: time.Minute},
+	})
+	r := &FakeIPResolver{Pool: p, Real: upstream, Exclude: []string{"*.corp.internal"}}
+	tests := []struct {
+		name    string
+		want    string
+		wantTTL time.Duration
+	}{
+		{"example.com", "198.18.0.1", fakeIPTTL},
+		{"corp.internal", "10.0.0.1", time.Minute},
+		{"App.corp.internal", "10.0.0.2", time.Minute},
+		{"192.0.2.1", "192.0.2.1", 0},
+	}
+	for _, tt := range tests {
+		ips, ttl, err := r.ResolveTTL(context.Background(), tt.name)
+		if err != nil {
+			t.Fatalf("ResolveTTL(%q) error = %v", tt.name, err)
+		}
+		if !ips[0].Equal(net.ParseIP(tt.want)) || ttl != tt.wantTTL {
+			t.Errorf("ResolveTTL(%q) = %v, %v, want %s, %v", tt.name, ips, ttl, tt.want, tt.wantTTL)
+		}
+	}
+}
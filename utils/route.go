@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thifnmi/proxy-socks-server/logger"
+)
+
+// Route sends the names under its domains to its own DNS servers
+type Route struct {
+	// Domains like "corp.internal", which also matches its subdomains.
+	// A leading "*." is ignored.
+	Domains []string `json:"domains"`
+	// Servers as accepted by NewDNSResolver, or "system" for the system resolver
+	Servers []string `json:"servers"`
+	// failover, race or roundrobin
+	Strategy string `json:"strategy"`
+	// Addresses of the servers, if their host names need resolving
+	Bootstrap []string `json:"bootstrap"`
+	// Pass the names to the dialer unresolved, Servers may then be empty
+	Remote bool `json:"remote"`
+}
+
+type route struct {
+	suffix string
+	// nil for remote routes without servers
+	resolver Resolver
+	remote   bool
+}
+
+// RoutingResolver answers names from a hosts file first, then picks a
+// resolver by the longest matching domain suffix of a routes file and falls
+// back to Default. Both files are optional and can be reloaded while serving.
+//
+// The routes file lists Routes:
+//
+//	{"routes": [{"domains": ["corp.internal"], "servers": ["10.0.0.53:53"]}]}
+type RoutingResolver struct {
+	Default Resolver
+	// Whether names matching no route are passed to the dialer unresolved
+	DefaultRemote bool
+
+	routesFile, hostsFile string
+	options               DNSOptions
+
+	mu       sync.RWMutex
+	routes   []route // longest suffix first
+	hosts    map[string][]net.IP
+	modTimes map[string]time.Time
+}
+
+// NewRoutingResolver loads the files, empty paths are skipped. Route
+// servers get the given options with their own strategy and bootstrap.
+func NewRoutingResolver(def Resolver, routesFile, hostsFile string, options DNSOptions) (*RoutingResolver, error) {
+	r := &RoutingResolver{Default: def, routesFile: routesFile, hostsFile: hostsFile, options: options}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads both files, the current tables stay in effect if one is invalid
+func (r *RoutingResolver) Reload() error {
+	modTimes := make(map[string]time.Time)
+	var routes []route
+	if r.routesFile != "" {
+		var err error
+		if routes, err = r.loadRoutes(); err != nil {
+			return err
+		}
+		modTimes[r.routesFile] = modTime(r.routesFile)
+	}
+	var hosts map[string][]net.IP
+	if r.hostsFile != "" {
+		var err error
+		if hosts, err = loadHosts(r.hostsFile); err != nil {
+			return err
+		}
+		modTimes[r.hostsFile] = modTime(r.hostsFile)
+	}
+	r.mu.Lock()
+	old := r.routes
+	r.routes, r.hosts, r.modTimes = routes, hosts, modTimes
+	r.mu.Unlock()
+	closeRoutes(old)
+	return nil
+}
+
+// closeRoutes releases the connections of replaced route resolvers
+func closeRoutes(routes []route) {
+	closed := make(map[Resolver]bool)
+	for _, rt := range routes {
+		if closer, ok := rt.resolver.(io.Closer); ok && !closed[rt.resolver] {
+			closed[rt.resolver] = true
+			closer.Close()
+		}
+	}
+}
+
+func (r *RoutingResolver) loadRoutes() ([]route, error) {
+	data, err := os.ReadFile(r.routesFile)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Routes []Route `json:"routes"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid dns routes file %s: %v", r.routesFile, err)
+	}
+	var routes []route
+	for i, rt := range f.Routes {
+		var resolver Resolver
+		if !rt.Remote || len(rt.Servers) > 0 {
+			var err error
+			if resolver, err = rt.resolver(r.options); err != nil {
+				return nil, fmt.Errorf("dns routes file %s, route %d: %v", r.routesFile, i, err)
+			}
+		}
+		for _, domain := range rt.Domains {
+			suffix := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(domain, "*."), "."))
+			routes = append(routes, route{suffix: suffix, resolver: resolver, remote: rt.Remote})
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].suffix) > len(routes[j].suffix) })
+	return routes, nil
+}
+
+func (rt *Route) resolver(options DNSOptions) (Resolver, error) {
+	if len(rt.Servers) == 0 {
+		return nil, fmt.Errorf("no servers")
+	}
+	if len(rt.Servers) == 1 && rt.Servers[0] == "system" {
+		return DefaultResolver{}, nil
+	}
+	strategy, err := ParseStrategy(rt.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	options.Strategy = strategy
+	if len(rt.Bootstrap) > 0 {
+		options.Bootstrap = nil
+		for _, s := range rt.Bootstrap {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid bootstrap address %q", s)
+			}
+			options.Bootstrap = append(options.Bootstrap, ip)
+		}
+	}
+	return NewDNSResolvers(rt.Servers, options)
+}
+
+// loadHosts reads a hosts file: an address followed by names per line,
+// "#" starts a comment. Names listed on several lines get every address.
+func loadHosts(path string) (map[string][]net.IP, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("hosts file %s, line %d: expected an address and names", path, n)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// WatchEvery reloads the files when they change, it does not return
+func (r *RoutingResolver) WatchEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.mu.RLock()
+		changed := false
+		for path, t := range r.modTimes {
+			if !modTime(path).Equal(t) {
+				changed = true
+			}
+		}
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			logger.Infof("Failed to reload dns routes: %s", err)
+			// do not retry until the file changes again
+			r.mu.Lock()
+			for path := range r.modTimes {
+				r.modTimes[path] = modTime(path)
+			}
+			r.mu.Unlock()
+			continue
+		}
+		logger.Info("Reloaded dns routes and hosts")
+	}
+}
+
+// route returns the static addresses of name, or the route matching it,
+// nil for the default
+func (r *RoutingResolver) route(name string) ([]net.IP, *route) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if ips, ok := r.hosts[name]; ok {
+		return ips, nil
+	}
+	for i := range r.routes {
+		if rt := &r.routes[i]; name == rt.suffix || strings.HasSuffix(name, "."+rt.suffix) {
+			return nil, rt
+		}
+	}
+	return nil, nil
+}
+
+// Remote reports whether name is left for the dialer to resolve. Names of
+// the hosts file are always resolved locally.
+func (r *RoutingResolver) Remote(name string) bool {
+	ips, rt := r.route(name)
+	switch {
+	case ips != nil:
+		return false
+	case rt != nil:
+		return rt.remote
+	}
+	return r.DefaultRemote
+}
+
+func (r *RoutingResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	ips, _, err := r.ResolveTTL(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// ResolveTTL passes the TTL of the chosen resolver on. Hosts file entries
+// have no TTL, so a cache asks again for them every time.
+func (r *RoutingResolver) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	ips, rt := r.route(name)
+	if ips != nil {
+		return ips, 0, nil
+	}
+	resolver := r.Default
+	if rt != nil && rt.resolver != nil {
+		resolver = rt.resolver
+	}
+	return LookupTTL(ctx, resolver, name)
+}
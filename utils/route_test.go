@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoutingResolver(t *testing.T) {
+	dir := t.TempDir()
+	routesFile := filepath.Join(dir, "routes.json")
+	hostsFile := filepath.Join(dir, "hosts")
+	corpAddr := startUDPStub(t)
+	writeFile(t, routesFile, `{"routes": [
+		{"domains": ["corp.internal"], "servers": ["`+corpAddr+`"]},
+		{"domains": ["*.remote.corp.internal"], "remote": true},
+		{"domains": ["onion"], "remote": true}
+	]}`)
+	writeFile(t, hostsFile, `
+# static entries
+192.0.2.10 db.corp.internal db
+2001:db8::10 db.corp.internal
+`)
+
+	def := newFakeResolver(map[string]fakeAnswer{
+		"example.com": {ips: []net.IP{net.ParseIP("198.51.100.1")}, ttl: time.Minute},
+	})
+	r, err := NewRoutingResolver(def, routesFile, hostsFile, DNSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		wantIPs    []string
+		wantErr    bool
+		wantRemote bool
+	}{
+		{"db", []string{"192.0.2.10"}, false, false},
+		{"DB.corp.internal.", []string{"192.0.2.10", "2001:db8::10"}, false, false},
+		{"example.com", []string{"198.51.100.1"}, false, false},
+		// routed to the stub, which knows example.com only
+		{"app.corp.internal", nil, true, false},
+		{"app.remote.corp.internal", nil, true, true},
+		{"remote.corp.internal", nil, true, true},
+		{"hidden.onion", nil, false, true},
+		{"192.0.2.99", []string{"192.0.2.99"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.Remote(tt.name); got != tt.wantRemote {
+				t.Errorf("Remote() = %v, want %v", got, tt.wantRemote)
+			}
+			if tt.wantRemote && !tt.wantErr {
+				return
+			}
+			ips, _, err := r.ResolveTTL(context.Background(), tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveTTL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(ips) != len(tt.wantIPs) {
+				t.Fatalf("ResolveTTL() = %v, want %v", ips, tt.wantIPs)
+			}
+			for i := range ips {
+				if !ips[i].Equal(net.ParseIP(tt.wantIPs[i])) {
+					t.Errorf("ResolveTTL() = %v, want %v", ips, tt.wantIPs)
+				}
+			}
+		})
+	}
+	if n := def.count("app.corp.internal"); n != 0 {
+		t.Errorf("routed name sent to the default resolver")
+	}
+}
+
+func TestRoutingResolverReload(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts")
+	writeFile(t, hostsFile, "192.0.2.1 app.example\n")
+	r, err := NewRoutingResolver(newFakeResolver(map[string]fakeAnswer{}), "", hostsFile, DNSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		hosts   string
+		wantErr bool
+		want    string
+	}{
+		{"changed", "192.0.2.2 app.example\n", false, "192.0.2.2"},
+		{"invalid keeps the table", "192.0.2.3\n", true, "192.0.2.2"},
+		{"invalid address", "app.example 192.0.2.3\n", true, "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFile(t, hostsFile, tt.hosts)
+			if err := r.Reload(); (err != nil) != tt.wantErr {
+				t.Fatalf("Reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			ip, err := r.Resolve(context.Background(), "app.example")
+			if err != nil || !ip.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("Resolve() = %v, %v, want %s", ip, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoutingResolverReloadClosesUpstreams(t *testing.T) {
+	addr, roots, _ := startDoTStub(t, false)
+	routesFile := filepath.Join(t.TempDir(), "routes.json")
+	writeFile(t, routesFile, `{"routes": [{"domains": ["example.com", "example.org"], "servers": ["tls://`+addr+`"]}]}`)
+	r, err := NewRoutingResolver(DefaultResolver{}, routesFile, "", DNSOptions{TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, rt := r.route("example.com")
+	upstream := rt.resolver.(*DNSResolver).upstream.(*serverGroup).servers[0].upstream.(*tlsUpstream)
+	if len(upstream.idle) == 0 {
+		t.Fatal("no idle connection kept")
+	}
+	idle := <-upstream.idle
+	upstream.idle <- idle
+
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(upstream.idle) != 0 {
+		t.Errorf("%d idle connections left open after reload", len(upstream.idle))
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("idle connection not closed, read error = %v", err)
+	}
+	// the new resolver works
+	if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+		t.Error(err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxSniffBytes bounds the client data held back while sniffing, a full
+// TLS record
+const maxSniffBytes = 5 + 16384
+
+// sniffedConn replays the bytes read while sniffing before reading on
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Sniff reads the first bytes the client sends, waiting at most timeout for
+// them, and returns the host name of the TLS ClientHello (SNI) or HTTP/1
+// request they start. The returned conn reads the sniffed bytes again.
+// Clients waiting for the server to speak first lose only the timeout.
+func Sniff(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var buf []byte
+	chunk := make([]byte, 2048)
+	host := ""
+	for len(buf) < maxSniffBytes {
+		n, err := conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		var more bool
+		if host, more = sniffTLS(buf); !more && host == "" {
+			host, more = sniffHTTP(buf)
+		}
+		if !more || err != nil {
+			break
+		}
+	}
+	if len(buf) == 0 {
+		return host, conn
+	}
+	return host, &sniffedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf), conn)}
+}
+
+// ResolvesTo reports whether name resolves to ip. A sniffed name is only
+// what the client claims, it may pick the policy only if it is a name of
+// the address that is dialed.
+func ResolvesTo(ctx context.Context, r Resolver, name string, ip net.IP) bool {
+	ips, err := LookupAll(ctx, r, name)
+	if err != nil {
+		return false
+	}
+	for _, resolved := range ips {
+		if resolved.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffTLS returns the server name of a ClientHello, more is set while the
+// data could still become one that is not complete yet
+func sniffTLS(data []byte) (host string, more bool) {
+	// gather the handshake messages of the leading handshake records
+	var handshake []byte
+	for records := 0; len(data) > 0; records++ {
+		if data[0] != 0x16 || len(data) >= 2 && data[1] != 0x03 {
+			if records == 0 {
+				return "", false
+			}
+			break
+		}
+		if len(data) < 5 {
+			return "", true
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			handshake = append(handshake, data[5:]...)
+			break
+		}
+		handshake = append(handshake, data[5:5+length]...)
+		data = data[5+length:]
+	}
+	if len(handshake) < 4 {
+		return "", true
+	}
+	if handshake[0] != 0x01 {
+		return "", false
+	}
+	length := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+	if len(handshake) < 4+length {
+		return "", true
+	}
+	return serverName(handshake[4 : 4+length]), false
+}
+
+// serverName finds the server_name extension of a ClientHello body
+func serverName(hello []byte) string {
+	r := reader(hello)
+	// legacy version and random
+	if !r.skip(2+32) || !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return ""
+	}
+	extensions, ok := r.vector(2)
+	if !ok {
+		return ""
+	}
+	for len(extensions) > 0 {
+		typ, ok1 := extensions.uint16()
+		ext, ok2 := extensions.vector(2)
+		if !ok1 || !ok2 {
+			return ""
+		}
+		if typ != 0 {
+			continue
+		}
+		names, ok := ext.vector(2)
+		for ok && len(names) > 0 {
+			var nameType []byte
+			var name reader
+			if nameType, ok = names.bytes(1); !ok {
+				break
+			}
+			if name, ok = names.vector(2); ok && nameType[0] == 0 {
+				return strings.ToLower(string(name))
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// reader consumes the length prefixed fields of TLS messages
+type reader []byte
+
+func (r *reader) bytes(n int) ([]byte, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b, true
+}
+
+func (r *reader) skip(n int) bool {
+	_, ok := r.bytes(n)
+	return ok
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+// vector reads a field prefixed with its length in lengthBytes bytes
+func (r *reader) vector(lengthBytes int) (reader, bool) {
+	b, ok := r.bytes(lengthBytes)
+	if !ok {
+		return nil, false
+	}
+	length := 0
+	for _, c := range b {
+		length = length<<8 | int(c)
+	}
+	v, ok := r.bytes(length)
+	return reader(v), ok
+}
+
+func (r *reader) skipVector(lengthBytes int) bool {
+	_, ok := r.vector(lengthBytes)
+	return ok
+}
+
+var httpMethods = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE", "CONNECT"}
+
+// sniffHTTP returns the Host header of an HTTP/1 request, more is set while
+// the headers are not complete
+func sniffHTTP(data []byte) (host string, more bool) {
+	start := data
+	if len(start) > 8 {
+		start = start[:8]
+	}
+	method, _, found := strings.Cut(string(start), " ")
+	if !found && len(data) >= 8 {
+		return "", false
+	}
+	known := false
+	for _, m := range httpMethods {
+		if found && method == m || !found && strings.HasPrefix(m, method) {
+			known = true
+		}
+	}
+	if !known {
+		return "", false
+	}
+	head, _, complete := strings.Cut(string(data), "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+	if !complete {
+		// the last line may be cut off
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return "", true
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "host") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(value); err == nil {
+			value = h
+		}
+		value = strings.TrimSuffix(strings.ToLower(value), ".")
+		if net.ParseIP(strings.Trim(value, "[]")) != nil {
+			return "", false
+		}
+		return value, false
+	}
+	return "", !complete
+}
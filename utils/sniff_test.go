@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first bytes a TLS client sends for serverName
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	hello := make([]byte, 4096)
+	n, err := server.Read(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hello[:n]
+}
+
+func TestSniff(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   string
+	}{
+		{"tls", [][]byte{hello}, "www.example.com"},
+		{"tls in pieces", [][]byte{hello[:3], hello[3:40], hello[40:]}, "www.example.com"},
+		{"http", [][]byte{[]byte("GET / HTTP/1.1\r\nUser-Agent: test\r\nHost: Example.org:8080\r\n\r\n")}, "example.org"},
+		{"http in pieces", [][]byte{[]byte("GE"), []byte("T / HTTP/1.1\r\nHo"), []byte("st: example.org\r\n\r\n")}, "example.org"},
+		{"http address", [][]byte{[]byte("GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n")}, ""},
+		{"http without host", [][]byte{[]byte("GET / HTTP/1.0\r\n\r\n")}, ""},
+		{"other protocol", [][]byte{[]byte("SSH-2.0-OpenSSH_9.0\r\n")}, ""},
+		{"server speaks first", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			var sent []byte
+			for _, chunk := range tt.chunks {
+				sent = append(sent, chunk...)
+			}
+			go func() {
+				for _, chunk := range tt.chunks {
+					client.Write(chunk)
+				}
+				// read after the sniffed bytes
+				client.Write([]byte("!"))
+			}()
+			host, conn := Sniff(server, 200*time.Millisecond)
+			if host != tt.want {
+				t.Errorf("Sniff() host = %q, want %q", host, tt.want)
+			}
+			// the sniffed bytes are read again
+			got := make([]byte, len(sent)+1)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(sent)+"!" {
+				t.Errorf("read %q after sniffing, want %q", got, string(sent)+"!")
+			}
+		})
+	}
+}
+
+func TestResolvesTo(t *testing.T) {
+	r := newFakeResolver(map[string]fakeAnswer{
+		"example.com": {ips: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}},
+	})
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"example.com", "192.0.2.1", true},
+		{"example.com", "2001:db8::1", true},
+		{"example.com", "192.0.2.2", false},
+		{"missing.example", "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		if got := ResolvesTo(context.Background(), r, tt.name, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("ResolvesTo(%q, %s) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides how the DNS servers of a resolver are queried
+type Strategy int
+
+const (
+	// Failover queries the servers in order until one answers
+	Failover Strategy = iota
+	// Race queries all servers at once and takes the first answer
+	Race
+	// RoundRobin starts with the next server for every query, then fails over
+	RoundRobin
+)
+
+// ParseStrategy reads "failover", "race" or "roundrobin"
+func ParseStrategy(s string) (Strategy, error) {
+	switch s {
+	case "failover", "":
+		return Failover, nil
+	case "race":
+		return Race, nil
+	case "roundrobin":
+		return RoundRobin, nil
+	}
+	return 0, fmt.Errorf("invalid dns strategy %q", s)
+}
+
+// A server failing this many queries in a row is skipped for a while
+const (
+	unhealthyAfter = 3
+	unhealthyFor   = 30 * time.Second
+)
+
+// RCODEs after which the next server is asked
+const (
+	rcodeServerFailure = 2
+	rcodeRefused       = 5
+)
+
+type server struct {
+	upstream
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+func (s *server) healthy(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(s.downUntil)
+}
+
+func (s *server) record(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ok {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.failures >= unhealthyAfter {
+		s.downUntil = time.Now().Add(unhealthyFor)
+	}
+}
+
+// serverGroup is the upstream of every resolver, it queries its servers
+// following the strategy and gives each attempt its own timeout
+type serverGroup struct {
+	servers  []*server
+	strategy Strategy
+	timeout  time.Duration
+	next     uint32
+}
+
+func newServerGroup(upstreams []upstream, options DNSOptions) *serverGroup {
+	g := &serverGroup{strategy: options.Strategy, timeout: options.timeout()}
+	for _, u := range upstreams {
+		g.servers = append(g.servers, &server{upstream: u})
+	}
+	return g
+}
+
+func (g *serverGroup) String() string {
+	names := make([]string, len(g.servers))
+	for i, s := range g.servers {
+		names[i] = s.String()
+	}
+	return strings.Join(names, ",")
+}
+
+func (g *serverGroup) close() {
+	for _, s := range g.servers {
+		s.close()
+	}
+}
+
+// order returns the servers to try, healthy ones first. Unhealthy servers
+// are only tried when all healthy ones failed.
+func (g *serverGroup) order() []*server {
+	start := 0
+	if g.strategy == RoundRobin {
+		start = int(atomic.AddUint32(&g.next, 1)-1) % len(g.servers)
+	}
+	now := time.Now()
+	var healthy, unhealthy []*server
+	for i := range g.servers {
+		s := g.servers[(start+i)%len(g.servers)]
+		if s.healthy(now) {
+			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, s)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// attempt sends the query to one server. The answer is not ok if the
+// exchange failed or the server answered SERVFAIL or REFUSED.
+func (g *serverGroup) attempt(ctx context.Context, s *server, query []byte) (answer []byte, ok bool, err error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	answer, err = s.exchange(attemptCtx, query)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%s: %w", s, err)
+	case len(answer) < 12:
+		answer, err = nil, fmt.Errorf("%s: short answer", s)
+	case answer[3]&0x0f == rcodeServerFailure || answer[3]&0x0f == rcodeRefused:
+		err = fmt.Errorf("%s: server failure", s)
+	default:
+		ok = true
+	}
+	// attempts cancelled by the caller or by a faster server say nothing
+	// about the health of the server
+	if ctx.Err() == nil {
+		s.record(ok)
+	}
+	return answer, ok, err
+}
+
+func (g *serverGroup) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	servers := g.order()
+	if g.strategy == Race && len(servers) > 1 {
+		return g.race(ctx, servers, query)
+	}
+	// an unsuccessful answer is returned if no server does better
+	var fallback []byte
+	var err error
+	for _, s := range servers {
+		answer, ok, attemptErr := g.attempt(ctx, s, query)
+		if ok {
+			return answer, nil
+		}
+		if attemptErr != nil {
+			err = attemptErr
+		}
+		if answer != nil {
+			fallback = answer
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, err
+}
+
+func (g *serverGroup) race(ctx context.Context, servers []*server, query []byte) ([]byte, error) {
+	// race the healthy servers, or all of them if none is
+	now := time.Now()
+	var racers []*server
+	for _, s := range servers {
+		if s.healthy(now) {
+			racers = append(racers, s)
+		}
+	}
+	if len(racers) == 0 {
+		racers = servers
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		answer []byte
+		ok     bool
+		err    error
+	}
+	results := make(chan result, len(racers))
+	for _, s := range racers {
+		go func(s *server) {
+			answer, ok, err := g.attempt(ctx, s, query)
+			results <- result{answer, ok, err}
+		}(s)
+	}
+	var fallback []byte
+	var err error
+	for range racers {
+		r := <-results
+		if r.ok {
+			return r.answer, nil
+		}
+		if r.err != nil {
+			err = r.err
+		}
+		if r.answer != nil {
+			fallback = r.answer
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUpstream answers every query with rcode after delay, or fails
+type fakeUpstream struct {
+	name  string
+	rcode byte
+	err   error
+	delay time.Duration
+
+	mu      sync.Mutex
+	queries int
+}
+
+func (u *fakeUpstream) String() string {
+	return u.name
+}
+
+func (u *fakeUpstream) close() {}
+
+func (u *fakeUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	u.mu.Lock()
+	u.queries++
+	u.mu.Unlock()
+	select {
+	case <-time.After(u.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if u.err != nil {
+		return nil, u.err
+	}
+	answer := make([]byte, 12)
+	copy(answer, query[:2])
+	answer[2] = 0x80
+	answer[3] = u.rcode
+	// the name of the server as the answer count, to tell answers apart
+	answer[7] = u.name[0]
+	return answer, nil
+}
+
+func (u *fakeUpstream) count() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.queries
+}
+
+func newTestGroup(strategy Strategy, upstreams ...*fakeUpstream) *serverGroup {
+	list := make([]upstream, len(upstreams))
+	for i, u := range upstreams {
+		list[i] = u
+	}
+	return newServerGroup(list, DNSOptions{Strategy: strategy, Timeout: 100 * time.Millisecond})
+}
+
+var testQuery = []byte{0x12, 0x34, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+
+func TestParseStrategy(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Strategy
+		wantErr bool
+	}{
+		{"", Failover, false},
+		{"failover", Failover, false},
+		{"race", Race, false},
+		{"roundrobin", RoundRobin, false},
+		{"random", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStrategy(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseStrategy(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestServerGroupExchange(t *testing.T) {
+	down := errors.New("connection refused")
+	tests := []struct {
+		name      string
+		strategy  Strategy
+		upstreams []*fakeUpstream
+		want      byte
+		wantErr   bool
+	}{
+		{"failover first", Failover, []*fakeUpstream{{name: "a"}, {name: "b"}}, 'a', false},
+		{"failover on error", Failover, []*fakeUpstream{{name: "a", err: down}, {name: "b"}}, 'b', false},
+		{"failover on timeout", Failover, []*fakeUpstream{{name: "a", delay: time.Second}, {name: "b"}}, 'b', false},
+		{"failover on servfail", Failover, []*fakeUpstream{{name: "a", rcode: rcodeServerFailure}, {name: "b"}}, 'b', false},
+		{"failover on refused", Failover, []*fakeUpstream{{name: "a", rcode: rcodeRefused}, {name: "b"}}, 'b', false},
+		{"nxdomain is an answer", Failover, []*fakeUpstream{{name: "a", rcode: 3}, {name: "b"}}, 'a', false},
+		{"servfail if nobody does better", Failover, []*fakeUpstream{{name: "a", rcode: rcodeServerFailure}, {name: "b", err: down}}, 'a', false},
+		{"all down", Failover, []*fakeUpstream{{name: "a", err: down}, {name: "b", err: down}}, 0, true},
+		{"race fastest", Race, []*fakeUpstream{{name: "a", delay: 50 * time.Millisecond}, {name: "b"}}, 'b', false},
+		{"race skips failures", Race, []*fakeUpstream{{name: "a", rcode: rcodeServerFailure}, {name: "b", delay: 10 * time.Millisecond}}, 'b', false},
+		{"race all down", Race, []*fakeUpstream{{name: "a", err: down}, {name: "b", err: down}}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer, err := newTestGroup(tt.strategy, tt.upstreams...).exchange(context.Background(), testQuery)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exchange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && answer[7] != tt.want {
+				t.Errorf("answered by %c, want %c", answer[7], tt.want)
+			}
+		})
+	}
+}
+
+func TestServerGroupRoundRobin(t *testing.T) {
+	upstreams := []*fakeUpstream{{name: "a"}, {name: "b"}, {name: "c"}}
+	g := newTestGroup(RoundRobin, upstreams...)
+	var got []byte
+	for i := 0; i < 4; i++ {
+		answer, err := g.exchange(context.Background(), testQuery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, answer[7])
+	}
+	if string(got) != "abca" {
+		t.Errorf("answered by %s, want abca", got)
+	}
+}
+
+func TestServerGroupSkipsUnhealthy(t *testing.T) {
+	bad := &fakeUpstream{name: "a", err: errors.New("connection refused")}
+	good := &fakeUpstream{name: "b"}
+	g := newTestGroup(Failover, bad, good)
+	for i := 0; i < unhealthyAfter+2; i++ {
+		if _, err := g.exchange(context.Background(), testQuery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := bad.count(); n != unhealthyAfter {
+		t.Errorf("unhealthy server queried %d times, want %d", n, unhealthyAfter)
+	}
+
+	// it is still tried when all servers are unhealthy
+	good.err = bad.err
+	for i := 0; i < unhealthyAfter; i++ {
+		g.exchange(context.Background(), testQuery)
+	}
+	before := bad.count()
+	g.exchange(context.Background(), testQuery)
+	if bad.count() != before+1 {
+		t.Error("unhealthy servers not tried when none is healthy")
+	}
+}
+
+func TestServerGroupCanceled(t *testing.T) {
+	slow := &fakeUpstream{name: "a", delay: time.Second}
+	g := newTestGroup(Failover, slow, &fakeUpstream{name: "b"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.exchange(ctx, testQuery); err == nil {
+		t.Error("exchange() succeeded after cancel")
+	}
+	// a cancelled attempt says nothing about the health of the server
+	if !g.servers[0].healthy(time.Now()) || g.servers[0].failures != 0 {
+		t.Error("cancelled attempt counted as failure")
+	}
+}
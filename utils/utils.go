@@ -2,7 +2,13 @@ package utils
 
 import (
 	"context"
+	"github.com/thifnmi/proxy-socks-server/server/accesslog"
+	"github.com/thifnmi/proxy-socks-server/server/acl"
 	"github.com/thifnmi/proxy-socks-server/server/auth"
+	"github.com/thifnmi/proxy-socks-server/server/connlimit"
+	"github.com/thifnmi/proxy-socks-server/server/policy"
+	"github.com/thifnmi/proxy-socks-server/server/quota"
+	"github.com/thifnmi/proxy-socks-server/server/ratelimit"
 	"net"
 	"time"
 )
@@ -12,12 +18,60 @@ type Config struct {
 	Credentials auth.CredentialStore
 	Resolv      Resolver
 	Dial        func(ctx context.Context, network, addr string) (net.Conn, error)
+	// HappyEyeballs dials the addresses of a destination
+	HappyEyeballs HappyEyeballs
+	// ResolveRemotely reports whether a destination name is passed to Dial
+	// unresolved, for dialers going through a proxy that resolves it. Nil
+	// resolves every name locally.
+	ResolveRemotely func(name string) bool
+	// FakeIP maps addresses handed out by the fake ip DNS server back to
+	// their names, nil disables the mapping
+	FakeIP *FakeIPPool
+	// SniffTimeout is how long CONNECT requests to an address wait for the
+	// first client bytes, to learn the host name from the TLS SNI or HTTP
+	// Host header. Zero disables sniffing.
+	SniffTimeout time.Duration
+	// Policy restricts destinations per user, nil allows everything
+	Policy *policy.Policy
+	// RateLimiter shapes relayed traffic, nil disables shaping
+	RateLimiter *ratelimit.Limiter
+	// Quota enforces per user traffic quotas, nil disables accounting
+	Quota *quota.Tracker
+	// ConnLimiter caps simultaneous sessions, nil means unlimited
+	ConnLimiter *connlimit.Limiter
+	// ACL restricts client addresses per listener, nil allows everyone
+	ACL *acl.ACL
+	// AccessLog records every session when it ends, nil disables it
+	AccessLog *accesslog.Log
 }
 
 type Resolver interface {
 	Resolve(ctx context.Context, name string) (net.IP, error)
 }
 
+// MultiResolver is a Resolver that can return every address of a name
+type MultiResolver interface {
+	Resolver
+	ResolveAll(ctx context.Context, name string) ([]net.IP, error)
+}
+
+// LookupAll returns every address of name the resolver knows, resolvers
+// returning a single address give a single address
+func LookupAll(ctx context.Context, r Resolver, name string) ([]net.IP, error) {
+	switch r := r.(type) {
+	case MultiResolver:
+		return r.ResolveAll(ctx, name)
+	case TTLResolver:
+		ips, _, err := r.ResolveTTL(ctx, name)
+		return ips, err
+	}
+	ip, err := r.Resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return []net.IP{ip}, nil
+}
+
 type DefaultResolver struct{}
 
 func (r DefaultResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
@@ -28,25 +82,23 @@ func (r DefaultResolver) Resolve(ctx context.Context, name string) (net.IP, erro
 	return addr.IP, nil
 }
 
-type CustomResolver struct {
-	netResolver *net.Resolver
+func (r DefaultResolver) ResolveAll(ctx context.Context, name string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
 }
 
-func NewCustomResolver(dnsAddr string) *CustomResolver {
-	return &CustomResolver{
-		netResolver: &net.Resolver{
-			PreferGo: true,
-			Dial: func(_ context.Context, network, address string) (net.Conn, error) {
-				return net.DialTimeout(network, dnsAddr, 3*time.Second)
-			},
-		},
-	}
+// CustomResolver queries a given DNS server directly
+type CustomResolver struct {
+	dnsClient
 }
 
-func (d *CustomResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
-	ips, err := d.netResolver.LookupIP(ctx, "ip", name)
-	if err != nil {
-		return nil, err
-	}
-	return ips[0], nil
+func NewCustomResolver(dnsAddr string) *CustomResolver {
+	return &CustomResolver{newDNSClient(DNSOptions{}, &udpUpstream{addr: dnsAddr})}
 }